@@ -2,19 +2,33 @@ package db
 
 import (
 	"context"
+	"errors"
 	"fmt"
-	"log"
 	"os"
 	"pitchlake-backend/models"
+	"strings"
 	"time"
 
 	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
 	"github.com/jackc/pgx/v5/pgxpool"
 )
 
 type DB struct {
-	Conn *pgx.Conn
-	Pool *pgxpool.Pool
+	Pool    *pgxpool.Pool
+	connStr string
+}
+
+// ErrNotFound is returned when the record a query asks for does not exist.
+var ErrNotFound = errors.New("not found")
+
+// notFound turns pgx.ErrNoRows into ErrNotFound, naming the missing record.
+// Other errors are returned as they are.
+func notFound(err error, format string, args ...any) error {
+	if errors.Is(err, pgx.ErrNoRows) {
+		return fmt.Errorf("%s: %w", fmt.Sprintf(format, args...), ErrNotFound)
+	}
+	return err
 }
 
 func (db *DB) Init() error {
@@ -24,18 +38,80 @@ func (db *DB) Init() error {
 		return fmt.Errorf("unable to parse connection string: %w", err)
 	}
 
-	conn, err := pgx.Connect(context.Background(), connStr)
-	if err != nil {
-		log.Fatal(err)
-	}
-
 	pool, err := pgxpool.NewWithConfig(context.Background(), config)
 	if err != nil {
 		return fmt.Errorf("unable to create connection pool: %w", err)
 	}
 
-	db.Conn = conn
 	db.Pool = pool
+	db.connStr = connStr
+	return nil
+}
+
+// ConnectListener opens a dedicated connection outside of the pool for
+// LISTEN/NOTIFY. The caller owns the connection and must close it.
+func (db *DB) ConnectListener(ctx context.Context) (*pgx.Conn, error) {
+	conn, err := pgx.Connect(ctx, db.connStr)
+	if err != nil {
+		return nil, fmt.Errorf("unable to open listener connection: %w", err)
+	}
+	return conn, nil
+}
+
+// ConnectReplication opens a logical replication connection. The caller owns
+// the connection and must close it.
+func (db *DB) ConnectReplication(ctx context.Context) (*pgconn.PgConn, error) {
+	config, err := pgconn.ParseConfig(db.connStr)
+	if err != nil {
+		return nil, fmt.Errorf("unable to parse connection string: %w", err)
+	}
+	config.RuntimeParams["replication"] = "database"
+	conn, err := pgconn.ConnectConfig(ctx, config)
+	if err != nil {
+		return nil, fmt.Errorf("unable to open replication connection: %w", err)
+	}
+	return conn, nil
+}
+
+// EnsurePublication creates the named publication for the given public
+// tables, or adds the tables it is missing. Only the replication change
+// source needs it, so it is not part of the migrations.
+func (db *DB) EnsurePublication(ctx context.Context, name string, tables []string) error {
+	var exists bool
+	err := db.Pool.QueryRow(ctx, `SELECT EXISTS (SELECT 1 FROM pg_publication WHERE pubname = $1)`, name).Scan(&exists)
+	if err != nil {
+		return fmt.Errorf("checking publication %s: %w", name, err)
+	}
+	published := make(map[string]bool)
+	if exists {
+		rows, err := db.Pool.Query(ctx, `SELECT tablename FROM pg_publication_tables WHERE pubname = $1 AND schemaname = 'public'`, name)
+		if err != nil {
+			return fmt.Errorf("listing tables of publication %s: %w", name, err)
+		}
+		names, err := pgx.CollectRows(rows, pgx.RowTo[string])
+		if err != nil {
+			return fmt.Errorf("listing tables of publication %s: %w", name, err)
+		}
+		for _, table := range names {
+			published[table] = true
+		}
+	}
+	var missing []string
+	for _, table := range tables {
+		if !published[table] {
+			missing = append(missing, pgx.Identifier{"public", table}.Sanitize())
+		}
+	}
+	if len(missing) == 0 {
+		return nil
+	}
+	statement := "ALTER PUBLICATION " + pgx.Identifier{name}.Sanitize() + " ADD TABLE " + strings.Join(missing, ", ")
+	if !exists {
+		statement = "CREATE PUBLICATION " + pgx.Identifier{name}.Sanitize() + " FOR TABLE " + strings.Join(missing, ", ")
+	}
+	if _, err := db.Pool.Exec(ctx, statement); err != nil {
+		return fmt.Errorf("updating publication %s: %w", name, err)
+	}
 	return nil
 }
 
@@ -72,8 +148,8 @@ func (db *DB) GetVaultStateByID(id string) (*models.VaultState, error) {
 
 	if err != nil {
 		fmt.Printf("Error getting vault state by id %s", err.Error())
-		if err == pgx.ErrNoRows {
-			return nil, fmt.Errorf("no vault state found with id %s", id)
+		if errors.Is(err, pgx.ErrNoRows) {
+			return nil, notFound(err, "vault %s", id)
 		}
 		return nil, fmt.Errorf("error scanning vault state: %w", err)
 	}
@@ -193,7 +269,7 @@ func (db *DB) GetBlocks(startTimestamp, endTimestamp, roundDuration uint64) ([]m
 
 // GetAllVaultStates retrieves all VaultState records from the database
 func (db *DB) GetAllVaultStates() ([]models.VaultState, error) {
-	query := `SELECT current_round, current_round_address, unlocked_balance, locked_balance, stashed_balance, address, last_block FROM public."VaultStates"`
+	query := `SELECT current_round, current_round_address, unlocked_balance, locked_balance, stashed_balance, address, latest_block FROM public."VaultStates"`
 	rows, err := db.Pool.Query(context.Background(), query)
 	if err != nil {
 		return nil, err
@@ -225,13 +301,72 @@ func (db *DB) GetAllVaultStates() ([]models.VaultState, error) {
 	return vaultStates, nil
 }
 
+// GetVaultSummaries retrieves every vault together with its current round
+// and the premiums of the round before it. Vaults without rounds have zero
+// round fields.
+func (db *DB) GetVaultSummaries() ([]*models.VaultSummary, error) {
+	query := `
+	SELECT
+		v.address, v.locked_balance + v.unlocked_balance + v.stashed_balance,
+		v.locked_balance, v.unlocked_balance, v.stashed_balance, v.round_duration,
+		v.current_round, v.current_round_address, COALESCE(cur.state, ''),
+		cur.strike_price, cur.cap_level, cur.reserve_price, COALESCE(cur.end_date, 0),
+		prev.premiums
+	FROM
+		public."VaultStates" v
+	LEFT JOIN public."Option_Rounds" cur
+		ON cur.address = v.current_round_address
+	LEFT JOIN public."Option_Rounds" prev
+		ON prev.vault_address = v.address AND prev.round_id = v.current_round - 1
+	ORDER BY
+		v.address ASC;`
+
+	rows, err := db.Pool.Query(context.Background(), query)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var summaries []*models.VaultSummary
+	for rows.Next() {
+		summary := &models.VaultSummary{}
+		err := rows.Scan(
+			&summary.Address,
+			&summary.TVL,
+			&summary.LockedBalance,
+			&summary.UnlockedBalance,
+			&summary.StashedBalance,
+			&summary.RoundDuration,
+			&summary.CurrentRoundID,
+			&summary.CurrentRoundAddress,
+			&summary.RoundState,
+			&summary.StrikePrice,
+			&summary.CapLevel,
+			&summary.ReservePrice,
+			&summary.AuctionEndDate,
+			&summary.LastRoundPremiums,
+		)
+		if err != nil {
+			return nil, err
+		}
+		summaries = append(summaries, summary)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return summaries, nil
+}
+
 // GetOptionRoundByID retrieves an OptionRound record by its ID
 
 func (db *DB) GetOptionRoundByAddress(address string) (*models.OptionRound, error) {
 	var optionRound models.OptionRound
-	query := `SELECT address, round_id, bids, cap_level, starting_block, ending_block, settlement_date, starting_liquidity, queued_liquidity,remaining_liquidity, unsold_liquidity, available_options, settlement_price, strike_price, sold_options, clearing_price, state, premiums, payout_per_option, deployment_date FROM public."Option_Rounds" WHERE address=$1`
+	query := `SELECT address, vault_address, round_id, cap_level, start_date, end_date, settlement_date, starting_liquidity, queued_liquidity, remaining_liquidity, unsold_liquidity, available_options, reserve_price, settlement_price, strike_price, sold_options, clearing_price, state, premiums, payout_per_option, deployment_date FROM public."Option_Rounds" WHERE address=$1`
 	err := db.Pool.QueryRow(context.Background(), query, address).Scan(
 		&optionRound.Address,
+		&optionRound.VaultAddress,
 		&optionRound.RoundID,
 		&optionRound.CapLevel,
 		&optionRound.AuctionStartDate,
@@ -242,6 +377,7 @@ func (db *DB) GetOptionRoundByAddress(address string) (*models.OptionRound, erro
 		&optionRound.RemainingLiquidity,
 		&optionRound.UnsoldLiquidity,
 		&optionRound.AvailableOptions,
+		&optionRound.ReservePrice,
 		&optionRound.SettlementPrice,
 		&optionRound.StrikePrice,
 		&optionRound.OptionsSold,
@@ -252,7 +388,7 @@ func (db *DB) GetOptionRoundByAddress(address string) (*models.OptionRound, erro
 		&optionRound.DeploymentDate,
 	)
 	if err != nil {
-		return nil, err
+		return nil, notFound(err, "option round %s", address)
 	}
 	return &optionRound, nil
 }
@@ -298,7 +434,7 @@ func (db *DB) GetLiquidityProviderStateByAddress(address, vaultAddress string) (
 		&liquidityProviderState.LatestBlock,
 	)
 	if err != nil {
-		return nil, err
+		return nil, notFound(err, "liquidity provider %s in vault %s", address, vaultAddress)
 	}
 	return &liquidityProviderState, nil
 }
@@ -334,45 +470,11 @@ func (db *DB) GetOptionBuyerByAddress(address string) ([]*models.OptionBuyer, er
 		}
 
 		// Fetch associated bids for this optionBuyer
-		bidQuery := `SELECT buyer_address, round_address, bid_id, tree_nonce, amount, price 
-		             FROM public."Bids" WHERE buyer_address=$1 AND round_address=$2`
-		bidRows, err := db.Pool.Query(context.Background(), bidQuery, optionBuyer.Address, optionBuyer.RoundAddress)
-
+		bids, err := db.GetBidsByBuyer(optionBuyer.Address, optionBuyer.RoundAddress)
 		if err != nil {
-			if err == pgx.ErrNoRows {
-				// If no rows are found, initialize an empty slice for bids
-				optionBuyer.Bids = []*models.Bid{}
-			} else {
-				return nil, err
-			}
-		} else {
-			defer bidRows.Close()
-
-			var bids []*models.Bid
-			for bidRows.Next() {
-				var bid models.Bid
-				err := bidRows.Scan(
-					&bid.BuyerAddress,
-					&bid.RoundAddress,
-					&bid.BidID,
-					&bid.TreeNonce,
-					&bid.Amount,
-					&bid.Price,
-				)
-				if err != nil {
-					return nil, err
-				}
-				bids = append(bids, &bid)
-			}
-
-			// Check for errors after finishing iteration
-			if err = bidRows.Err(); err != nil {
-				return nil, err
-			}
-
-			// Attach bids to the optionBuyer
-			optionBuyer.Bids = bids
+			return nil, err
 		}
+		optionBuyer.Bids = bids
 
 		optionBuyers = append(optionBuyers, &optionBuyer)
 	}
@@ -385,4 +487,176 @@ func (db *DB) GetOptionBuyerByAddress(address string) ([]*models.OptionBuyer, er
 	return optionBuyers, nil
 }
 
-// GetAllOptionBuyers retrieves all OptionBuyer records from the database
+// GetOptionBuyer retrieves the OptionBuyer record of address in a single
+// round, together with its bids
+func (db *DB) GetOptionBuyer(address, roundAddress string) (*models.OptionBuyer, error) {
+	var optionBuyer models.OptionBuyer
+	query := `SELECT address, round_address, mintable_options, refundable_amount, has_minted, has_refunded 
+	          FROM public."Option_Buyers" WHERE address=$1 AND round_address=$2`
+	err := db.Pool.QueryRow(context.Background(), query, address, roundAddress).Scan(
+		&optionBuyer.Address,
+		&optionBuyer.RoundAddress,
+		&optionBuyer.MintableOptions,
+		&optionBuyer.RefundableOptions,
+		&optionBuyer.HasMinted,
+		&optionBuyer.HasRefunded,
+	)
+	if err != nil {
+		return nil, notFound(err, "option buyer %s in round %s", address, roundAddress)
+	}
+	bids, err := db.GetBidsByBuyer(optionBuyer.Address, optionBuyer.RoundAddress)
+	if err != nil {
+		return nil, err
+	}
+	optionBuyer.Bids = bids
+	return &optionBuyer, nil
+}
+
+// GetQueuedLiquidity retrieves the liquidity an LP has queued for withdrawal
+// from a round
+func (db *DB) GetQueuedLiquidity(address, roundAddress string) (*models.QueuedLiquidity, error) {
+	var queuedLiquidity models.QueuedLiquidity
+	query := `SELECT address, round_address, bps, queued_liquidity FROM public."Queued_Liquidity" WHERE address=$1 AND round_address=$2`
+	err := db.Pool.QueryRow(context.Background(), query, address, roundAddress).Scan(
+		&queuedLiquidity.Address,
+		&queuedLiquidity.RoundAddress,
+		&queuedLiquidity.Bps,
+		&queuedLiquidity.QueuedLiquidity,
+	)
+	if err != nil {
+		return nil, notFound(err, "queued liquidity of %s in round %s", address, roundAddress)
+	}
+	return &queuedLiquidity, nil
+}
+
+// GetBidsByBuyer retrieves the bids placed by a buyer in a round
+func (db *DB) GetBidsByBuyer(buyerAddress, roundAddress string) ([]*models.Bid, error) {
+	bids := []*models.Bid{}
+	query := `SELECT buyer_address, round_address, bid_id, tree_nonce, amount, price 
+	          FROM public."Bids" WHERE buyer_address=$1 AND round_address=$2`
+	rows, err := db.Pool.Query(context.Background(), query, buyerAddress, roundAddress)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var bid models.Bid
+		err := rows.Scan(
+			&bid.BuyerAddress,
+			&bid.RoundAddress,
+			&bid.BidID,
+			&bid.TreeNonce,
+			&bid.Amount,
+			&bid.Price,
+		)
+		if err != nil {
+			return nil, err
+		}
+		bids = append(bids, &bid)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	return bids, nil
+}
+
+// GetBid retrieves a single bid by its round and bid id
+func (db *DB) GetBid(roundAddress, bidID string) (*models.Bid, error) {
+	var bid models.Bid
+	query := `SELECT buyer_address, round_address, bid_id, tree_nonce, amount, price 
+	          FROM public."Bids" WHERE round_address=$1 AND bid_id=$2`
+	err := db.Pool.QueryRow(context.Background(), query, roundAddress, bidID).Scan(
+		&bid.BuyerAddress,
+		&bid.RoundAddress,
+		&bid.BidID,
+		&bid.TreeNonce,
+		&bid.Amount,
+		&bid.Price,
+	)
+	if err != nil {
+		return nil, notFound(err, "bid %s in round %s", bidID, roundAddress)
+	}
+	return &bid, nil
+}
+
+// GetTwapStates retrieves the confirmed and unconfirmed TWAP state of a
+// window
+func (db *DB) GetTwapStates(windowType models.TwapWindowType) ([]models.TwapState, error) {
+	query := `SELECT window_type, weighted_sum, total_seconds, is_confirmed, twap_value, last_block_number, last_block_timestamp
+	FROM public."twap_state"
+	WHERE window_type = $1
+	ORDER BY is_confirmed DESC`
+
+	rows, err := db.Pool.Query(context.Background(), query, string(windowType))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	twapStates := []models.TwapState{}
+	for rows.Next() {
+		twapState, err := scanTwapState(rows)
+		if err != nil {
+			return nil, err
+		}
+		twapStates = append(twapStates, *twapState)
+	}
+	if rows.Err() != nil {
+		return nil, rows.Err()
+	}
+	return twapStates, nil
+}
+
+// GetTwapState retrieves the TWAP state of a window on the confirmed or
+// unconfirmed chain
+func (db *DB) GetTwapState(windowType models.TwapWindowType, isConfirmed bool) (*models.TwapState, error) {
+	query := `SELECT window_type, weighted_sum, total_seconds, is_confirmed, twap_value, last_block_number, last_block_timestamp
+	FROM public."twap_state"
+	WHERE window_type = $1 AND is_confirmed = $2`
+	twapState, err := scanTwapState(db.Pool.QueryRow(context.Background(), query, string(windowType), isConfirmed))
+	if err != nil {
+		return nil, notFound(err, "twap state %s", windowType)
+	}
+	return twapState, nil
+}
+
+func scanTwapState(row pgx.Row) (*models.TwapState, error) {
+	var twapState models.TwapState
+	var windowType string
+	err := row.Scan(
+		&windowType,
+		&twapState.WeightedSum,
+		&twapState.TotalSeconds,
+		&twapState.IsConfirmed,
+		&twapState.TwapValue,
+		&twapState.LastBlockNumber,
+		&twapState.LastBlockTimestamp,
+	)
+	if err != nil {
+		return nil, err
+	}
+	twapState.WindowType = models.TwapWindowType(windowType)
+	return &twapState, nil
+}
+
+// GetBlockByNumber retrieves a single block by its number
+func (db *DB) GetBlockByNumber(blockNumber uint64) (*models.Block, error) {
+	var block models.Block
+	query := `SELECT block_number, timestamp, basefee, is_confirmed, twelve_min_twap, three_hour_twap, thirty_day_twap 
+	FROM public."blocks" WHERE block_number=$1`
+	err := db.Pool.QueryRow(context.Background(), query, blockNumber).Scan(
+		&block.BlockNumber,
+		&block.Timestamp,
+		&block.BaseFee,
+		&block.IsConfirmed,
+		&block.TwelveMinTwap,
+		&block.ThreeHourTwap,
+		&block.ThirtyDayTwap,
+	)
+	if err != nil {
+		return nil, notFound(err, "block %d", blockNumber)
+	}
+	return &block, nil
+}
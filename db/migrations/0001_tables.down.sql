@@ -0,0 +1,6 @@
+DROP TABLE IF EXISTS public."blocks";
+DROP TABLE IF EXISTS public."Bids";
+DROP TABLE IF EXISTS public."Option_Buyers";
+DROP TABLE IF EXISTS public."Liquidity_Providers";
+DROP TABLE IF EXISTS public."Option_Rounds";
+DROP TABLE IF EXISTS public."VaultStates";
@@ -0,0 +1,88 @@
+CREATE TABLE IF NOT EXISTS public."VaultStates" (
+    address                 TEXT PRIMARY KEY,
+    current_round           NUMERIC NOT NULL DEFAULT 0,
+    current_round_address   TEXT NOT NULL DEFAULT '',
+    unlocked_balance        NUMERIC NOT NULL DEFAULT 0,
+    locked_balance          NUMERIC NOT NULL DEFAULT 0,
+    stashed_balance         NUMERIC NOT NULL DEFAULT 0,
+    latest_block            NUMERIC NOT NULL DEFAULT 0,
+    deployment_date         BIGINT NOT NULL DEFAULT 0,
+    fossil_client_address   TEXT NOT NULL DEFAULT '',
+    eth_address             TEXT NOT NULL DEFAULT '',
+    option_round_class_hash TEXT NOT NULL DEFAULT '',
+    alpha                   NUMERIC NOT NULL DEFAULT 0,
+    strike_level            NUMERIC NOT NULL DEFAULT 0,
+    auction_duration        BIGINT NOT NULL DEFAULT 0,
+    round_duration          BIGINT NOT NULL DEFAULT 0,
+    round_transition_period BIGINT NOT NULL DEFAULT 0
+);
+
+CREATE TABLE IF NOT EXISTS public."Option_Rounds" (
+    address             TEXT PRIMARY KEY,
+    vault_address       TEXT NOT NULL,
+    round_id            NUMERIC NOT NULL,
+    cap_level           NUMERIC NOT NULL DEFAULT 0,
+    start_date          BIGINT NOT NULL DEFAULT 0,
+    end_date            BIGINT NOT NULL DEFAULT 0,
+    settlement_date     BIGINT NOT NULL DEFAULT 0,
+    starting_liquidity  NUMERIC NOT NULL DEFAULT 0,
+    queued_liquidity    NUMERIC NOT NULL DEFAULT 0,
+    remaining_liquidity NUMERIC NOT NULL DEFAULT 0,
+    unsold_liquidity    NUMERIC NOT NULL DEFAULT 0,
+    available_options   NUMERIC NOT NULL DEFAULT 0,
+    reserve_price       NUMERIC NOT NULL DEFAULT 0,
+    settlement_price    NUMERIC NOT NULL DEFAULT 0,
+    strike_price        NUMERIC NOT NULL DEFAULT 0,
+    sold_options        NUMERIC NOT NULL DEFAULT 0,
+    clearing_price      NUMERIC NOT NULL DEFAULT 0,
+    state               TEXT NOT NULL DEFAULT 'Open',
+    premiums            NUMERIC NOT NULL DEFAULT 0,
+    payout_per_option   NUMERIC NOT NULL DEFAULT 0,
+    deployment_date     BIGINT NOT NULL DEFAULT 0
+);
+
+CREATE INDEX IF NOT EXISTS option_rounds_vault_address_idx ON public."Option_Rounds" (vault_address, round_id);
+
+CREATE TABLE IF NOT EXISTS public."Liquidity_Providers" (
+    address          TEXT NOT NULL,
+    vault_address    TEXT NOT NULL,
+    unlocked_balance NUMERIC NOT NULL DEFAULT 0,
+    locked_balance   NUMERIC NOT NULL DEFAULT 0,
+    stashed_balance  NUMERIC NOT NULL DEFAULT 0,
+    latest_block     NUMERIC NOT NULL DEFAULT 0,
+    PRIMARY KEY (address, vault_address)
+);
+
+CREATE TABLE IF NOT EXISTS public."Option_Buyers" (
+    address           TEXT NOT NULL,
+    round_address     TEXT NOT NULL,
+    mintable_options  NUMERIC NOT NULL DEFAULT 0,
+    refundable_amount NUMERIC NOT NULL DEFAULT 0,
+    has_minted        BOOLEAN NOT NULL DEFAULT FALSE,
+    has_refunded      BOOLEAN NOT NULL DEFAULT FALSE,
+    PRIMARY KEY (address, round_address)
+);
+
+CREATE TABLE IF NOT EXISTS public."Bids" (
+    buyer_address TEXT NOT NULL,
+    round_address TEXT NOT NULL,
+    bid_id        TEXT NOT NULL,
+    tree_nonce    TEXT NOT NULL DEFAULT '',
+    amount        NUMERIC NOT NULL DEFAULT 0,
+    price         NUMERIC NOT NULL DEFAULT 0,
+    PRIMARY KEY (round_address, bid_id)
+);
+
+CREATE INDEX IF NOT EXISTS bids_buyer_idx ON public."Bids" (buyer_address, round_address);
+
+CREATE TABLE IF NOT EXISTS public."blocks" (
+    block_number    BIGINT PRIMARY KEY,
+    timestamp       BIGINT NOT NULL,
+    basefee         NUMERIC NOT NULL DEFAULT 0,
+    is_confirmed    BOOLEAN NOT NULL DEFAULT FALSE,
+    twelve_min_twap NUMERIC NOT NULL DEFAULT 0,
+    three_hour_twap NUMERIC NOT NULL DEFAULT 0,
+    thirty_day_twap NUMERIC NOT NULL DEFAULT 0
+);
+
+CREATE INDEX IF NOT EXISTS blocks_timestamp_idx ON public."blocks" (timestamp);
@@ -0,0 +1,15 @@
+DROP TRIGGER IF EXISTS confirmed_update ON public."blocks";
+DROP TRIGGER IF EXISTS confirmed_insert ON public."blocks";
+DROP TRIGGER IF EXISTS unconfirmed_insert ON public."blocks";
+DROP TRIGGER IF EXISTS bids_update ON public."Bids";
+DROP TRIGGER IF EXISTS ob_update ON public."Option_Buyers";
+DROP TRIGGER IF EXISTS or_update ON public."Option_Rounds";
+DROP TRIGGER IF EXISTS vault_update ON public."VaultStates";
+DROP TRIGGER IF EXISTS lp_row_update ON public."Liquidity_Providers";
+
+DROP FUNCTION IF EXISTS notify_confirmed_insert();
+DROP FUNCTION IF EXISTS notify_unconfirmed_insert();
+DROP FUNCTION IF EXISTS notify_ob_update();
+DROP FUNCTION IF EXISTS notify_bids_update();
+DROP FUNCTION IF EXISTS notify_row_change();
+DROP FUNCTION IF EXISTS notify_send(TEXT, TEXT, TEXT, JSONB, TEXT[]);
@@ -0,0 +1,151 @@
+-- Every trigger sends {"operation": TG_OP, "payload": row} on its channel.
+-- Rows too large for the 8000 byte NOTIFY limit are sent in reference mode,
+-- {"operation": TG_OP, "table": TG_TABLE_NAME, "key": {...}}, and fetched by
+-- the server. The channel is the first trigger argument and the primary key
+-- columns of the table are the remaining ones.
+CREATE OR REPLACE FUNCTION notify_send(channel TEXT, operation TEXT, table_name TEXT, row_json JSONB, key_columns TEXT[])
+RETURNS VOID AS $$
+DECLARE
+    payload  TEXT;
+    key_json JSONB := '{}'::JSONB;
+    col      TEXT;
+BEGIN
+    payload := jsonb_build_object('operation', operation, 'payload', row_json)::TEXT;
+    IF octet_length(payload) > 7900 THEN
+        FOREACH col IN ARRAY key_columns LOOP
+            key_json := key_json || jsonb_build_object(col, row_json -> col);
+        END LOOP;
+        payload := jsonb_build_object('operation', operation, 'table', table_name, 'key', key_json)::TEXT;
+    END IF;
+    PERFORM pg_notify(channel, payload);
+END;
+$$ LANGUAGE plpgsql;
+
+CREATE OR REPLACE FUNCTION notify_row_change()
+RETURNS TRIGGER AS $$
+DECLARE
+    row_json JSONB;
+BEGIN
+    IF TG_OP = 'DELETE' THEN
+        row_json := to_jsonb(OLD);
+    ELSE
+        row_json := to_jsonb(NEW);
+    END IF;
+    PERFORM notify_send(TG_ARGV[0], TG_OP, TG_TABLE_NAME, row_json, TG_ARGV[1:TG_NARGS - 1]);
+    RETURN NULL;
+END;
+$$ LANGUAGE plpgsql;
+
+-- Bids are keyed on "address" in the payload rather than buyer_address.
+CREATE OR REPLACE FUNCTION notify_bids_update()
+RETURNS TRIGGER AS $$
+DECLARE
+    row_json JSONB;
+BEGIN
+    IF TG_OP = 'DELETE' THEN
+        row_json := to_jsonb(OLD);
+    ELSE
+        row_json := to_jsonb(NEW);
+    END IF;
+    row_json := (row_json - 'buyer_address') || jsonb_build_object('address', row_json -> 'buyer_address');
+    PERFORM notify_send('bids_update', TG_OP, TG_TABLE_NAME, row_json, ARRAY['round_address', 'bid_id']);
+    RETURN NULL;
+END;
+$$ LANGUAGE plpgsql;
+
+-- Option buyers are sent together with their bids in the round.
+CREATE OR REPLACE FUNCTION notify_ob_update()
+RETURNS TRIGGER AS $$
+DECLARE
+    row_json JSONB;
+BEGIN
+    IF TG_OP = 'DELETE' THEN
+        row_json := to_jsonb(OLD);
+    ELSE
+        row_json := to_jsonb(NEW);
+    END IF;
+    row_json := row_json || jsonb_build_object('bids', COALESCE((
+        SELECT jsonb_agg((to_jsonb(b) - 'buyer_address') || jsonb_build_object('address', b.buyer_address))
+        FROM public."Bids" b
+        WHERE b.buyer_address = row_json ->> 'address'
+          AND b.round_address = row_json ->> 'round_address'
+    ), '[]'::JSONB));
+    PERFORM notify_send('ob_update', TG_OP, TG_TABLE_NAME, row_json, ARRAY['address', 'round_address']);
+    RETURN NULL;
+END;
+$$ LANGUAGE plpgsql;
+
+-- Newly indexed blocks are pushed one by one while unconfirmed.
+CREATE OR REPLACE FUNCTION notify_unconfirmed_insert()
+RETURNS TRIGGER AS $$
+BEGIN
+    IF NOT NEW.is_confirmed THEN
+        PERFORM pg_notify('unconfirmed_insert', row_to_json(NEW)::TEXT);
+    END IF;
+    RETURN NULL;
+END;
+$$ LANGUAGE plpgsql;
+
+-- Confirmed blocks are announced once per statement as a timestamp range.
+CREATE OR REPLACE FUNCTION notify_confirmed_insert()
+RETURNS TRIGGER AS $$
+DECLARE
+    confirmed_range RECORD;
+BEGIN
+    SELECT min(timestamp) AS start_timestamp, max(timestamp) AS end_timestamp
+    INTO confirmed_range
+    FROM changed_blocks
+    WHERE is_confirmed;
+    IF confirmed_range.end_timestamp IS NOT NULL THEN
+        PERFORM pg_notify('confirmed_insert', json_build_object(
+            'start_timestamp', confirmed_range.start_timestamp,
+            'end_timestamp', confirmed_range.end_timestamp
+        )::TEXT);
+    END IF;
+    RETURN NULL;
+END;
+$$ LANGUAGE plpgsql;
+
+-- Databases set up before migrations have these triggers installed by hand,
+-- so they are replaced rather than created.
+DROP TRIGGER IF EXISTS lp_row_update ON public."Liquidity_Providers";
+CREATE TRIGGER lp_row_update
+AFTER INSERT OR UPDATE OR DELETE ON public."Liquidity_Providers"
+FOR EACH ROW EXECUTE FUNCTION notify_row_change('lp_update', 'address', 'vault_address');
+
+DROP TRIGGER IF EXISTS vault_update ON public."VaultStates";
+CREATE TRIGGER vault_update
+AFTER INSERT OR UPDATE OR DELETE ON public."VaultStates"
+FOR EACH ROW EXECUTE FUNCTION notify_row_change('vault_update', 'address');
+
+DROP TRIGGER IF EXISTS or_update ON public."Option_Rounds";
+CREATE TRIGGER or_update
+AFTER INSERT OR UPDATE OR DELETE ON public."Option_Rounds"
+FOR EACH ROW EXECUTE FUNCTION notify_row_change('or_update', 'address');
+
+DROP TRIGGER IF EXISTS ob_update ON public."Option_Buyers";
+CREATE TRIGGER ob_update
+AFTER INSERT OR UPDATE OR DELETE ON public."Option_Buyers"
+FOR EACH ROW EXECUTE FUNCTION notify_ob_update();
+
+DROP TRIGGER IF EXISTS bids_update ON public."Bids";
+CREATE TRIGGER bids_update
+AFTER INSERT OR UPDATE OR DELETE ON public."Bids"
+FOR EACH ROW EXECUTE FUNCTION notify_bids_update();
+
+DROP TRIGGER IF EXISTS unconfirmed_insert ON public."blocks";
+CREATE TRIGGER unconfirmed_insert
+AFTER INSERT ON public."blocks"
+FOR EACH ROW EXECUTE FUNCTION notify_unconfirmed_insert();
+
+DROP TRIGGER IF EXISTS confirmed_insert ON public."blocks";
+CREATE TRIGGER confirmed_insert
+AFTER INSERT ON public."blocks"
+REFERENCING NEW TABLE AS changed_blocks
+FOR EACH STATEMENT EXECUTE FUNCTION notify_confirmed_insert();
+
+DROP TRIGGER IF EXISTS confirmed_update ON public."blocks";
+CREATE TRIGGER confirmed_update
+AFTER UPDATE ON public."blocks"
+REFERENCING NEW TABLE AS changed_blocks
+FOR EACH STATEMENT EXECUTE FUNCTION notify_confirmed_insert();
@@ -0,0 +1 @@
+DROP PUBLICATION IF EXISTS pitchlake_db_server;
@@ -0,0 +1,3 @@
+-- The publication consumed by CDC_SOURCE=replication is created by the
+-- server when that source starts, named by REPLICATION_PUBLICATION, so that
+-- migrating does not need publication privileges with the LISTEN source.
@@ -0,0 +1,2 @@
+DROP TRIGGER IF EXISTS ql_update ON public."Queued_Liquidity";
+DROP TABLE IF EXISTS public."Queued_Liquidity";
@@ -0,0 +1,13 @@
+-- Liquidity an LP has queued for withdrawal at the end of a round.
+CREATE TABLE IF NOT EXISTS public."Queued_Liquidity" (
+    address          TEXT NOT NULL,
+    round_address    TEXT NOT NULL,
+    bps              NUMERIC NOT NULL DEFAULT 0,
+    queued_liquidity NUMERIC NOT NULL DEFAULT 0,
+    PRIMARY KEY (address, round_address)
+);
+
+DROP TRIGGER IF EXISTS ql_update ON public."Queued_Liquidity";
+CREATE TRIGGER ql_update
+AFTER INSERT OR UPDATE OR DELETE ON public."Queued_Liquidity"
+FOR EACH ROW EXECUTE FUNCTION notify_row_change('ql_update', 'address', 'round_address');
@@ -0,0 +1,2 @@
+DROP TRIGGER IF EXISTS twap_update ON public."twap_state";
+DROP TABLE IF EXISTS public."twap_state";
@@ -0,0 +1,17 @@
+-- Running TWAP accumulators maintained by the indexer, one row per window
+-- for the confirmed and for the unconfirmed chain.
+CREATE TABLE IF NOT EXISTS public."twap_state" (
+    window_type          TEXT NOT NULL,
+    is_confirmed         BOOLEAN NOT NULL DEFAULT FALSE,
+    weighted_sum         NUMERIC NOT NULL DEFAULT 0,
+    total_seconds        NUMERIC NOT NULL DEFAULT 0,
+    twap_value           NUMERIC NOT NULL DEFAULT 0,
+    last_block_number    BIGINT NOT NULL DEFAULT 0,
+    last_block_timestamp BIGINT NOT NULL DEFAULT 0,
+    PRIMARY KEY (window_type, is_confirmed)
+);
+
+DROP TRIGGER IF EXISTS twap_update ON public."twap_state";
+CREATE TRIGGER twap_update
+AFTER INSERT OR UPDATE OR DELETE ON public."twap_state"
+FOR EACH ROW EXECUTE FUNCTION notify_row_change('twap_update', 'window_type', 'is_confirmed');
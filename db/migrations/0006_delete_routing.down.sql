@@ -0,0 +1,28 @@
+ALTER TABLE public."twap_state" REPLICA IDENTITY DEFAULT;
+ALTER TABLE public."Queued_Liquidity" REPLICA IDENTITY DEFAULT;
+ALTER TABLE public."Bids" REPLICA IDENTITY DEFAULT;
+ALTER TABLE public."Option_Buyers" REPLICA IDENTITY DEFAULT;
+ALTER TABLE public."Liquidity_Providers" REPLICA IDENTITY DEFAULT;
+ALTER TABLE public."Option_Rounds" REPLICA IDENTITY DEFAULT;
+ALTER TABLE public."VaultStates" REPLICA IDENTITY DEFAULT;
+
+DROP TRIGGER IF EXISTS or_update ON public."Option_Rounds";
+CREATE TRIGGER or_update
+AFTER INSERT OR UPDATE OR DELETE ON public."Option_Rounds"
+FOR EACH ROW EXECUTE FUNCTION notify_row_change('or_update', 'address');
+
+CREATE OR REPLACE FUNCTION notify_bids_update()
+RETURNS TRIGGER AS $$
+DECLARE
+    row_json JSONB;
+BEGIN
+    IF TG_OP = 'DELETE' THEN
+        row_json := to_jsonb(OLD);
+    ELSE
+        row_json := to_jsonb(NEW);
+    END IF;
+    row_json := (row_json - 'buyer_address') || jsonb_build_object('address', row_json -> 'buyer_address');
+    PERFORM notify_send('bids_update', TG_OP, TG_TABLE_NAME, row_json, ARRAY['round_address', 'bid_id']);
+    RETURN NULL;
+END;
+$$ LANGUAGE plpgsql;
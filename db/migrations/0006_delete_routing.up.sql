@@ -0,0 +1,31 @@
+-- Deletes can only be routed with the columns sent for them. Reference
+-- payloads carry the key columns, so add the ones subscribers are matched
+-- on, and have logical replication send the whole old row.
+CREATE OR REPLACE FUNCTION notify_bids_update()
+RETURNS TRIGGER AS $$
+DECLARE
+    row_json JSONB;
+BEGIN
+    IF TG_OP = 'DELETE' THEN
+        row_json := to_jsonb(OLD);
+    ELSE
+        row_json := to_jsonb(NEW);
+    END IF;
+    row_json := (row_json - 'buyer_address') || jsonb_build_object('address', row_json -> 'buyer_address');
+    PERFORM notify_send('bids_update', TG_OP, TG_TABLE_NAME, row_json, ARRAY['round_address', 'bid_id', 'address']);
+    RETURN NULL;
+END;
+$$ LANGUAGE plpgsql;
+
+DROP TRIGGER IF EXISTS or_update ON public."Option_Rounds";
+CREATE TRIGGER or_update
+AFTER INSERT OR UPDATE OR DELETE ON public."Option_Rounds"
+FOR EACH ROW EXECUTE FUNCTION notify_row_change('or_update', 'address', 'vault_address');
+
+ALTER TABLE public."VaultStates" REPLICA IDENTITY FULL;
+ALTER TABLE public."Option_Rounds" REPLICA IDENTITY FULL;
+ALTER TABLE public."Liquidity_Providers" REPLICA IDENTITY FULL;
+ALTER TABLE public."Option_Buyers" REPLICA IDENTITY FULL;
+ALTER TABLE public."Bids" REPLICA IDENTITY FULL;
+ALTER TABLE public."Queued_Liquidity" REPLICA IDENTITY FULL;
+ALTER TABLE public."twap_state" REPLICA IDENTITY FULL;
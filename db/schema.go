@@ -0,0 +1,261 @@
+package db
+
+import (
+	"context"
+	"fmt"
+)
+
+// columnKind is the family of Postgres types a column must belong to for
+// the Go field it is scanned into.
+type columnKind string
+
+const (
+	kindText         columnKind = "text"
+	kindNumber       columnKind = "number"
+	kindBoolean      columnKind = "boolean"
+	kindNumberOrText columnKind = "number or text"
+)
+
+// kindTypes lists the information_schema data types accepted for each kind.
+var kindTypes = map[columnKind][]string{
+	kindText:         {"text", "character varying", "character"},
+	kindNumber:       {"numeric", "bigint", "integer", "smallint"},
+	kindBoolean:      {"boolean"},
+	kindNumberOrText: {"numeric", "bigint", "integer", "smallint", "text", "character varying", "character"},
+}
+
+// schemaColumns is the type family expected for every column read by the
+// queries in this package, keyed by table.
+var schemaColumns = map[string]map[string]columnKind{
+	"VaultStates": {
+		"current_round":           kindNumber,
+		"current_round_address":   kindText,
+		"unlocked_balance":        kindNumber,
+		"locked_balance":          kindNumber,
+		"stashed_balance":         kindNumber,
+		"address":                 kindText,
+		"latest_block":            kindNumber,
+		"deployment_date":         kindNumber,
+		"fossil_client_address":   kindText,
+		"eth_address":             kindText,
+		"option_round_class_hash": kindText,
+		"alpha":                   kindNumber,
+		"strike_level":            kindNumber,
+		"auction_duration":        kindNumber,
+		"round_duration":          kindNumber,
+		"round_transition_period": kindNumber,
+	},
+	"Option_Rounds": {
+		"address":             kindText,
+		"vault_address":       kindText,
+		"round_id":            kindNumber,
+		"cap_level":           kindNumber,
+		"start_date":          kindNumber,
+		"end_date":            kindNumber,
+		"settlement_date":     kindNumber,
+		"starting_liquidity":  kindNumber,
+		"queued_liquidity":    kindNumber,
+		"remaining_liquidity": kindNumber,
+		"unsold_liquidity":    kindNumber,
+		"available_options":   kindNumber,
+		"reserve_price":       kindNumber,
+		"settlement_price":    kindNumber,
+		"strike_price":        kindNumber,
+		"sold_options":        kindNumber,
+		"clearing_price":      kindNumber,
+		"state":               kindText,
+		"premiums":            kindNumber,
+		"payout_per_option":   kindNumber,
+		"deployment_date":     kindNumber,
+	},
+	"Liquidity_Providers": {
+		"address":          kindText,
+		"vault_address":    kindText,
+		"unlocked_balance": kindNumber,
+		"locked_balance":   kindNumber,
+		"stashed_balance":  kindNumber,
+		"latest_block":     kindNumber,
+	},
+	"Option_Buyers": {
+		"address":           kindText,
+		"round_address":     kindText,
+		"mintable_options":  kindNumber,
+		"refundable_amount": kindNumber,
+		"has_minted":        kindBoolean,
+		"has_refunded":      kindBoolean,
+	},
+	"Queued_Liquidity": {
+		"address":          kindText,
+		"round_address":    kindText,
+		"bps":              kindNumber,
+		"queued_liquidity": kindNumber,
+	},
+	"Bids": {
+		"buyer_address": kindText,
+		"round_address": kindText,
+		"bid_id":        kindNumberOrText,
+		"tree_nonce":    kindNumberOrText,
+		"amount":        kindNumber,
+		"price":         kindNumber,
+	},
+	"twap_state": {
+		"window_type":          kindText,
+		"weighted_sum":         kindNumberOrText,
+		"total_seconds":        kindNumber,
+		"is_confirmed":         kindBoolean,
+		"twap_value":           kindNumberOrText,
+		"last_block_number":    kindNumber,
+		"last_block_timestamp": kindNumber,
+	},
+	"blocks": {
+		"block_number":    kindNumber,
+		"timestamp":       kindNumber,
+		"basefee":         kindNumberOrText,
+		"is_confirmed":    kindBoolean,
+		"twelve_min_twap": kindNumberOrText,
+		"three_hour_twap": kindNumberOrText,
+		"thirty_day_twap": kindNumberOrText,
+	},
+}
+
+// schemaDependency lists the columns a query reads from a table. Keep it in
+// sync with the queries in this package.
+type schemaDependency struct {
+	query   string
+	table   string
+	columns []string
+}
+
+var (
+	vaultStateColumns  = []string{"current_round", "current_round_address", "unlocked_balance", "locked_balance", "stashed_balance", "address", "latest_block", "deployment_date", "fossil_client_address", "eth_address", "option_round_class_hash", "alpha", "strike_level", "auction_duration", "round_duration", "round_transition_period"}
+	optionRoundColumns = []string{"address", "vault_address", "round_id", "cap_level", "start_date", "end_date", "settlement_date", "starting_liquidity", "queued_liquidity", "remaining_liquidity", "unsold_liquidity", "available_options", "reserve_price", "settlement_price", "strike_price", "sold_options", "clearing_price", "state", "premiums", "payout_per_option", "deployment_date"}
+	optionBuyerColumns = []string{"address", "round_address", "mintable_options", "refundable_amount", "has_minted", "has_refunded"}
+	bidColumns         = []string{"buyer_address", "round_address", "bid_id", "tree_nonce", "amount", "price"}
+	twapStateColumns   = []string{"window_type", "weighted_sum", "total_seconds", "is_confirmed", "twap_value", "last_block_number", "last_block_timestamp"}
+	blockColumns       = []string{"block_number", "timestamp", "basefee", "is_confirmed", "twelve_min_twap", "three_hour_twap", "thirty_day_twap"}
+)
+
+var schemaDependencies = []schemaDependency{
+	{"GetVaultStateByID", "VaultStates", vaultStateColumns},
+	{"GetAllVaultStates", "VaultStates", []string{"current_round", "current_round_address", "unlocked_balance", "locked_balance", "stashed_balance", "address", "latest_block"}},
+	{"GetVaultAddresses", "VaultStates", []string{"address"}},
+	{"GetVaultSummaries", "VaultStates", []string{"address", "locked_balance", "unlocked_balance", "stashed_balance", "round_duration", "current_round", "current_round_address"}},
+	{"GetVaultSummaries", "Option_Rounds", []string{"address", "vault_address", "round_id", "state", "strike_price", "cap_level", "reserve_price", "end_date", "premiums"}},
+	{"GetOptionRoundsByVaultAddress", "Option_Rounds", optionRoundColumns},
+	{"GetOptionRoundByAddress", "Option_Rounds", optionRoundColumns},
+	{"GetLiquidityProviderStateByAddress", "Liquidity_Providers", []string{"address", "vault_address", "unlocked_balance", "locked_balance", "stashed_balance", "latest_block"}},
+	{"GetOptionBuyerByAddress", "Option_Buyers", optionBuyerColumns},
+	{"GetOptionBuyer", "Option_Buyers", optionBuyerColumns},
+	{"GetQueuedLiquidity", "Queued_Liquidity", []string{"address", "round_address", "bps", "queued_liquidity"}},
+	{"GetBidsByBuyer", "Bids", bidColumns},
+	{"GetBid", "Bids", bidColumns},
+	{"GetBlocks", "blocks", blockColumns},
+	{"GetBlockByNumber", "blocks", blockColumns},
+	{"GetTwapStates", "twap_state", twapStateColumns},
+	{"GetTwapState", "twap_state", twapStateColumns},
+}
+
+// SchemaMismatch is a table or column the db package depends on that is
+// missing from the database or has an incompatible type.
+type SchemaMismatch struct {
+	Table   string   `json:"table"`
+	Column  string   `json:"column,omitempty"`
+	Problem string   `json:"problem"`
+	Queries []string `json:"queries"`
+}
+
+func (m SchemaMismatch) String() string {
+	if m.Column == "" {
+		return fmt.Sprintf("table %q: %s (used by %v)", m.Table, m.Problem, m.Queries)
+	}
+	return fmt.Sprintf("column %q.%s: %s (used by %v)", m.Table, m.Column, m.Problem, m.Queries)
+}
+
+// VerifySchema compares the public schema, as reported by
+// information_schema, against every table and column the queries in this
+// package read. It returns one mismatch per missing table, missing column or
+// column of an incompatible type.
+func (db *DB) VerifySchema(ctx context.Context) ([]SchemaMismatch, error) {
+	rows, err := db.Pool.Query(ctx, `SELECT table_name, column_name, data_type
+	FROM information_schema.columns
+	WHERE table_schema = 'public'`)
+	if err != nil {
+		return nil, fmt.Errorf("error reading information_schema: %w", err)
+	}
+	defer rows.Close()
+
+	tables := make(map[string]map[string]string)
+	for rows.Next() {
+		var table, column, dataType string
+		if err := rows.Scan(&table, &column, &dataType); err != nil {
+			return nil, err
+		}
+		if tables[table] == nil {
+			tables[table] = make(map[string]string)
+		}
+		tables[table][column] = dataType
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return compareSchema(tables), nil
+}
+
+// compareSchema checks the columns found in the database, keyed by table
+// and column name, against schemaDependencies.
+func compareSchema(tables map[string]map[string]string) []SchemaMismatch {
+	// Collect the queries depending on every table and column so that each
+	// mismatch is reported once with all of its users.
+	type column struct{ table, name string }
+	users := make(map[column][]string)
+	var order []column
+	for _, dep := range schemaDependencies {
+		for _, name := range append([]string{""}, dep.columns...) {
+			c := column{dep.table, name}
+			if _, seen := users[c]; !seen {
+				order = append(order, c)
+			}
+			if len(users[c]) == 0 || users[c][len(users[c])-1] != dep.query {
+				users[c] = append(users[c], dep.query)
+			}
+		}
+	}
+
+	var mismatches []SchemaMismatch
+	for _, c := range order {
+		columns, ok := tables[c.table]
+		if c.name == "" {
+			if !ok {
+				mismatches = append(mismatches, SchemaMismatch{Table: c.table, Problem: "missing", Queries: users[c]})
+			}
+			continue
+		}
+		if !ok {
+			continue
+		}
+		dataType, ok := columns[c.name]
+		if !ok {
+			mismatches = append(mismatches, SchemaMismatch{Table: c.table, Column: c.name, Problem: "missing", Queries: users[c]})
+			continue
+		}
+		if kind := schemaColumns[c.table][c.name]; !kindAccepts(kind, dataType) {
+			mismatches = append(mismatches, SchemaMismatch{
+				Table:   c.table,
+				Column:  c.name,
+				Problem: fmt.Sprintf("has type %s, expected %s", dataType, kind),
+				Queries: users[c],
+			})
+		}
+	}
+	return mismatches
+}
+
+func kindAccepts(kind columnKind, dataType string) bool {
+	for _, t := range kindTypes[kind] {
+		if t == dataType {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,119 @@
+package db
+
+import (
+	"reflect"
+	"testing"
+)
+
+// expectedSchema returns the columns of schemaColumns, each with the first
+// type its kind accepts.
+func expectedSchema() map[string]map[string]string {
+	tables := make(map[string]map[string]string)
+	for table, columns := range schemaColumns {
+		tables[table] = make(map[string]string)
+		for column, kind := range columns {
+			tables[table][column] = kindTypes[kind][0]
+		}
+	}
+	return tables
+}
+
+func TestSchemaDependenciesHaveKinds(t *testing.T) {
+	for _, dep := range schemaDependencies {
+		for _, column := range dep.columns {
+			if _, ok := kindTypes[schemaColumns[dep.table][column]]; !ok {
+				t.Errorf("%s reads %s.%s, which has no kind in schemaColumns", dep.query, dep.table, column)
+			}
+		}
+	}
+}
+
+func TestCompareSchema(t *testing.T) {
+	tests := []struct {
+		name   string
+		change func(tables map[string]map[string]string)
+		want   []SchemaMismatch
+	}{
+		{
+			name:   "expected schema",
+			change: func(map[string]map[string]string) {},
+		},
+		{
+			name: "extra tables and columns",
+			change: func(tables map[string]map[string]string) {
+				tables["schema_migrations"] = map[string]string{"version": "bigint"}
+				tables["Bids"]["created_at"] = "timestamp without time zone"
+			},
+		},
+		{
+			name: "missing table",
+			change: func(tables map[string]map[string]string) {
+				delete(tables, "Bids")
+			},
+			want: []SchemaMismatch{{Table: "Bids", Problem: "missing", Queries: []string{"GetBidsByBuyer", "GetBid"}}},
+		},
+		{
+			name: "missing column",
+			change: func(tables map[string]map[string]string) {
+				delete(tables["VaultStates"], "alpha")
+			},
+			want: []SchemaMismatch{{Table: "VaultStates", Column: "alpha", Problem: "missing", Queries: []string{"GetVaultStateByID"}}},
+		},
+		{
+			name: "missing column read by several queries",
+			change: func(tables map[string]map[string]string) {
+				delete(tables["VaultStates"], "address")
+			},
+			want: []SchemaMismatch{{
+				Table:   "VaultStates",
+				Column:  "address",
+				Problem: "missing",
+				Queries: []string{"GetVaultStateByID", "GetAllVaultStates", "GetVaultAddresses", "GetVaultSummaries"},
+			}},
+		},
+		{
+			name: "type mismatch",
+			change: func(tables map[string]map[string]string) {
+				tables["Option_Rounds"]["state"] = "integer"
+				tables["twap_state"]["is_confirmed"] = "text"
+			},
+			want: []SchemaMismatch{
+				{
+					Table:   "Option_Rounds",
+					Column:  "state",
+					Problem: "has type integer, expected text",
+					Queries: []string{"GetVaultSummaries", "GetOptionRoundsByVaultAddress", "GetOptionRoundByAddress"},
+				},
+				{
+					Table:   "twap_state",
+					Column:  "is_confirmed",
+					Problem: "has type text, expected boolean",
+					Queries: []string{"GetTwapStates", "GetTwapState"},
+				},
+			},
+		},
+		{
+			name: "number or text",
+			change: func(tables map[string]map[string]string) {
+				tables["Bids"]["bid_id"] = "character varying"
+				tables["Bids"]["tree_nonce"] = "bigint"
+				tables["blocks"]["basefee"] = "boolean"
+			},
+			want: []SchemaMismatch{{
+				Table:   "blocks",
+				Column:  "basefee",
+				Problem: "has type boolean, expected number or text",
+				Queries: []string{"GetBlocks", "GetBlockByNumber"},
+			}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tables := expectedSchema()
+			tt.change(tables)
+			if got := compareSchema(tables); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("compareSchema = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -2,18 +2,23 @@ module pitchlake-backend
 
 go 1.22.5
 
-require github.com/joho/godotenv v1.5.1
+require (
+	github.com/jackc/pglogrepl v0.0.0-20240307033717-828fbfe908e9
+	github.com/joho/godotenv v1.5.1
+)
 
 require (
+	github.com/jackc/pgio v1.0.0 // indirect
 	github.com/jackc/pgpassfile v1.0.0 // indirect
 	github.com/jackc/pgservicefile v0.0.0-20240606120523-5a60cdf6a761 // indirect
 	github.com/jackc/puddle/v2 v2.2.2 // indirect
 	golang.org/x/sync v0.8.0 // indirect
+	golang.org/x/sys v0.25.0 // indirect
 )
 
 require (
 	github.com/coder/websocket v1.8.12
 	github.com/jackc/pgx/v5 v5.7.1
-	golang.org/x/crypto v0.27.0 // indirect
+	golang.org/x/crypto v0.27.0
 	golang.org/x/text v0.18.0 // indirect
 )
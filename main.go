@@ -2,11 +2,15 @@ package main
 
 import (
 	"context"
+	"errors"
+	"fmt"
 	"log"
 	"net/http"
 	"os"
 	"os/signal"
+	"pitchlake-backend/db"
 	"pitchlake-backend/server"
+	"strconv"
 	"time"
 
 	"github.com/joho/godotenv"
@@ -17,25 +21,106 @@ func main() {
 
 	//Load env
 	_ = godotenv.Load(".env")
-	err := run()
+	var err error
+	if len(os.Args) > 1 {
+		err = runCommand(os.Args[1:])
+	} else {
+		err = run()
+	}
 	if err != nil {
 		log.Fatal(err)
 	}
 }
 
+// runCommand runs a maintenance subcommand instead of the server.
+//
+//	migrate up           apply every pending migration
+//	migrate down [n]     revert the last n migrations (default 1)
+//	migrate status       list migrations and whether they are applied
+//	doctor               check the schema against the db package's queries
+func runCommand(args []string) error {
+	switch args[0] {
+	case "migrate":
+		return migrate(args[1:])
+	case "doctor":
+		return doctor()
+	default:
+		return fmt.Errorf("unknown command %q", args[0])
+	}
+}
+
+func migrate(args []string) error {
+	if len(args) == 0 {
+		return errors.New("usage: migrate up|down [n]|status")
+	}
+	ctx := context.Background()
+	database := &db.DB{}
+	if err := database.Init(); err != nil {
+		return err
+	}
+	defer database.Pool.Close()
+
+	switch args[0] {
+	case "up":
+		applied, err := database.MigrateUp(ctx)
+		for _, m := range applied {
+			log.Printf("applied %04d_%s", m.Version, m.Name)
+		}
+		if err == nil && len(applied) == 0 {
+			log.Printf("no pending migrations")
+		}
+		return err
+	case "down":
+		steps := 1
+		if len(args) > 1 {
+			n, err := strconv.Atoi(args[1])
+			if err != nil || n < 1 {
+				return fmt.Errorf("invalid number of migrations %q", args[1])
+			}
+			steps = n
+		}
+		reverted, err := database.MigrateDown(ctx, steps)
+		for _, m := range reverted {
+			log.Printf("reverted %04d_%s", m.Version, m.Name)
+		}
+		return err
+	case "status":
+		statuses, err := database.MigrationStatus(ctx)
+		if err != nil {
+			return err
+		}
+		for _, s := range statuses {
+			if s.Applied {
+				log.Printf("%04d_%s\tapplied %s", s.Version, s.Name, s.AppliedAt.Format(time.RFC3339))
+			} else {
+				log.Printf("%04d_%s\tpending", s.Version, s.Name)
+			}
+		}
+		return nil
+	default:
+		return fmt.Errorf("unknown migrate command %q", args[0])
+	}
+}
+
 // run starts a http.Server for the passed in address
 // with all requests handled by echoServer.
-// NOTE: Triggers for the DB are created once and not mentioned in the plugin code
+// NOTE: The tables and notification triggers are installed by the embedded
+// migrations in db/migrations, see `migrate up`.
 // LP Trigger: lp_row_update
 // Vault Trigger: vault_update
-// State Transition: state_transition(can be OR trigger on the state field)
 // OB Trigger: ob_update
-// OR Trigger:or_update
+// OR Trigger: or_update
+// Bids Trigger: bids_update
+// QL Trigger: ql_update
+// TWAP Trigger: twap_update
+// Blocks Triggers: unconfirmed_insert, confirmed_insert, confirmed_update
 func run() error {
 
-	ctx, cancel := context.WithTimeout(context.Background(), time.Second*10)
-	defer cancel()
-	dbs := server.NewDBServer(ctx)
+	dbs, err := server.NewDBServer(context.Background())
+	if err != nil {
+		return err
+	}
+	defer dbs.Close()
 	s := &http.Server{
 		Addr:         ":8080",
 		Handler:      dbs,
@@ -57,5 +142,30 @@ func run() error {
 		log.Printf("terminating: %v", sig)
 	}
 
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*10)
+	defer cancel()
 	return s.Shutdown(ctx)
 }
+
+// doctor reports every table and column the db package depends on that is
+// missing or has an incompatible type, and fails if there are any.
+func doctor() error {
+	database := &db.DB{}
+	if err := database.Init(); err != nil {
+		return err
+	}
+	defer database.Pool.Close()
+
+	mismatches, err := database.VerifySchema(context.Background())
+	if err != nil {
+		return err
+	}
+	for _, m := range mismatches {
+		log.Printf("%s", m)
+	}
+	if len(mismatches) > 0 {
+		return fmt.Errorf("%d schema mismatches", len(mismatches))
+	}
+	log.Printf("schema OK")
+	return nil
+}
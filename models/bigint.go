@@ -39,6 +39,13 @@ func (b *BigInt) Scan(value interface{}) error {
 
 func (b *BigInt) scanString(s string) error {
 	s = strings.TrimSpace(s)
+	base := 10
+	if strings.HasPrefix(s, "0x") || strings.HasPrefix(s, "0X") {
+		s, base = s[2:], 16
+	}
+	if _, ok := b.Int.SetString(s, base); !ok {
+		return fmt.Errorf("invalid uint256 value %q", s)
+	}
 	return b.validateUint256()
 }
 
@@ -72,6 +72,27 @@ type VaultState struct {
 	RoundTransitionPeriod uint64 `json:"roundTransitionPeriod"`
 }
 
+// VaultSummary condenses a vault and its current round for the home page.
+type VaultSummary struct {
+	Address             string `json:"address"`
+	TVL                 BigInt `json:"tvl"`
+	LockedBalance       BigInt `json:"lockedBalance"`
+	UnlockedBalance     BigInt `json:"unlockedBalance"`
+	StashedBalance      BigInt `json:"stashedBalance"`
+	RoundDuration       uint64 `json:"roundDuration"`
+	CurrentRoundID      BigInt `json:"currentRoundId"`
+	CurrentRoundAddress string `json:"currentRoundAddress"`
+	RoundState          string `json:"roundState"`
+	StrikePrice         BigInt `json:"strikePrice"`
+	CapLevel            BigInt `json:"capLevel"`
+	ReservePrice        BigInt `json:"reservePrice"`
+	AuctionEndDate      uint64 `json:"auctionEndDate"`
+	// AuctionEndsIn is the number of seconds until the current auction
+	// ends, zero once it has ended.
+	AuctionEndsIn     uint64 `json:"auctionEndsIn"`
+	LastRoundPremiums BigInt `json:"lastRoundPremiums"`
+}
+
 type LiquidityProviderState struct {
 	VaultAddress    string `json:"vaultAddress"`
 	Address         string `json:"address"`
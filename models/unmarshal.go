@@ -248,10 +248,10 @@ func (t *TwapState) UnmarshalJSON(data []byte) error {
 	// Auxiliary struct to map JSON keys
 	aux := struct {
 		WindowType         TwapWindowType `json:"window_type"`
-		WeightedSum        string         `json:"weighted_sum"`
+		WeightedSum        json.Number    `json:"weighted_sum"`
 		TotalSeconds       BigInt         `json:"total_seconds"`
 		IsConfirmed        bool           `json:"is_confirmed"`
-		TwapValue          string         `json:"twap_value"`
+		TwapValue          json.Number    `json:"twap_value"`
 		LastBlockNumber    uint64         `json:"last_block_number"`
 		LastBlockTimestamp uint64         `json:"last_block_timestamp"`
 	}{}
@@ -263,10 +263,10 @@ func (t *TwapState) UnmarshalJSON(data []byte) error {
 
 	// Copy data from aux to the original struct
 	t.WindowType = aux.WindowType
-	t.WeightedSum = aux.WeightedSum
+	t.WeightedSum = aux.WeightedSum.String()
 	t.TotalSeconds = aux.TotalSeconds
 	t.IsConfirmed = aux.IsConfirmed
-	t.TwapValue = aux.TwapValue
+	t.TwapValue = aux.TwapValue.String()
 	t.LastBlockNumber = aux.LastBlockNumber
 	t.LastBlockTimestamp = aux.LastBlockTimestamp
 
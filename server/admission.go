@@ -0,0 +1,182 @@
+package server
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"pitchlake-backend/starknet"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/coder/websocket"
+)
+
+// admissionConfig controls which websocket connections are accepted and
+// how much a client may send.
+type admissionConfig struct {
+	// originPatterns are the hosts of the origins allowed to connect, from
+	// APP_URL, as path.Match patterns. Any origin is allowed when it is
+	// empty.
+	originPatterns []string
+	maxConnections int
+	maxPerIP       int
+	readLimit      int64
+	// trustProxy takes the client IP from the X-Forwarded-For entry added
+	// by the load balancer instead of the TCP peer.
+	trustProxy bool
+}
+
+func admissionConfigFromEnv() admissionConfig {
+	config := admissionConfig{
+		maxConnections: 10000,
+		maxPerIP:       50,
+		readLimit:      4096,
+	}
+	for _, origin := range strings.Split(os.Getenv("APP_URL"), ",") {
+		origin = strings.TrimSpace(origin)
+		if origin == "" {
+			continue
+		}
+		// Origins are only matched by host, so URLs are reduced to theirs.
+		if u, err := url.Parse(origin); err == nil && u.Scheme != "" && u.Host != "" {
+			origin = u.Host
+		}
+		config.originPatterns = append(config.originPatterns, origin)
+	}
+	if len(config.originPatterns) == 0 {
+		log.Printf("APP_URL is not set, accepting websocket connections from any origin")
+	}
+	intFromEnv("MAX_CONNECTIONS", &config.maxConnections)
+	intFromEnv("MAX_CONNECTIONS_PER_IP", &config.maxPerIP)
+	readLimit := int(config.readLimit)
+	intFromEnv("WS_READ_LIMIT", &readLimit)
+	config.readLimit = int64(readLimit)
+	if value := os.Getenv("TRUST_PROXY"); value != "" {
+		trust, err := strconv.ParseBool(value)
+		if err != nil {
+			log.Printf("Invalid TRUST_PROXY %q, using %t", value, config.trustProxy)
+		} else {
+			config.trustProxy = trust
+		}
+	}
+	return config
+}
+
+// intFromEnv overwrites n with the named environment variable when it is
+// set to a positive integer.
+func intFromEnv(name string, n *int) {
+	value := os.Getenv(name)
+	if value == "" {
+		return
+	}
+	parsed, err := strconv.Atoi(value)
+	if err != nil || parsed <= 0 {
+		log.Printf("Invalid %s %q, using %d", name, value, *n)
+		return
+	}
+	*n = parsed
+}
+
+// connectionCounter tracks open websocket connections, in total and per
+// client IP.
+type connectionCounter struct {
+	mu    sync.Mutex
+	total int
+	perIP map[string]int
+}
+
+// acquire counts a new connection from ip. It returns a reason when a cap
+// is reached instead.
+func (cc *connectionCounter) acquire(ip string, config admissionConfig) (string, bool) {
+	cc.mu.Lock()
+	defer cc.mu.Unlock()
+	if cc.total >= config.maxConnections {
+		return "server is at its connection limit", false
+	}
+	if cc.perIP[ip] >= config.maxPerIP {
+		return "too many connections from this address", false
+	}
+	cc.total++
+	cc.perIP[ip]++
+	return "", true
+}
+
+func (cc *connectionCounter) release(ip string) {
+	cc.mu.Lock()
+	defer cc.mu.Unlock()
+	cc.total--
+	if cc.perIP[ip]--; cc.perIP[ip] <= 0 {
+		delete(cc.perIP, ip)
+	}
+}
+
+// clientIP returns the IP of the client that sent r.
+func (dbs *dbServer) clientIP(r *http.Request) string {
+	if dbs.admission.trustProxy {
+		forwarded := r.Header.Values("X-Forwarded-For")
+		if len(forwarded) > 0 {
+			entries := strings.Split(forwarded[len(forwarded)-1], ",")
+			if ip := strings.TrimSpace(entries[len(entries)-1]); ip != "" {
+				return ip
+			}
+		}
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// accept upgrades r to a websocket connection from an allowed origin and
+// counts it against the connection caps. Connections over a cap are closed
+// with StatusTryAgainLater. release must be called once the connection is
+// done.
+func (dbs *dbServer) accept(w http.ResponseWriter, r *http.Request) (c *websocket.Conn, release func(), err error) {
+	c, err = websocket.Accept(w, r, &websocket.AcceptOptions{
+		OriginPatterns:     dbs.admission.originPatterns,
+		InsecureSkipVerify: len(dbs.admission.originPatterns) == 0,
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	c.SetReadLimit(dbs.admission.readLimit)
+	ip := dbs.clientIP(r)
+	if reason, ok := dbs.connections.acquire(ip, dbs.admission); !ok {
+		return nil, nil, reject(c, websocket.StatusTryAgainLater, reason)
+	}
+	return c, func() { dbs.connections.release(ip) }, nil
+}
+
+// reject closes c with code and reason and returns an error describing the
+// rejection.
+func reject(c *websocket.Conn, code websocket.StatusCode, reason string) error {
+	c.Close(code, reason)
+	return fmt.Errorf("rejected connection: %s", reason)
+}
+
+// validAddress reports whether s is a Starknet address. Empty optional
+// addresses are accepted.
+func validAddress(s string, optional bool) bool {
+	if s == "" {
+		return optional
+	}
+	_, err := starknet.ParseAddress(s)
+	return err == nil
+}
+
+// validVaultRequest reports whether the addresses of a /subscribeVault
+// request are well formed.
+func validVaultRequest(request subscriberVaultRequest) bool {
+	switch {
+	case request.Action == "watch" || request.Action == "unwatch":
+		return validAddress(request.VaultAddress, false) && validAddress(request.Address, true)
+	case request.UpdatedField == "address":
+		return validAddress(request.UpdatedValue, false)
+	}
+	return true
+}
@@ -0,0 +1,55 @@
+package server
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/coder/websocket"
+)
+
+func TestAcceptOrigin(t *testing.T) {
+	t.Setenv("APP_URL", "https://app.example.com, *.preview.example.com")
+	dbs := newTestServer(t)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		c, release, err := dbs.accept(w, r)
+		if err != nil {
+			return
+		}
+		defer release()
+		c.Close(websocket.StatusNormalClosure, "")
+	}))
+	defer srv.Close()
+
+	tests := []struct {
+		origin string
+		status int
+	}{
+		{"https://app.example.com", http.StatusSwitchingProtocols},
+		{"http://app.example.com", http.StatusSwitchingProtocols},
+		{"https://pr-1.preview.example.com", http.StatusSwitchingProtocols},
+		{"https://evil.example.com", http.StatusForbidden},
+		{"https://app.example.com.evil.com", http.StatusForbidden},
+	}
+	for _, tt := range tests {
+		t.Run(tt.origin, func(t *testing.T) {
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			c, resp, err := websocket.Dial(ctx, "ws"+strings.TrimPrefix(srv.URL, "http"), &websocket.DialOptions{
+				HTTPHeader: http.Header{"Origin": {tt.origin}},
+			})
+			if c != nil {
+				c.CloseNow()
+			}
+			if resp == nil {
+				t.Fatalf("dial: %v", err)
+			}
+			if resp.StatusCode != tt.status {
+				t.Errorf("status = %d, want %d (err %v)", resp.StatusCode, tt.status, err)
+			}
+		})
+	}
+}
@@ -0,0 +1,334 @@
+package server
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"math/big"
+	"net/http"
+	"os"
+	"pitchlake-backend/starknet"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Sign-in with Starknet: a client asks for a challenge, signs it as SNIP-12
+// typed data with its account's key and exchanges the signature for a
+// session token scoped to the account address. Account data is only served
+// to connections presenting a token for that address.
+
+// publicKeyEntryPoints are the views account contracts expose their signing
+// key with: OpenZeppelin and Braavos, then Argent.
+var publicKeyEntryPoints = []string{"get_public_key", "getPublicKey", "get_owner", "getSigner"}
+
+// sessionCheckInterval is how often connections drop the account data of
+// sessions that have expired. Updates are checked against the session as
+// they are delivered regardless.
+const sessionCheckInterval = time.Minute
+
+var (
+	errChallengeExpired = errors.New("challenge expired or unknown")
+	errInvalidSignature = errors.New("invalid signature")
+	errSignInDisabled   = errors.New("sign-in is not configured")
+)
+
+type authChallenge struct {
+	address   *big.Int
+	typedData starknet.TypedData
+	expires   time.Time
+}
+
+type authSession struct {
+	address *big.Int
+	expires time.Time
+}
+
+// authenticator issues challenges and session tokens. Both are kept in
+// memory, so sessions do not survive a restart.
+type authenticator struct {
+	// required gates account data behind a session. Disabling it restores
+	// open access for local development.
+	required     bool
+	chainID      string
+	challengeTTL time.Duration
+	sessionTTL   time.Duration
+	// rpc reads account keys; sign-in is unavailable without it.
+	rpc *starknet.Client
+
+	mu         sync.Mutex
+	challenges map[string]*authChallenge
+	sessions   map[string]*authSession
+}
+
+func authFromEnv() *authenticator {
+	a := &authenticator{
+		required:     true,
+		chainID:      "SN_MAIN",
+		challengeTTL: 5 * time.Minute,
+		sessionTTL:   24 * time.Hour,
+		challenges:   make(map[string]*authChallenge),
+		sessions:     make(map[string]*authSession),
+	}
+	if value := os.Getenv("AUTH_REQUIRED"); value != "" {
+		required, err := strconv.ParseBool(value)
+		if err != nil {
+			log.Printf("Invalid AUTH_REQUIRED %q, using %t", value, a.required)
+		} else {
+			a.required = required
+		}
+	}
+	if value := os.Getenv("STARKNET_CHAIN_ID"); value != "" {
+		a.chainID = value
+	}
+	durationFromEnv("AUTH_CHALLENGE_TTL", &a.challengeTTL, false)
+	durationFromEnv("AUTH_SESSION_TTL", &a.sessionTTL, false)
+	if url := os.Getenv("STARKNET_RPC_URL"); url != "" {
+		a.rpc = &starknet.Client{URL: url, HTTPClient: &http.Client{Timeout: 10 * time.Second}}
+	} else if a.required {
+		log.Printf("STARKNET_RPC_URL is not set, sign-in is unavailable and account data is closed")
+	}
+	return a
+}
+
+// challenge returns typed data for address to sign, identified by its nonce.
+func (a *authenticator) challenge(address string) (string, *authChallenge, error) {
+	account, err := starknet.ParseAddress(address)
+	if err != nil {
+		return "", nil, err
+	}
+	nonce, err := randomHex(16)
+	if err != nil {
+		return "", nil, err
+	}
+	now := time.Now()
+	c := &authChallenge{
+		address: account,
+		expires: now.Add(a.challengeTTL),
+		typedData: starknet.TypedData{
+			Types: map[string][]starknet.TypeMember{
+				"StarkNetDomain": {
+					{Name: "name", Type: "felt"},
+					{Name: "version", Type: "felt"},
+					{Name: "chainId", Type: "felt"},
+				},
+				"SignIn": {
+					{Name: "statement", Type: "felt"},
+					{Name: "nonce", Type: "felt"},
+					{Name: "issuedAt", Type: "felt"},
+				},
+			},
+			PrimaryType: "SignIn",
+			Domain: map[string]any{
+				"name":    "Pitchlake",
+				"version": "1",
+				"chainId": a.chainID,
+			},
+			Message: map[string]any{
+				"statement": "Sign in to Pitchlake",
+				"nonce":     "0x" + nonce,
+				"issuedAt":  strconv.FormatInt(now.Unix(), 10),
+			},
+		},
+	}
+	a.mu.Lock()
+	a.challenges[nonce] = c
+	a.mu.Unlock()
+	return nonce, c, nil
+}
+
+// verify consumes the challenge nonce and, if signature is a valid
+// signature of it by address, returns a new session token.
+func (a *authenticator) verify(ctx context.Context, address, nonce string, signature []string) (string, *authSession, error) {
+	if a.rpc == nil {
+		return "", nil, errSignInDisabled
+	}
+	account, err := starknet.ParseAddress(address)
+	if err != nil {
+		return "", nil, err
+	}
+	a.mu.Lock()
+	c, ok := a.challenges[nonce]
+	delete(a.challenges, nonce)
+	a.mu.Unlock()
+	if !ok || time.Now().After(c.expires) || c.address.Cmp(account) != 0 {
+		return "", nil, errChallengeExpired
+	}
+	// Accounts that add data to their signatures end with r and s.
+	if len(signature) < 2 {
+		return "", nil, errInvalidSignature
+	}
+	r, err := starknet.ParseFelt(signature[len(signature)-2])
+	if err != nil {
+		return "", nil, errInvalidSignature
+	}
+	s, err := starknet.ParseFelt(signature[len(signature)-1])
+	if err != nil {
+		return "", nil, errInvalidSignature
+	}
+	hash, err := c.typedData.MessageHash(account)
+	if err != nil {
+		return "", nil, err
+	}
+	publicKey, err := a.accountPublicKey(ctx, account)
+	if err != nil {
+		return "", nil, err
+	}
+	if !starknet.Verify(hash, r, s, publicKey) {
+		return "", nil, errInvalidSignature
+	}
+
+	token, err := randomHex(32)
+	if err != nil {
+		return "", nil, err
+	}
+	session := &authSession{address: account, expires: time.Now().Add(a.sessionTTL)}
+	a.mu.Lock()
+	a.sessions[token] = session
+	a.mu.Unlock()
+	return token, session, nil
+}
+
+// accountPublicKey reads the signing key of the account contract.
+func (a *authenticator) accountPublicKey(ctx context.Context, account *big.Int) (*big.Int, error) {
+	var errs []error
+	for _, entryPoint := range publicKeyEntryPoints {
+		result, err := a.rpc.Call(ctx, account, entryPoint)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		if len(result) > 0 && result[0].Sign() != 0 {
+			return result[0], nil
+		}
+	}
+	return nil, fmt.Errorf("could not read the public key of account 0x%s: %w", account.Text(16), errors.Join(errs...))
+}
+
+// session returns the live session of token.
+func (a *authenticator) session(token string) (*authSession, bool) {
+	if token == "" {
+		return nil, false
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	s, ok := a.sessions[token]
+	if !ok || time.Now().After(s.expires) {
+		return nil, false
+	}
+	return s, true
+}
+
+// authorize reports whether token grants access to the data of address.
+func (a *authenticator) authorize(token, address string) bool {
+	if !a.required {
+		return true
+	}
+	account, err := starknet.ParseAddress(address)
+	if err != nil {
+		return false
+	}
+	s, ok := a.session(token)
+	return ok && s.address.Cmp(account) == 0
+}
+
+// expire drops expired challenges and sessions until ctx is done.
+func (a *authenticator) expire(ctx context.Context) {
+	ticker := time.NewTicker(time.Minute)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			a.mu.Lock()
+			for nonce, c := range a.challenges {
+				if now.After(c.expires) {
+					delete(a.challenges, nonce)
+				}
+			}
+			for token, s := range a.sessions {
+				if now.After(s.expires) {
+					delete(a.sessions, token)
+				}
+			}
+			a.mu.Unlock()
+		}
+	}
+}
+
+func randomHex(n int) (string, error) {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// authChallengeHandler starts a sign-in for the address in the request
+// body.
+func (dbs *dbServer) authChallengeHandler(w http.ResponseWriter, r *http.Request) {
+	if !dbs.allowIP(w, r, commandAuth) {
+		return
+	}
+	var request struct {
+		Address string `json:"address"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		http.Error(w, "invalid request", http.StatusBadRequest)
+		return
+	}
+	nonce, c, err := dbs.auth.challenge(request.Address)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(struct {
+		Nonce     string             `json:"nonce"`
+		ExpiresAt int64              `json:"expiresAt"`
+		TypedData starknet.TypedData `json:"typedData"`
+	}{nonce, c.expires.Unix(), c.typedData})
+}
+
+// authVerifyHandler exchanges a signed challenge for a session token.
+func (dbs *dbServer) authVerifyHandler(w http.ResponseWriter, r *http.Request) {
+	if !dbs.allowIP(w, r, commandAuth) {
+		return
+	}
+	var request struct {
+		Address   string   `json:"address"`
+		Nonce     string   `json:"nonce"`
+		Signature []string `json:"signature"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		http.Error(w, "invalid request", http.StatusBadRequest)
+		return
+	}
+	token, session, err := dbs.auth.verify(r.Context(), request.Address, request.Nonce, request.Signature)
+	switch {
+	case errors.Is(err, errChallengeExpired), errors.Is(err, errInvalidSignature):
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	case errors.Is(err, errSignInDisabled):
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	case errors.Is(err, starknet.ErrInvalidAddress), errors.Is(err, starknet.ErrInvalidFelt):
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	case err != nil:
+		dbs.logf("Error verifying sign-in of %s: %v", request.Address, err)
+		http.Error(w, "could not verify signature", http.StatusBadGateway)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(struct {
+		Token     string `json:"token"`
+		Address   string `json:"address"`
+		ExpiresAt int64  `json:"expiresAt"`
+	}{token, "0x" + session.address.Text(16), session.expires.Unix()})
+}
@@ -0,0 +1,85 @@
+package server
+
+import (
+	"math/big"
+	"testing"
+	"time"
+)
+
+// withSessions requires sign-in, with a live session for account 0x1 and
+// an expired one for account 0x2.
+func withSessions(dbs *dbServer) {
+	dbs.auth.required = true
+	dbs.auth.sessions["live"] = &authSession{address: big.NewInt(1), expires: time.Now().Add(time.Hour)}
+	dbs.auth.sessions["expired"] = &authSession{address: big.NewInt(2), expires: time.Now().Add(-time.Second)}
+}
+
+func TestDeliverChecksSession(t *testing.T) {
+	dbs := newTestServer(t, withSessions)
+	live := &subscriberVault{streamConn: streamConn{msgs: newOutbox(4, slowPolicyDisconnect)}, watches: make(map[vaultWatch]struct{}), token: "live"}
+	expired := &subscriberVault{streamConn: streamConn{msgs: newOutbox(4, slowPolicyDisconnect)}, watches: make(map[vaultWatch]struct{}), token: "expired"}
+	dbs.addVaultWatch(live, vaultWatch{vaultAddress: "0xa", address: "0x1"})
+	dbs.addVaultWatch(expired, vaultWatch{vaultAddress: "0xa", address: "0x2"})
+
+	dbs.deliver(outboundMessage{stream: streamVault, vaultAddress: "0xa", account: "0x1", msg: []byte(`"lp1"`)})
+	dbs.deliver(outboundMessage{stream: streamVault, vaultAddress: "0xa", account: "0x2", msg: []byte(`"lp2"`)})
+	dbs.deliver(outboundMessage{stream: streamVault, vaultAddress: "0xa", msg: []byte(`"vault"`)})
+
+	if got := len(live.msgs.drain()); got != 2 {
+		t.Errorf("live session got %d messages, want 2", got)
+	}
+	msgs := expired.msgs.drain()
+	if len(msgs) != 1 || string(msgs[0]) != `"vault"` {
+		t.Errorf("expired session got %q, want only the vault update", msgs)
+	}
+}
+
+func TestRevokeVaultWatches(t *testing.T) {
+	dbs := newTestServer(t, withSessions)
+	s := &subscriberVault{streamConn: streamConn{msgs: newOutbox(4, slowPolicyDisconnect)}, watches: make(map[vaultWatch]struct{}), token: "expired"}
+	dbs.addVaultWatch(s, vaultWatch{vaultAddress: "0xa", address: "0x2"})
+	dbs.addVaultWatch(s, vaultWatch{vaultAddress: "0xb"})
+
+	revoked := dbs.revokeVaultWatches(s)
+	if len(revoked) != 1 || revoked[0] != (vaultWatch{vaultAddress: "0xa", address: "0x2"}) {
+		t.Fatalf("revoked %v, want the account watch on 0xa", revoked)
+	}
+	for _, w := range []vaultWatch{{vaultAddress: "0xa"}, {vaultAddress: "0xb"}} {
+		if _, ok := s.watches[w]; !ok {
+			t.Errorf("missing vault watch %v after revoke", w)
+		}
+	}
+	if len(dbs.revokeVaultWatches(s)) != 0 {
+		t.Error("second revoke returned watches")
+	}
+}
+
+func TestRevokeAccountTopics(t *testing.T) {
+	dbs := newTestServer(t, withSessions)
+	c := &wsClient{
+		msgs:    newOutbox(4, slowPolicyDisconnect),
+		topics:  make(map[string]struct{}),
+		pending: make(map[string][]outboxMessage),
+		token:   "live",
+	}
+	for _, topic := range []string{"account:0x1", "vault:0xa"} {
+		dbs.subscribeTopic(c, topic, nil)
+		c.release(topic, []outboxMessage{})
+	}
+	if revoked := dbs.revokeAccountTopics(c); len(revoked) != 0 {
+		t.Fatalf("revoked %v with a live session", revoked)
+	}
+
+	c.setToken("expired")
+	dbs.publish(outboundMessage{stream: streamVault, account: "0x1", msg: []byte("{}")})
+	if msgs := c.msgs.drain(); len(msgs) != 0 {
+		t.Errorf("expired session got %d account updates", len(msgs))
+	}
+	revoked := dbs.revokeAccountTopics(c)
+	if len(revoked) != 1 || revoked[0] != "account:0x1" {
+		t.Errorf("revoked %v, want account:0x1", revoked)
+	}
+	if _, ok := c.topics["vault:0xa"]; !ok {
+		t.Error("vault topic was revoked")
+	}
+}
@@ -0,0 +1,464 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"pitchlake-backend/models"
+	"strings"
+)
+
+// Streams an outbound message can be routed to.
+const (
+	streamVault = "vault"
+	streamHome  = "home"
+	streamGas   = "gas"
+)
+
+// gasRoundDurations are the round durations gas subscribers can follow.
+var gasRoundDurations = []uint64{960, 13200, 2631600}
+
+// outboundMessage is a message produced by a channel handler together with
+// the routing keys selecting its subscribers. Empty routing keys match every
+// subscriber of the stream.
+type outboundMessage struct {
+	stream string
+	// msgType names the payload for the /ws envelope.
+	msgType       string
+	vaultAddress  string
+	account       string
+	userType      string
+	roundAddress  string
+	roundDuration uint64
+	// key identifies the entity the message describes, see outbox.push.
+	key string
+	msg []byte
+}
+
+// channelHandler turns the payload of a single Postgres channel into
+// outbound messages.
+type channelHandler interface {
+	channel() string
+	handle(dbs *dbServer, payload string) ([]outboundMessage, error)
+}
+
+// channelRegistry maps Postgres channels to their handlers. Only enabled
+// channels are LISTENed on.
+type channelRegistry struct {
+	handlers map[string]channelHandler
+	order    []string
+	enabled  map[string]bool
+}
+
+func newChannelRegistry() *channelRegistry {
+	return &channelRegistry{
+		handlers: make(map[string]channelHandler),
+		enabled:  make(map[string]bool),
+	}
+}
+
+// register adds a handler and enables its channel. Registering a channel
+// twice replaces the previous handler.
+func (r *channelRegistry) register(h channelHandler) {
+	if _, exists := r.handlers[h.channel()]; !exists {
+		r.order = append(r.order, h.channel())
+	}
+	r.handlers[h.channel()] = h
+	r.enabled[h.channel()] = true
+}
+
+// restrict enables only the named channels. Unknown names are logged and
+// ignored.
+func (r *channelRegistry) restrict(channels []string) {
+	for channel := range r.enabled {
+		r.enabled[channel] = false
+	}
+	for _, channel := range channels {
+		if _, ok := r.handlers[channel]; !ok {
+			log.Printf("Ignoring unknown channel %q", channel)
+			continue
+		}
+		r.enabled[channel] = true
+	}
+}
+
+// channels returns the enabled channels in registration order.
+func (r *channelRegistry) channels() []string {
+	var channels []string
+	for _, channel := range r.order {
+		if r.enabled[channel] {
+			channels = append(channels, channel)
+		}
+	}
+	return channels
+}
+
+func (r *channelRegistry) handler(channel string) (channelHandler, bool) {
+	h, ok := r.handlers[channel]
+	if !ok || !r.enabled[channel] {
+		return nil, false
+	}
+	return h, true
+}
+
+// defaultChannels registers the handlers for every channel served by the
+// db triggers. LISTEN_CHANNELS, a comma separated list, limits the
+// channels listened on.
+func defaultChannels() *channelRegistry {
+	r := newChannelRegistry()
+	r.register(vaultHandler[models.LiquidityProviderState]{
+		name:        "lp_update",
+		messageType: "lpState",
+		route: func(lp *models.LiquidityProviderState) outboundMessage {
+			return outboundMessage{vaultAddress: lp.VaultAddress, account: lp.Address, key: entityKey("lpState", lp.VaultAddress, lp.Address)}
+		},
+	})
+	r.register(vaultHandler[models.VaultState]{
+		name:        "vault_update",
+		messageType: "vaultState",
+		observe: func(dbs *dbServer, operation string, vs *models.VaultState) {
+			if operation == "DELETE" {
+				dbs.forgetVault(vs.Address)
+				return
+			}
+			dbs.recordVaultState(vs)
+		},
+		route: func(vs *models.VaultState) outboundMessage {
+			return outboundMessage{vaultAddress: vs.Address, key: entityKey("vaultState", vs.Address)}
+		},
+		extra: func(dbs *dbServer, operation string, vs *models.VaultState) []outboundMessage {
+			return dbs.homeVaultEvents(operation, vs)
+		},
+	})
+	r.register(vaultHandler[models.OptionBuyer]{
+		name:        "ob_update",
+		messageType: "optionBuyerState",
+		route: func(ob *models.OptionBuyer) outboundMessage {
+			return outboundMessage{account: ob.Address, userType: "ob", roundAddress: ob.RoundAddress, key: entityKey("optionBuyer", ob.RoundAddress, ob.Address)}
+		},
+	})
+	r.register(vaultHandler[models.OptionRound]{
+		name:        "or_update",
+		messageType: "optionRoundState",
+		observe: func(dbs *dbServer, operation string, or *models.OptionRound) {
+			if operation == "DELETE" {
+				dbs.forgetOptionRound(or.VaultAddress, or.Address)
+				return
+			}
+			dbs.recordOptionRound(or)
+		},
+		route: func(or *models.OptionRound) outboundMessage {
+			return outboundMessage{vaultAddress: or.VaultAddress, roundAddress: or.Address, key: entityKey("optionRound", or.VaultAddress, or.Address)}
+		},
+		extra: func(dbs *dbServer, operation string, or *models.OptionRound) []outboundMessage {
+			return dbs.homeRoundEvents(operation, or)
+		},
+	})
+	r.register(vaultHandler[models.Bid]{
+		name:        "bids_update",
+		messageType: "bid",
+		route: func(bid *models.Bid) outboundMessage {
+			return outboundMessage{account: bid.BuyerAddress, roundAddress: bid.RoundAddress, key: entityKey("bid", bid.RoundAddress, bid.BuyerAddress, bid.BidID)}
+		},
+	})
+	r.register(vaultHandler[models.QueuedLiquidity]{
+		name:        "ql_update",
+		messageType: "queuedLiquidity",
+		route: func(ql *models.QueuedLiquidity) outboundMessage {
+			return outboundMessage{account: ql.Address, roundAddress: ql.RoundAddress, key: entityKey("queuedLiquidity", ql.RoundAddress, ql.Address)}
+		},
+	})
+	r.register(gasHandler{
+		name:        "unconfirmed_insert",
+		messageType: "unconfirmedBlocks",
+		blocks: func(dbs *dbServer, payload string) ([]models.Block, error) {
+			block, err := decodeBlock(dbs, payload)
+			if err != nil {
+				return nil, err
+			}
+			return []models.Block{block}, nil
+		},
+	})
+	r.register(gasHandler{
+		name:        "confirmed_insert",
+		messageType: "confirmedBlocks",
+		blocks: func(dbs *dbServer, payload string) ([]models.Block, error) {
+			var updatedData confirmedUpdate
+			if err := json.Unmarshal([]byte(payload), &updatedData); err != nil {
+				return nil, err
+			}
+			return dbs.db.GetBlocks(updatedData.StartTimestamp, updatedData.EndTimestamp, 0)
+		},
+	})
+
+	r.register(twapHandler{})
+
+	if value := os.Getenv("LISTEN_CHANNELS"); value != "" {
+		var channels []string
+		for _, channel := range strings.Split(value, ",") {
+			if channel = strings.TrimSpace(channel); channel != "" {
+				channels = append(channels, channel)
+			}
+		}
+		r.restrict(channels)
+	}
+	return r
+}
+
+// entityKey builds the key of a row's updates from its entity and the
+// addresses identifying it. A connection may watch several vaults and
+// accounts, so keys name both; rows scoped to a round name the round, which
+// belongs to a single vault.
+func entityKey(entity string, addresses ...string) string {
+	return entity + ":" + strings.Join(addresses, ":")
+}
+
+type confirmedUpdate struct {
+	StartTimestamp uint64 `json:"start_timestamp"`
+	EndTimestamp   uint64 `json:"end_timestamp"`
+}
+
+// vaultHandler handles a channel carrying NotificationPayloadVault rows for
+// the vault stream.
+type vaultHandler[T AllowedPayload] struct {
+	name        string
+	messageType string
+	// observe, if set, is called with every decoded row before routing.
+	observe func(dbs *dbServer, operation string, row *T)
+	// route returns the routing keys for a row.
+	route func(row *T) outboundMessage
+	// extra, if set, returns additional messages for other streams.
+	extra func(dbs *dbServer, operation string, row *T) []outboundMessage
+}
+
+func (h vaultHandler[T]) channel() string { return h.name }
+
+func (h vaultHandler[T]) handle(dbs *dbServer, payload string) ([]outboundMessage, error) {
+	updatedData, err := decodeVaultNotification[T](dbs, payload)
+	if err != nil {
+		return nil, fmt.Errorf("error parsing %s payload: %w", h.name, err)
+	}
+	updatedData.Type = h.messageType
+	if h.observe != nil {
+		h.observe(dbs, updatedData.Operation, &updatedData.Payload)
+	}
+	out := h.route(&updatedData.Payload)
+	out.stream = streamVault
+	out.msgType = notificationType(updatedData)
+	out.msg, err = marshalNotification(updatedData, out.key)
+	if err != nil {
+		return nil, fmt.Errorf("error marshalling %s response: %w", h.name, err)
+	}
+	messages := []outboundMessage{out}
+	if h.extra != nil {
+		messages = append(messages, h.extra(dbs, updatedData.Operation, &updatedData.Payload)...)
+	}
+	return messages, nil
+}
+
+// gasHandler handles a channel carrying blocks for the gas stream. Every
+// gas round duration gets its own message with the matching TWAP.
+type gasHandler struct {
+	name        string
+	messageType string
+	blocks      func(dbs *dbServer, payload string) ([]models.Block, error)
+}
+
+func (h gasHandler) channel() string { return h.name }
+
+func (h gasHandler) handle(dbs *dbServer, payload string) ([]outboundMessage, error) {
+	blocks, err := h.blocks(dbs, payload)
+	if err != nil {
+		return nil, fmt.Errorf("error parsing %s payload: %w", h.name, err)
+	}
+	var out []outboundMessage
+	for _, roundDuration := range gasRoundDurations {
+		response, err := json.Marshal(NotificationPayloadGas{
+			Type:   h.messageType,
+			Blocks: blockResponses(blocks, roundDuration),
+		})
+		if err != nil {
+			return nil, fmt.Errorf("error marshalling %s response: %w", h.name, err)
+		}
+		out = append(out, outboundMessage{
+			stream:        streamGas,
+			msgType:       h.messageType,
+			roundDuration: roundDuration,
+			msg:           response,
+		})
+	}
+	return out, nil
+}
+
+// twapHandler handles twap_update, carrying TwapState rows for the gas
+// stream. Each window is sent to the subscribers of the round duration it
+// settles.
+type twapHandler struct{}
+
+func (twapHandler) channel() string { return "twap_update" }
+
+func (twapHandler) handle(dbs *dbServer, payload string) ([]outboundMessage, error) {
+	updatedData, err := decodeVaultNotification[models.TwapState](dbs, payload)
+	if err != nil {
+		return nil, fmt.Errorf("error parsing twap_update payload: %w", err)
+	}
+	updatedData.Type = "twapState"
+	roundDuration := twapRoundDuration(updatedData.Payload.WindowType)
+	if roundDuration == 0 {
+		return nil, fmt.Errorf("unknown twap window %q", updatedData.Payload.WindowType)
+	}
+	key := fmt.Sprintf("twapState:%s:%t", updatedData.Payload.WindowType, updatedData.Payload.IsConfirmed)
+	response, err := marshalNotification(updatedData, key)
+	if err != nil {
+		return nil, fmt.Errorf("error marshalling twap_update response: %w", err)
+	}
+	return []outboundMessage{{
+		stream:        streamGas,
+		msgType:       notificationType(updatedData),
+		roundDuration: roundDuration,
+		key:           key,
+		msg:           response,
+	}}, nil
+}
+
+// notificationType is the type of the message marshalNotification produces.
+func notificationType[T AllowedPayload](updatedData NotificationPayloadVault[T]) string {
+	if updatedData.Operation == "DELETE" {
+		return "removed"
+	}
+	return updatedData.Type
+}
+
+// marshalNotification encodes a row notification for subscribers. Deleted
+// rows are sent as a RemovedPayload naming the key of the row's updates.
+func marshalNotification[T AllowedPayload](updatedData NotificationPayloadVault[T], key string) ([]byte, error) {
+	if updatedData.Operation != "DELETE" {
+		return json.Marshal(updatedData)
+	}
+	return json.Marshal(RemovedPayload[T]{
+		Operation: updatedData.Operation,
+		Type:      notificationType(updatedData),
+		Entity:    updatedData.Type,
+		Key:       key,
+		Payload:   updatedData.Payload,
+	})
+}
+
+// twapWindow returns the TWAP window settling rounds of roundDuration.
+func twapWindow(roundDuration uint64) models.TwapWindowType {
+	switch roundDuration {
+	case 960:
+		return models.TwapWindowTwelveMin
+	case 13200:
+		return models.TwapWindowThreeHour
+	case 2631600:
+		return models.TwapWindowThirtyDay
+	}
+	return ""
+}
+
+func twapRoundDuration(windowType models.TwapWindowType) uint64 {
+	for _, roundDuration := range gasRoundDurations {
+		if twapWindow(roundDuration) == windowType {
+			return roundDuration
+		}
+	}
+	return 0
+}
+
+// blockTwap returns the TWAP of block over the window used by rounds of
+// roundDuration.
+func blockTwap(block models.Block, roundDuration uint64) string {
+	switch roundDuration {
+	case 960:
+		return block.TwelveMinTwap
+	case 13200:
+		return block.ThreeHourTwap
+	case 2631600:
+		return block.ThirtyDayTwap
+	}
+	return ""
+}
+
+func blockResponses(blocks []models.Block, roundDuration uint64) []BlockResponse {
+	responses := make([]BlockResponse, 0, len(blocks))
+	for _, block := range blocks {
+		responses = append(responses, BlockResponse{
+			BlockNumber: block.BlockNumber,
+			Timestamp:   block.Timestamp,
+			BaseFee:     block.BaseFee,
+			IsConfirmed: block.IsConfirmed,
+			Twap:        blockTwap(block, roundDuration),
+		})
+	}
+	return responses
+}
+
+// dispatch runs the handler registered for channel and delivers its
+// messages. Any error leaves the notification undelivered.
+func (dbs *dbServer) dispatch(channel, payload string) error {
+	h, ok := dbs.channels.handler(channel)
+	if !ok {
+		return fmt.Errorf("no handler registered for channel %q", channel)
+	}
+	out, err := h.handle(dbs, payload)
+	if err != nil {
+		return err
+	}
+	for _, m := range out {
+		dbs.deliver(m)
+	}
+	return nil
+}
+
+// deliver queues m on every subscriber matching its routing keys.
+func (dbs *dbServer) deliver(m outboundMessage) {
+	dbs.publish(m)
+	switch m.stream {
+	case streamVault:
+		dbs.subscribersVaultMu.Lock()
+		defer dbs.subscribersVaultMu.Unlock()
+		// A subscriber watching several vaults is indexed under each of
+		// them but must receive a message once.
+		delivered := make(map[*subscriberVault]bool)
+		deliverVault := func(subscribers []*subscriberVault) {
+			for _, s := range subscribers {
+				if delivered[s] {
+					continue
+				}
+				// Sessions may have expired since the watch was added.
+				if m.account != "" && (!s.watchesAccount(m.vaultAddress, m.account) || !dbs.auth.authorize(s.token, m.account)) {
+					continue
+				}
+				if m.userType != "" && s.userType != m.userType {
+					continue
+				}
+				delivered[s] = true
+				s.send(m.msgType, m.key, m.msg)
+			}
+		}
+		if m.vaultAddress != "" {
+			deliverVault(dbs.subscribersVault[m.vaultAddress])
+			return
+		}
+		for _, subscribers := range dbs.subscribersVault {
+			deliverVault(subscribers)
+		}
+	case streamHome:
+		dbs.subscribersHomeMu.Lock()
+		defer dbs.subscribersHomeMu.Unlock()
+		for s := range dbs.subscribersHome {
+			s.send(m.msgType, m.key, m.msg)
+		}
+	case streamGas:
+		dbs.subscribersGasMu.Lock()
+		defer dbs.subscribersGasMu.Unlock()
+		for s := range dbs.subscribersGas {
+			if m.roundDuration != 0 && s.RoundDuration != m.roundDuration {
+				continue
+			}
+			s.send(m.msgType, m.key, m.msg)
+		}
+	}
+}
@@ -0,0 +1,203 @@
+package server
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// deadLetter is a notification that could not be processed.
+type deadLetter struct {
+	ID         uint64    `json:"id"`
+	Channel    string    `json:"channel"`
+	Payload    string    `json:"payload"`
+	Error      string    `json:"error"`
+	ReceivedAt time.Time `json:"receivedAt"`
+}
+
+// deadLetterStore keeps quarantined notifications in memory and mirrors
+// them to a JSON lines file so they survive restarts. The store holds at
+// most maxEntries letters; older ones are rotated out.
+type deadLetterStore struct {
+	mu         sync.Mutex
+	path       string
+	maxEntries int
+	nextID     uint64
+	total      uint64
+	letters    []deadLetter
+}
+
+// newDeadLetterStore opens the store backed by path, loading any letters
+// quarantined by a previous run. An empty path keeps letters in memory only.
+func newDeadLetterStore(path string, maxEntries int) *deadLetterStore {
+	dls := &deadLetterStore{path: path, maxEntries: maxEntries, nextID: 1}
+	if path == "" {
+		return dls
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		if !errors.Is(err, os.ErrNotExist) {
+			log.Printf("Error opening dead letter file: %v", err)
+		}
+		return dls
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 0, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		var letter deadLetter
+		if err := json.Unmarshal(scanner.Bytes(), &letter); err != nil {
+			log.Printf("Skipping corrupt dead letter: %v", err)
+			continue
+		}
+		dls.letters = append(dls.letters, letter)
+		if letter.ID >= dls.nextID {
+			dls.nextID = letter.ID + 1
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		log.Printf("Error reading dead letter file: %v", err)
+	}
+	// The file may come from a run with a larger DEAD_LETTER_MAX.
+	if dls.trim() {
+		dls.rewrite()
+	}
+	return dls
+}
+
+// add quarantines a notification.
+func (dls *deadLetterStore) add(channel, payload string, cause error) deadLetter {
+	dls.mu.Lock()
+	defer dls.mu.Unlock()
+
+	letter := deadLetter{
+		ID:         dls.nextID,
+		Channel:    channel,
+		Payload:    payload,
+		Error:      cause.Error(),
+		ReceivedAt: time.Now().UTC(),
+	}
+	dls.nextID++
+	dls.total++
+	dls.letters = append(dls.letters, letter)
+	if dls.trim() {
+		dls.rewrite()
+	} else {
+		dls.append(letter)
+	}
+	return letter
+}
+
+// list returns the quarantined letters, oldest first.
+func (dls *deadLetterStore) list() []deadLetter {
+	dls.mu.Lock()
+	defer dls.mu.Unlock()
+	return append([]deadLetter(nil), dls.letters...)
+}
+
+// remove drops the letter with the given id, reporting whether it existed.
+func (dls *deadLetterStore) remove(id uint64) bool {
+	dls.mu.Lock()
+	defer dls.mu.Unlock()
+	for i, letter := range dls.letters {
+		if letter.ID == id {
+			dls.letters = append(dls.letters[:i], dls.letters[i+1:]...)
+			dls.rewrite()
+			return true
+		}
+	}
+	return false
+}
+
+// counts returns the number of letters quarantined since startup and the
+// number still pending replay.
+func (dls *deadLetterStore) counts() (total uint64, pending int) {
+	dls.mu.Lock()
+	defer dls.mu.Unlock()
+	return dls.total, len(dls.letters)
+}
+
+// trim rotates out the oldest letters over maxEntries, reporting whether
+// any were dropped. dls.mu must be held.
+func (dls *deadLetterStore) trim() bool {
+	if len(dls.letters) <= dls.maxEntries {
+		return false
+	}
+	dls.letters = append(dls.letters[:0], dls.letters[len(dls.letters)-dls.maxEntries:]...)
+	return true
+}
+
+// append writes a single letter to the backing file. dls.mu must be held.
+func (dls *deadLetterStore) append(letter deadLetter) {
+	if dls.path == "" {
+		return
+	}
+	f, err := os.OpenFile(dls.path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0o644)
+	if err != nil {
+		log.Printf("Error opening dead letter file: %v", err)
+		return
+	}
+	defer f.Close()
+	if err := json.NewEncoder(f).Encode(letter); err != nil {
+		log.Printf("Error writing dead letter: %v", err)
+	}
+}
+
+// rewrite replaces the backing file with the letters currently held.
+// dls.mu must be held.
+func (dls *deadLetterStore) rewrite() {
+	if dls.path == "" {
+		return
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(dls.path), filepath.Base(dls.path)+".*")
+	if err != nil {
+		log.Printf("Error rewriting dead letter file: %v", err)
+		return
+	}
+	enc := json.NewEncoder(tmp)
+	for _, letter := range dls.letters {
+		if err := enc.Encode(letter); err != nil {
+			log.Printf("Error rewriting dead letter file: %v", err)
+			tmp.Close()
+			os.Remove(tmp.Name())
+			return
+		}
+	}
+	if err := tmp.Close(); err != nil {
+		log.Printf("Error rewriting dead letter file: %v", err)
+		os.Remove(tmp.Name())
+		return
+	}
+	if err := os.Rename(tmp.Name(), dls.path); err != nil {
+		log.Printf("Error rewriting dead letter file: %v", err)
+		os.Remove(tmp.Name())
+	}
+}
+
+// quarantine records a notification that failed processing so the listener
+// can move on to the next one.
+func (dbs *dbServer) quarantine(channel, payload string, err error) {
+	letter := dbs.deadLetters.add(channel, payload, err)
+	log.Printf("Quarantined %s notification %d: %v", channel, letter.ID, err)
+}
+
+// deadLettersFromEnv builds the dead letter store from DEAD_LETTER_FILE and
+// DEAD_LETTER_MAX.
+func deadLettersFromEnv() *deadLetterStore {
+	maxEntries := 1000
+	if value := os.Getenv("DEAD_LETTER_MAX"); value != "" {
+		n, err := strconv.Atoi(value)
+		if err != nil || n <= 0 {
+			log.Printf("Invalid DEAD_LETTER_MAX %q, using %d", value, maxEntries)
+		} else {
+			maxEntries = n
+		}
+	}
+	return newDeadLetterStore(os.Getenv("DEAD_LETTER_FILE"), maxEntries)
+}
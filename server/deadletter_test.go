@@ -0,0 +1,51 @@
+package server
+
+import (
+	"errors"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func letterIDs(letters []deadLetter) []uint64 {
+	var ids []uint64
+	for _, letter := range letters {
+		ids = append(ids, letter.ID)
+	}
+	return ids
+}
+
+func TestDeadLetterStoreRotates(t *testing.T) {
+	dls := newDeadLetterStore("", 2)
+	for i := 0; i < 3; i++ {
+		dls.add("vault_update", "{}", errors.New("boom"))
+	}
+	if got := letterIDs(dls.list()); !reflect.DeepEqual(got, []uint64{2, 3}) {
+		t.Errorf("letters %v, want [2 3]", got)
+	}
+	if total, pending := dls.counts(); total != 3 || pending != 2 {
+		t.Errorf("counts = %d, %d, want 3, 2", total, pending)
+	}
+}
+
+func TestDeadLetterStoreTrimsOnLoad(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "dead_letters.jsonl")
+	// A previous run allowed more letters.
+	dls := newDeadLetterStore(path, 5)
+	for i := 0; i < 5; i++ {
+		dls.add("vault_update", "{}", errors.New("boom"))
+	}
+
+	dls = newDeadLetterStore(path, 2)
+	if got := letterIDs(dls.list()); !reflect.DeepEqual(got, []uint64{4, 5}) {
+		t.Errorf("loaded %v, want the newest [4 5]", got)
+	}
+	if letter := dls.add("vault_update", "{}", errors.New("boom")); letter.ID != 6 {
+		t.Errorf("next id = %d, want 6", letter.ID)
+	}
+
+	// The file was rewritten with the trimmed letters.
+	if got := letterIDs(newDeadLetterStore(path, 10).list()); !reflect.DeepEqual(got, []uint64{5, 6}) {
+		t.Errorf("file holds %v, want [5 6]", got)
+	}
+}
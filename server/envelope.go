@@ -0,0 +1,137 @@
+package server
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// protocolVersion is the version of the /ws message envelope. It changes
+// whenever the envelope or a payload changes incompatibly.
+const protocolVersion = 1
+
+// Envelope wraps every message sent on /ws, and on the dedicated endpoints
+// when opened with ?v=1, see streamEnvelope.
+//
+// Seq numbers the snapshot and update messages of a topic. Updates are
+// numbered consecutively per topic, shared by every client, and a snapshot
+// carries the seq of the last update it contains. A client that sees an
+// update whose seq is not one more than the previous one has missed messages
+// and should resubscribe to the topic. Messages that do not carry topic
+// state, such as subscribed or error, have no seq.
+type Envelope struct {
+	Version   int             `json:"v"`
+	Type      string          `json:"type"`
+	Topic     string          `json:"topic"`
+	Seq       uint64          `json:"seq,omitempty"`
+	Timestamp int64           `json:"ts"`
+	Payload   json.RawMessage `json:"payload,omitempty"`
+}
+
+// newEnvelope marshals payload in an Envelope stamped with the current time
+// in milliseconds.
+func newEnvelope(msgType, topic string, seq uint64, payload []byte) ([]byte, error) {
+	return json.Marshal(Envelope{
+		Version:   protocolVersion,
+		Type:      msgType,
+		Topic:     topic,
+		Seq:       seq,
+		Timestamp: time.Now().UnixMilli(),
+		Payload:   payload,
+	})
+}
+
+// streamEnvelope wraps the messages of a dedicated endpoint connection in
+// Envelopes. Those endpoints keep their original message shapes unless the
+// connection is opened with ?v=1.
+//
+// A dedicated connection follows a single stream, named by topic. Its seqs
+// are counted per connection rather than shared with /ws: every queued
+// update increments it, so a gap means the connection was too slow and
+// updates were dropped or coalesced. Snapshots are written as soon as they
+// are read and updates queued meanwhile follow them, so unlike on /ws they
+// have no seq, nor do errors, heartbeats and unsubscribed messages.
+type streamEnvelope struct {
+	mu    sync.Mutex
+	topic string
+	seq   uint64
+}
+
+// newStreamEnvelope returns the envelope for a dedicated endpoint request,
+// or nil if r did not ask for it.
+func newStreamEnvelope(r *http.Request, topic string) *streamEnvelope {
+	if r.URL.Query().Get("v") != strconv.Itoa(protocolVersion) {
+		return nil
+	}
+	return &streamEnvelope{topic: topic}
+}
+
+// frame wraps msg in an envelope of type msgType. A nil e returns msg as is.
+func (e *streamEnvelope) frame(msgType string, msg []byte) []byte {
+	if e == nil {
+		return msg
+	}
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return e.frameLocked(msgType, msg)
+}
+
+// push queues msg on msgs like frame, numbering updates and queueing them
+// under e.mu so that seqs reach the outbox in order. An empty msgType
+// queues msg unwrapped, as JSON-RPC responses are on every endpoint. It
+// reports false if msgs is full.
+func (e *streamEnvelope) push(msgs *outbox, msgType, key string, msg []byte) bool {
+	if e == nil || msgType == "" {
+		return msgs.push(key, msg)
+	}
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return msgs.push(key, e.frameLocked(msgType, msg))
+}
+
+// frameLocked wraps msg, taking the next seq for updates. e.mu must be held.
+func (e *streamEnvelope) frameLocked(msgType string, msg []byte) []byte {
+	topic, seq := e.topic, uint64(0)
+	switch msgType {
+	case wsTypeSnapshot, wsTypeError, wsTypeUnsubscribed:
+	case wsTypeHeartbeat:
+		topic = ""
+	default:
+		e.seq++
+		seq = e.seq
+	}
+	wrapped, err := newEnvelope(msgType, topic, seq, msg)
+	if err != nil {
+		log.Printf("Error marshalling %s message: %v", topic, err)
+		return msg
+	}
+	return wrapped
+}
+
+// errorPayload encodes err for the connection: an error frame with
+// PayloadType "error" without an envelope, the /ws error payload with one.
+func (e *streamEnvelope) errorPayload(err error) []byte {
+	if e == nil {
+		return errorPayload(err)
+	}
+	msg, _ := json.Marshal(errorFrame(err))
+	return msg
+}
+
+// errorMessage is the complete message reporting err, for writes that
+// bypass the outbox.
+func (e *streamEnvelope) errorMessage(err error) []byte {
+	return e.frame(wsTypeError, e.errorPayload(err))
+}
+
+// heartbeatPayload is the payload of a heartbeat, which an envelope
+// carries in its type alone.
+func (e *streamEnvelope) heartbeatPayload() []byte {
+	if e == nil {
+		return heartbeatMessage()
+	}
+	return nil
+}
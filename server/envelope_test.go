@@ -0,0 +1,108 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+)
+
+func TestNewStreamEnvelope(t *testing.T) {
+	for target, want := range map[string]bool{
+		"/subscribeVault":      false,
+		"/subscribeVault?v=1":  true,
+		"/subscribeVault?v=2":  false,
+		"/subscribeGas?v=1&x=": true,
+	} {
+		e := newStreamEnvelope(httptest.NewRequest("GET", target, nil), streamVault)
+		if got := e != nil; got != want {
+			t.Errorf("newStreamEnvelope(%q) set = %t, want %t", target, got, want)
+		}
+	}
+}
+
+func TestStreamEnvelopeWithoutEnvelope(t *testing.T) {
+	var e *streamEnvelope
+	if got := string(e.frame(wsTypeSnapshot, []byte(`{"payloadType":"initial"}`))); got != `{"payloadType":"initial"}` {
+		t.Errorf("frame = %s, want the payload as is", got)
+	}
+	var frame ErrorFrame
+	if err := json.Unmarshal(e.errorPayload(invalidRequest("bad")), &frame); err != nil {
+		t.Fatal(err)
+	}
+	if frame.PayloadType != "error" || frame.Code != codeInvalidRequest {
+		t.Errorf("errorPayload = %+v, want the legacy error frame", frame)
+	}
+}
+
+func TestStreamEnvelopeSeq(t *testing.T) {
+	e := &streamEnvelope{topic: streamVault}
+	msgs := newOutbox(16, slowPolicyDisconnect)
+	e.push(msgs, "vaultState", "", []byte(`{}`))
+	snapshot := e.frame(wsTypeSnapshot, []byte(`{}`))
+	e.push(msgs, "bid", "", []byte(`{}`))
+	e.push(msgs, wsTypeError, "", e.errorPayload(errors.New("boom")))
+	e.push(msgs, wsTypeHeartbeat, "heartbeat", e.heartbeatPayload())
+	e.push(msgs, "optionRoundState", "", []byte(`{}`))
+	e.push(msgs, "", "", []byte(`{"jsonrpc":"2.0","id":1,"result":null}`))
+
+	type frame struct {
+		Type  string
+		Topic string
+		Seq   uint64
+	}
+	decode := func(msg []byte) frame {
+		var env Envelope
+		if err := json.Unmarshal(msg, &env); err != nil {
+			t.Fatalf("decode %s: %v", msg, err)
+		}
+		if env.Version != protocolVersion {
+			t.Errorf("version = %d, want %d", env.Version, protocolVersion)
+		}
+		return frame{env.Type, env.Topic, env.Seq}
+	}
+	if got, want := decode(snapshot), (frame{wsTypeSnapshot, streamVault, 0}); got != want {
+		t.Errorf("snapshot = %+v, want %+v", got, want)
+	}
+	queued := msgs.drain()
+	var got []frame
+	for _, msg := range queued[:len(queued)-1] {
+		got = append(got, decode(msg))
+	}
+	want := []frame{
+		{"vaultState", streamVault, 1},
+		{"bid", streamVault, 2},
+		{wsTypeError, streamVault, 0},
+		{wsTypeHeartbeat, "", 0},
+		{"optionRoundState", streamVault, 3},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("queued %+v, want %+v", got, want)
+	}
+	if rpc := string(queued[len(queued)-1]); rpc != `{"jsonrpc":"2.0","id":1,"result":null}` {
+		t.Errorf("JSON-RPC response = %s, want it unwrapped", rpc)
+	}
+}
+
+func TestStreamEnvelopeGapAfterCoalescing(t *testing.T) {
+	e := &streamEnvelope{topic: streamVault}
+	msgs := newOutbox(2, slowPolicyCoalesce)
+	e.push(msgs, "vaultState", "vault", []byte(`{}`))
+	e.push(msgs, "bid", "bid", []byte(`{}`))
+	e.push(msgs, "vaultState", "vault", []byte(`{}`))
+
+	var seqs []uint64
+	for _, msg := range msgs.drain() {
+		var env Envelope
+		if err := json.Unmarshal(msg, &env); err != nil {
+			t.Fatal(err)
+		}
+		seqs = append(seqs, env.Seq)
+	}
+	// The first vaultState was replaced in place, so the client sees seq 3
+	// before 2 and resyncs.
+	if want := []uint64{3, 2}; !reflect.DeepEqual(seqs, want) {
+		t.Errorf("seqs = %v, want %v", seqs, want)
+	}
+}
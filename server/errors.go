@@ -0,0 +1,102 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"pitchlake-backend/db"
+)
+
+// Error codes sent to clients in error frames.
+const (
+	codeInvalidRequest = "invalid_request"
+	codeVaultNotFound  = "vault_not_found"
+	codeNotFound       = "not_found"
+	codeUnauthorized   = "unauthorized"
+	codeRateLimited    = "rate_limited"
+	codeInternal       = "internal"
+)
+
+// ErrorFrame reports a failed request to a client. The dedicated endpoints
+// send it with PayloadType "error", /ws and the dedicated endpoints opened
+// with ?v=1 as the payload of an error envelope.
+// RetryAfter is in milliseconds and only set for rate_limited.
+type ErrorFrame struct {
+	PayloadType string `json:"payloadType,omitempty"`
+	Code        string `json:"code"`
+	Message     string `json:"message"`
+	RetryAfter  int64  `json:"retryAfter,omitempty"`
+}
+
+// clientError is a failure caused by the client's request, reported with
+// its code and message.
+type clientError struct {
+	code    string
+	message string
+}
+
+func (e *clientError) Error() string {
+	return e.message
+}
+
+func invalidRequest(format string, args ...any) error {
+	return &clientError{code: codeInvalidRequest, message: fmt.Sprintf(format, args...)}
+}
+
+func unauthorized(format string, args ...any) error {
+	return &clientError{code: codeUnauthorized, message: fmt.Sprintf(format, args...)}
+}
+
+// vaultNotFound reports a missing vault as vault_not_found rather than as
+// a generic missing record.
+func vaultNotFound(vaultAddress string, err error) error {
+	if errors.Is(err, db.ErrNotFound) {
+		return &clientError{code: codeVaultNotFound, message: fmt.Sprintf("vault %s not found", vaultAddress)}
+	}
+	return err
+}
+
+// errorFrame maps err to the frame sent to the client. Internal errors are
+// logged and their details kept from the client.
+func errorFrame(err error) ErrorFrame {
+	var ce *clientError
+	var re *rateLimitError
+	switch {
+	case errors.As(err, &ce):
+		return ErrorFrame{Code: ce.code, Message: ce.message}
+	case errors.As(err, &re):
+		return ErrorFrame{Code: codeRateLimited, Message: re.Error(), RetryAfter: re.retryAfter.Milliseconds()}
+	case errors.Is(err, db.ErrNotFound):
+		return ErrorFrame{Code: codeNotFound, Message: err.Error()}
+	}
+	log.Printf("Internal error: %v", err)
+	return ErrorFrame{Code: codeInternal, Message: "internal server error"}
+}
+
+// errorPayload encodes err as an error frame for the dedicated endpoints.
+func errorPayload(err error) []byte {
+	frame := errorFrame(err)
+	frame.PayloadType = "error"
+	msg, _ := json.Marshal(frame)
+	return msg
+}
+
+// errorStatus is the HTTP status of each error code.
+var errorStatus = map[string]int{
+	codeInvalidRequest: http.StatusBadRequest,
+	codeVaultNotFound:  http.StatusNotFound,
+	codeNotFound:       http.StatusNotFound,
+	codeUnauthorized:   http.StatusUnauthorized,
+	codeRateLimited:    http.StatusTooManyRequests,
+	codeInternal:       http.StatusInternalServerError,
+}
+
+// writeError answers an HTTP request with the error frame of err.
+func writeError(w http.ResponseWriter, err error) {
+	frame := errorFrame(err)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(errorStatus[frame.Code])
+	json.NewEncoder(w).Encode(frame)
+}
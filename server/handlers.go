@@ -2,8 +2,13 @@ package server
 
 import (
 	"context"
+	"crypto/subtle"
+	"encoding/json"
 	"errors"
 	"net/http"
+	"pitchlake-backend/db"
+	"strconv"
+	"strings"
 
 	"github.com/coder/websocket"
 )
@@ -60,3 +65,93 @@ func (dbs *dbServer) healthCheckHandler(w http.ResponseWriter, r *http.Request)
 	w.WriteHeader(http.StatusOK)
 	w.Write([]byte("OK"))
 }
+
+// statusHandler reports the state of the notification listener so that
+// operators can tell a live server from one waiting on the database.
+func (dbs *dbServer) statusHandler(w http.ResponseWriter, r *http.Request) {
+	total, pending := dbs.deadLetters.counts()
+	status := struct {
+		Listener    listenerStatus `json:"listener"`
+		DeadLetters struct {
+			Total   uint64 `json:"total"`
+			Pending int    `json:"pending"`
+		} `json:"deadLetters"`
+		SchemaMismatches []db.SchemaMismatch `json:"schemaMismatches,omitempty"`
+	}{
+		Listener:         dbs.currentListenerStatus(),
+		SchemaMismatches: dbs.schemaMismatches,
+	}
+	status.DeadLetters.Total = total
+	status.DeadLetters.Pending = pending
+	w.Header().Set("Content-Type", "application/json")
+	if status.Listener.State != listenerConnected || len(status.SchemaMismatches) > 0 {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	json.NewEncoder(w).Encode(status)
+}
+
+// requireAdmin guards admin endpoints with the ADMIN_TOKEN bearer token.
+// Admin endpoints are disabled when no token is configured.
+func (dbs *dbServer) requireAdmin(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if dbs.adminToken == "" {
+			http.NotFound(w, r)
+			return
+		}
+		token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !ok || subtle.ConstantTimeCompare([]byte(token), []byte(dbs.adminToken)) != 1 {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		next(w, r)
+	}
+}
+
+func (dbs *dbServer) listDeadLettersHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(dbs.deadLetters.list())
+}
+
+// replayDeadLettersHandler re-processes quarantined notifications. A single
+// letter is replayed when the id query parameter is set, otherwise all of
+// them are. Letters that now process cleanly are removed from the store.
+func (dbs *dbServer) replayDeadLettersHandler(w http.ResponseWriter, r *http.Request) {
+	type replayResult struct {
+		ID    uint64 `json:"id"`
+		Error string `json:"error,omitempty"`
+	}
+
+	letters := dbs.deadLetters.list()
+	if value := r.URL.Query().Get("id"); value != "" {
+		id, err := strconv.ParseUint(value, 10, 64)
+		if err != nil {
+			http.Error(w, "invalid id", http.StatusBadRequest)
+			return
+		}
+		var selected []deadLetter
+		for _, letter := range letters {
+			if letter.ID == id {
+				selected = append(selected, letter)
+			}
+		}
+		if len(selected) == 0 {
+			http.NotFound(w, r)
+			return
+		}
+		letters = selected
+	}
+
+	results := make([]replayResult, 0, len(letters))
+	for _, letter := range letters {
+		result := replayResult{ID: letter.ID}
+		err := dbs.dispatch(letter.Channel, letter.Payload)
+		if err != nil {
+			result.Error = err.Error()
+		} else {
+			dbs.deadLetters.remove(letter.ID)
+		}
+		results = append(results, result)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(results)
+}
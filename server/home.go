@@ -0,0 +1,262 @@
+package server
+
+import (
+	"encoding/json"
+	"log"
+	"pitchlake-backend/models"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Home stream event types.
+const (
+	homeVaultCreated      = "vaultCreated"
+	homeBalancesChanged   = "balancesChanged"
+	homeRoundStateChanged = "roundStateChanged"
+	homeVaultRemoved      = "vaultRemoved"
+)
+
+// HomeVaultUpdate is the compact summary pushed to home subscribers when a
+// vault is created or removed or its balances or current round change.
+type HomeVaultUpdate struct {
+	Type            string         `json:"type"`
+	VaultAddress    string         `json:"vaultAddress"`
+	LockedBalance   *models.BigInt `json:"lockedBalance,omitempty"`
+	UnlockedBalance *models.BigInt `json:"unlockedBalance,omitempty"`
+	StashedBalance  *models.BigInt `json:"stashedBalance,omitempty"`
+	RoundAddress    string         `json:"roundAddress,omitempty"`
+	RoundID         *models.BigInt `json:"roundId,omitempty"`
+	RoundState      string         `json:"roundState,omitempty"`
+}
+
+// Sort orders accepted in subscriberHomeMessage.SortBy.
+const (
+	homeSortTVL           = "tvl"
+	homeSortRoundDuration = "roundDuration"
+	homeSortAuctionEnd    = "auctionEnd"
+)
+
+// subscriberHomeMessage selects and orders the vault summaries sent to a
+// home subscriber. Zero values mean no filter and ascending address order.
+type subscriberHomeMessage struct {
+	SortBy        string `json:"sortBy"`
+	Descending    bool   `json:"descending"`
+	RoundDuration uint64 `json:"roundDuration"`
+	RoundState    string `json:"roundState"`
+}
+
+// InitialPayloadHome is sent when a home subscriber connects and again
+// whenever it changes its sorting or filtering options.
+type InitialPayloadHome struct {
+	PayloadType    string                 `json:"payloadType"`
+	VaultAddresses []string               `json:"vaultAddresses"`
+	Vaults         []*models.VaultSummary `json:"vaults"`
+}
+
+// homePayload builds the home payload for the vaults selected by sm.
+func (dbs *dbServer) homePayload(sm subscriberHomeMessage) ([]byte, error) {
+	switch sm.SortBy {
+	case "", homeSortTVL, homeSortRoundDuration, homeSortAuctionEnd:
+	default:
+		return nil, invalidRequest("unknown sortBy %q", sm.SortBy)
+	}
+	summaries, err := dbs.db.GetVaultSummaries()
+	if err != nil {
+		return nil, err
+	}
+
+	now := uint64(time.Now().Unix())
+	payload := InitialPayloadHome{
+		PayloadType:    "initial",
+		VaultAddresses: []string{},
+		Vaults:         []*models.VaultSummary{},
+	}
+	for _, summary := range summaries {
+		if sm.RoundDuration != 0 && summary.RoundDuration != sm.RoundDuration {
+			continue
+		}
+		if sm.RoundState != "" && !strings.EqualFold(summary.RoundState, sm.RoundState) {
+			continue
+		}
+		if summary.AuctionEndDate > now {
+			summary.AuctionEndsIn = summary.AuctionEndDate - now
+		}
+		payload.Vaults = append(payload.Vaults, summary)
+	}
+
+	compare := func(a, b *models.VaultSummary) int {
+		switch sm.SortBy {
+		case homeSortTVL:
+			return a.TVL.Cmp(b.TVL.Int)
+		case homeSortRoundDuration:
+			return compareUint64(a.RoundDuration, b.RoundDuration)
+		case homeSortAuctionEnd:
+			return compareUint64(a.AuctionEndDate, b.AuctionEndDate)
+		}
+		return strings.Compare(a.Address, b.Address)
+	}
+	sort.SliceStable(payload.Vaults, func(i, j int) bool {
+		if sm.Descending {
+			return compare(payload.Vaults[j], payload.Vaults[i]) < 0
+		}
+		return compare(payload.Vaults[i], payload.Vaults[j]) < 0
+	})
+	for _, summary := range payload.Vaults {
+		payload.VaultAddresses = append(payload.VaultAddresses, summary.Address)
+	}
+	return json.Marshal(payload)
+}
+
+func compareUint64(a, b uint64) int {
+	switch {
+	case a < b:
+		return -1
+	case a > b:
+		return 1
+	}
+	return 0
+}
+
+// homeVault is what the home stream last told subscribers about a vault.
+type homeVault struct {
+	currentRoundAddress string
+	balances            string
+	roundStates         map[string]string
+}
+
+// homeVaultEvents returns the home messages for a vault_update notification:
+// vaultCreated for new vaults, vaultRemoved for deleted ones, balancesChanged
+// when any balance moved and roundStateChanged when the vault moved on to a
+// round whose state is known. An update to a vault not seen before only sets
+// its baseline.
+func (dbs *dbServer) homeVaultEvents(operation string, vs *models.VaultState) []outboundMessage {
+	if operation == "DELETE" {
+		dbs.homeVaultsMu.Lock()
+		delete(dbs.homeVaults, vs.Address)
+		dbs.homeVaultsMu.Unlock()
+		return homeMessage(HomeVaultUpdate{
+			Type:         homeVaultRemoved,
+			VaultAddress: vs.Address,
+		}, "home:"+homeVaultRemoved+":"+vs.Address)
+	}
+	balances := homeBalances(vs)
+
+	dbs.homeVaultsMu.Lock()
+	hv, known := dbs.homeVaults[vs.Address]
+	if !known {
+		hv = dbs.seedHomeVault(vs)
+	}
+	balancesChanged := known && hv.balances != balances
+	roundChanged := known && hv.currentRoundAddress != vs.CurrentRoundAddress
+	roundState := hv.roundStates[vs.CurrentRoundAddress]
+	hv.balances = balances
+	hv.currentRoundAddress = vs.CurrentRoundAddress
+	dbs.homeVaultsMu.Unlock()
+
+	var out []outboundMessage
+	update := HomeVaultUpdate{
+		VaultAddress:    vs.Address,
+		LockedBalance:   &vs.LockedBalance,
+		UnlockedBalance: &vs.UnlockedBalance,
+		StashedBalance:  &vs.StashedBalance,
+	}
+	switch {
+	case operation == "INSERT":
+		update.Type = homeVaultCreated
+		out = append(out, homeMessage(update, "home:"+homeVaultCreated+":"+vs.Address)...)
+	case balancesChanged:
+		update.Type = homeBalancesChanged
+		out = append(out, homeMessage(update, "home:"+homeBalancesChanged+":"+vs.Address)...)
+	}
+	if roundChanged && roundState != "" {
+		out = append(out, homeMessage(HomeVaultUpdate{
+			Type:         homeRoundStateChanged,
+			VaultAddress: vs.Address,
+			RoundAddress: vs.CurrentRoundAddress,
+			RoundID:      &vs.CurrentRound,
+			RoundState:   roundState,
+		}, "home:"+homeRoundStateChanged+":"+vs.Address)...)
+	}
+	return out
+}
+
+// homeRoundEvents returns a roundStateChanged message when the state of a
+// vault's current round changes. Updates to older rounds are not relevant
+// to the home page, and deleted rounds are only forgotten.
+func (dbs *dbServer) homeRoundEvents(operation string, or *models.OptionRound) []outboundMessage {
+	dbs.homeVaultsMu.Lock()
+	hv, known := dbs.homeVaults[or.VaultAddress]
+	if operation == "DELETE" {
+		if known {
+			delete(hv.roundStates, or.Address)
+		}
+		dbs.homeVaultsMu.Unlock()
+		return nil
+	}
+	dbs.homeVaultsMu.Unlock()
+	if !known {
+		// Learn the current round of a vault the home stream has not seen
+		// an update for yet.
+		vaultState, err := dbs.db.GetVaultStateByID(or.VaultAddress)
+		if err != nil {
+			log.Printf("Error fetching vault %s for home stream: %v", or.VaultAddress, err)
+			return nil
+		}
+		dbs.homeVaultsMu.Lock()
+		if _, known := dbs.homeVaults[or.VaultAddress]; !known {
+			dbs.seedHomeVault(vaultState)
+		}
+		dbs.homeVaultsMu.Unlock()
+	}
+
+	// The vault may have been deleted since, by a concurrent notification
+	// or a dead letter replay.
+	dbs.homeVaultsMu.Lock()
+	hv, known = dbs.homeVaults[or.VaultAddress]
+	if !known {
+		dbs.homeVaultsMu.Unlock()
+		return nil
+	}
+	isCurrent := hv.currentRoundAddress == or.Address
+	changed := hv.roundStates[or.Address] != or.RoundState
+	hv.roundStates[or.Address] = or.RoundState
+	dbs.homeVaultsMu.Unlock()
+	if !isCurrent || !changed {
+		return nil
+	}
+
+	return homeMessage(HomeVaultUpdate{
+		Type:         homeRoundStateChanged,
+		VaultAddress: or.VaultAddress,
+		RoundAddress: or.Address,
+		RoundID:      &or.RoundID,
+		RoundState:   or.RoundState,
+	}, "home:"+homeRoundStateChanged+":"+or.VaultAddress)
+}
+
+// seedHomeVault records vs as the baseline of a vault the home stream has
+// not seen yet. Nothing is announced for it, as there is no earlier state to
+// compare with. homeVaultsMu must be held.
+func (dbs *dbServer) seedHomeVault(vs *models.VaultState) *homeVault {
+	hv := &homeVault{
+		currentRoundAddress: vs.CurrentRoundAddress,
+		balances:            homeBalances(vs),
+		roundStates:         make(map[string]string),
+	}
+	dbs.homeVaults[vs.Address] = hv
+	return hv
+}
+
+func homeBalances(vs *models.VaultState) string {
+	return vs.LockedBalance.String() + "/" + vs.UnlockedBalance.String() + "/" + vs.StashedBalance.String()
+}
+
+func homeMessage(update HomeVaultUpdate, key string) []outboundMessage {
+	response, err := json.Marshal(update)
+	if err != nil {
+		log.Printf("Error marshalling home update: %v", err)
+		return nil
+	}
+	return []outboundMessage{{stream: streamHome, msgType: update.Type, key: key, msg: response}}
+}
@@ -0,0 +1,125 @@
+package server
+
+import (
+	"encoding/json"
+	"math/big"
+	"reflect"
+	"testing"
+
+	"pitchlake-backend/models"
+)
+
+func TestHomePayloadRejectsUnknownSort(t *testing.T) {
+	dbs := newTestServer(t)
+	_, err := dbs.homePayload(subscriberHomeMessage{SortBy: "popularity"})
+	if err == nil {
+		t.Fatal("homePayload accepted an unknown sortBy")
+	}
+	if frame := errorFrame(err); frame.Code != codeInvalidRequest {
+		t.Errorf("error code = %q, want %q", frame.Code, codeInvalidRequest)
+	}
+}
+
+func testVaultState(address, round string, locked int64) *models.VaultState {
+	return &models.VaultState{
+		Address:             address,
+		CurrentRoundAddress: round,
+		CurrentRound:        models.BigInt{Int: big.NewInt(1)},
+		LockedBalance:       models.BigInt{Int: big.NewInt(locked)},
+	}
+}
+
+func testOptionRound(vault, address, state string) *models.OptionRound {
+	return &models.OptionRound{
+		VaultAddress: vault,
+		Address:      address,
+		RoundID:      models.BigInt{Int: big.NewInt(1)},
+		RoundState:   state,
+	}
+}
+
+// homeEvent describes a home message as "<type> <round state>".
+func homeEvent(t *testing.T, m outboundMessage) string {
+	t.Helper()
+	var update HomeVaultUpdate
+	if err := json.Unmarshal(m.msg, &update); err != nil {
+		t.Fatal(err)
+	}
+	if m.msgType != update.Type {
+		t.Errorf("message type %q carries update %q", m.msgType, update.Type)
+	}
+	return update.Type + " " + update.RoundState
+}
+
+func TestHomeEvents(t *testing.T) {
+	dbs := newTestServer(t)
+	steps := []struct {
+		name   string
+		events func() []outboundMessage
+		want   []string
+	}{
+		{
+			name:   "first update of an unknown vault",
+			events: func() []outboundMessage { return dbs.homeVaultEvents("UPDATE", testVaultState("0x1", "0xa", 5)) },
+		},
+		{
+			name:   "new balances",
+			events: func() []outboundMessage { return dbs.homeVaultEvents("UPDATE", testVaultState("0x1", "0xa", 6)) },
+			want:   []string{"balancesChanged "},
+		},
+		{
+			name:   "same balances",
+			events: func() []outboundMessage { return dbs.homeVaultEvents("UPDATE", testVaultState("0x1", "0xa", 6)) },
+		},
+		{
+			name:   "new vault",
+			events: func() []outboundMessage { return dbs.homeVaultEvents("INSERT", testVaultState("0x2", "0xb", 0)) },
+			want:   []string{"vaultCreated "},
+		},
+		{
+			name: "current round moves on",
+			events: func() []outboundMessage {
+				return dbs.homeRoundEvents("UPDATE", testOptionRound("0x1", "0xa", "Auctioning"))
+			},
+			want: []string{"roundStateChanged Auctioning"},
+		},
+		{
+			name: "current round unchanged",
+			events: func() []outboundMessage {
+				return dbs.homeRoundEvents("UPDATE", testOptionRound("0x1", "0xa", "Auctioning"))
+			},
+		},
+		{
+			name:   "next round is not current yet",
+			events: func() []outboundMessage { return dbs.homeRoundEvents("INSERT", testOptionRound("0x1", "0xc", "Open")) },
+		},
+		{
+			name:   "vault moves to the next round",
+			events: func() []outboundMessage { return dbs.homeVaultEvents("UPDATE", testVaultState("0x1", "0xc", 0)) },
+			want:   []string{"balancesChanged ", "roundStateChanged Open"},
+		},
+		{
+			name:   "deleted round",
+			events: func() []outboundMessage { return dbs.homeRoundEvents("DELETE", testOptionRound("0x1", "0xa", "")) },
+		},
+		{
+			name:   "deleted vault",
+			events: func() []outboundMessage { return dbs.homeVaultEvents("DELETE", testVaultState("0x2", "", 0)) },
+			want:   []string{"vaultRemoved "},
+		},
+		{
+			name:   "deleted vault comes back",
+			events: func() []outboundMessage { return dbs.homeVaultEvents("INSERT", testVaultState("0x2", "0xb", 0)) },
+			want:   []string{"vaultCreated "},
+		},
+	}
+	for _, step := range steps {
+		var got []string
+		for _, m := range step.events() {
+			got = append(got, homeEvent(t, m))
+		}
+		if !reflect.DeepEqual(got, step.want) {
+			t.Errorf("%s: events %q, want %q", step.name, got, step.want)
+		}
+	}
+}
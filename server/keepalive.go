@@ -0,0 +1,99 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"time"
+
+	"github.com/coder/websocket"
+)
+
+// keepaliveConfig controls how connections are kept alive through proxies
+// and how dead peers are detected. A zero heartbeatInterval disables the
+// application heartbeat.
+type keepaliveConfig struct {
+	pingInterval      time.Duration
+	pingTimeout       time.Duration
+	heartbeatInterval time.Duration
+}
+
+func keepaliveConfigFromEnv() keepaliveConfig {
+	config := keepaliveConfig{
+		pingInterval:      20 * time.Second,
+		pingTimeout:       10 * time.Second,
+		heartbeatInterval: 30 * time.Second,
+	}
+	durationFromEnv("PING_INTERVAL", &config.pingInterval, false)
+	durationFromEnv("PING_TIMEOUT", &config.pingTimeout, false)
+	durationFromEnv("HEARTBEAT_INTERVAL", &config.heartbeatInterval, true)
+	return config
+}
+
+// durationFromEnv overwrites d with the named environment variable when it
+// is set to a valid duration. Zero is only accepted when allowZero is set.
+func durationFromEnv(name string, d *time.Duration, allowZero bool) {
+	value := os.Getenv(name)
+	if value == "" {
+		return
+	}
+	parsed, err := time.ParseDuration(value)
+	if err != nil || parsed < 0 || (parsed == 0 && !allowZero) {
+		log.Printf("Invalid %s %q, using %s", name, value, *d)
+		return
+	}
+	*d = parsed
+}
+
+// keepalive pings c every pingInterval and calls heartbeat every
+// heartbeatInterval until ctx is done. A read loop must be running on c for
+// pongs to be received. The returned channel yields an error once the peer
+// fails to answer a ping within pingTimeout; the connection is closed by
+// then.
+func (dbs *dbServer) keepalive(ctx context.Context, c *websocket.Conn, heartbeat func()) <-chan error {
+	errc := make(chan error, 1)
+	go func() {
+		ping := time.NewTicker(dbs.keepaliveConfig.pingInterval)
+		defer ping.Stop()
+		var beat <-chan time.Time
+		if dbs.keepaliveConfig.heartbeatInterval > 0 {
+			ticker := time.NewTicker(dbs.keepaliveConfig.heartbeatInterval)
+			defer ticker.Stop()
+			beat = ticker.C
+		}
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-beat:
+				heartbeat()
+			case <-ping.C:
+				pingCtx, cancel := context.WithTimeout(ctx, dbs.keepaliveConfig.pingTimeout)
+				err := c.Ping(pingCtx)
+				cancel()
+				if err != nil {
+					if ctx.Err() != nil {
+						return
+					}
+					// The peer is gone, so don't wait on a close handshake.
+					c.CloseNow()
+					errc <- fmt.Errorf("peer did not answer ping: %w", err)
+					return
+				}
+			}
+		}
+	}()
+	return errc
+}
+
+// heartbeatMessage is the application heartbeat sent on the dedicated
+// endpoints, for clients behind proxies that strip control frames.
+func heartbeatMessage() []byte {
+	msg, _ := json.Marshal(struct {
+		Type      string `json:"type"`
+		Timestamp int64  `json:"timestamp"`
+	}{"heartbeat", time.Now().UnixMilli()})
+	return msg
+}
@@ -0,0 +1,65 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/jackc/pgx/v5/pgconn"
+)
+
+// fakeNotificationConn returns its notifications in order, then fails.
+type fakeNotificationConn struct {
+	notifications []*pgconn.Notification
+}
+
+var errConnClosed = errors.New("connection closed")
+
+func (c *fakeNotificationConn) WaitForNotification(ctx context.Context) (*pgconn.Notification, error) {
+	if len(c.notifications) == 0 {
+		return nil, errConnClosed
+	}
+	n := c.notifications[0]
+	c.notifications = c.notifications[1:]
+	return n, nil
+}
+
+// stateHandler turns every notification into a home update carrying the
+// payload.
+type stateHandler struct{}
+
+func (stateHandler) channel() string { return "state_update" }
+
+func (stateHandler) handle(dbs *dbServer, payload string) ([]outboundMessage, error) {
+	return []outboundMessage{{stream: streamHome, msgType: "state", key: "state", msg: []byte(payload)}}, nil
+}
+
+func TestResyncRunsBeforeNotifications(t *testing.T) {
+	dbs := newTestServer(t, func(dbs *dbServer) {
+		dbs.channels = newChannelRegistry()
+		dbs.channels.register(stateHandler{})
+	})
+	s := &subscriberHome{streamConn{msgs: newOutbox(8, slowPolicyDisconnect)}}
+	dbs.addSubscriberHome(s)
+
+	// The resync read the state before the newer notification arrived, but
+	// is slow to push it.
+	resync := func() {
+		time.Sleep(20 * time.Millisecond)
+		dbs.deliver(outboundMessage{stream: streamHome, msgType: "state", key: "state", msg: []byte(`"stale"`)})
+	}
+	conn := &fakeNotificationConn{notifications: []*pgconn.Notification{{Channel: "state_update", Payload: `"newer"`}}}
+	if err := dbs.serveNotifications(context.Background(), conn, resync); err != errConnClosed {
+		t.Fatalf("serveNotifications = %v, want %v", err, errConnClosed)
+	}
+
+	var got []string
+	for _, msg := range s.msgs.drain() {
+		got = append(got, string(msg))
+	}
+	if want := []string{`"stale"`, `"newer"`}; !reflect.DeepEqual(got, want) {
+		t.Errorf("subscriber got %v, want %v", got, want)
+	}
+}
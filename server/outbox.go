@@ -0,0 +1,138 @@
+package server
+
+import (
+	"log"
+	"os"
+	"sync"
+)
+
+// slowPolicy decides what happens when a subscriber's outbox is full.
+type slowPolicy string
+
+const (
+	// slowPolicyDisconnect closes the connection of a subscriber that
+	// cannot keep up.
+	slowPolicyDisconnect slowPolicy = "disconnect"
+	// slowPolicyDropOldest discards the oldest queued message to make room.
+	slowPolicyDropOldest slowPolicy = "drop_oldest"
+	// slowPolicyCoalesce replaces a queued message for the same entity with
+	// the latest one. Messages without an entity key, or for an entity that
+	// is not queued, fall back to disconnecting the subscriber.
+	slowPolicyCoalesce slowPolicy = "coalesce"
+)
+
+// slowPolicyFromEnv reads a slowPolicy from the named environment variable,
+// falling back to def when it is unset or unknown.
+func slowPolicyFromEnv(name string, def slowPolicy) slowPolicy {
+	value := os.Getenv(name)
+	switch slowPolicy(value) {
+	case slowPolicyDisconnect, slowPolicyDropOldest, slowPolicyCoalesce:
+		return slowPolicy(value)
+	case "":
+		return def
+	default:
+		log.Printf("Unknown %s %q, using %s", name, value, def)
+		return def
+	}
+}
+
+type outboxMessage struct {
+	key string
+	msg []byte
+}
+
+// outbox is a bounded, non-blocking message queue for a single subscriber.
+// Producers never block on push; the subscriber's write loop waits on ready
+// and drains everything queued so far. done is closed once the subscriber
+// has been found too slow.
+type outbox struct {
+	mu       sync.Mutex
+	capacity int
+	policy   slowPolicy
+	queue    []outboxMessage
+	closed   bool
+	ready    chan struct{}
+	done     chan struct{}
+}
+
+func newOutbox(capacity int, policy slowPolicy) *outbox {
+	return &outbox{
+		capacity: capacity,
+		policy:   policy,
+		queue:    make([]outboxMessage, 0, capacity),
+		ready:    make(chan struct{}, 1),
+		done:     make(chan struct{}),
+	}
+}
+
+// push queues msg for delivery. key identifies the entity the message
+// describes and is used by slowPolicyCoalesce; it may be empty. push returns
+// false if the subscriber is too slow and must be disconnected.
+func (o *outbox) push(key string, msg []byte) bool {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if o.closed {
+		return true
+	}
+
+	if len(o.queue) >= o.capacity {
+		switch o.policy {
+		case slowPolicyDropOldest:
+			o.queue = append(o.queue[:0], o.queue[1:]...)
+		case slowPolicyCoalesce:
+			if !o.coalesce(key, msg) {
+				o.close()
+				return false
+			}
+			o.signal()
+			return true
+		default:
+			o.close()
+			return false
+		}
+	}
+
+	o.queue = append(o.queue, outboxMessage{key: key, msg: msg})
+	o.signal()
+	return true
+}
+
+// coalesce replaces the queued message for key with msg. o.mu must be held.
+func (o *outbox) coalesce(key string, msg []byte) bool {
+	if key == "" {
+		return false
+	}
+	for i := range o.queue {
+		if o.queue[i].key == key {
+			o.queue[i].msg = msg
+			return true
+		}
+	}
+	return false
+}
+
+// close stops accepting messages. o.mu must be held.
+func (o *outbox) close() {
+	o.closed = true
+	o.queue = o.queue[:0]
+	close(o.done)
+}
+
+func (o *outbox) signal() {
+	select {
+	case o.ready <- struct{}{}:
+	default:
+	}
+}
+
+// drain removes and returns every queued message in order.
+func (o *outbox) drain() [][]byte {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	msgs := make([][]byte, len(o.queue))
+	for i, m := range o.queue {
+		msgs[i] = m.msg
+	}
+	o.queue = o.queue[:0]
+	return msgs
+}
@@ -0,0 +1,158 @@
+package server
+
+import (
+	"reflect"
+	"testing"
+)
+
+type push struct {
+	key, msg string
+}
+
+func TestOutbox(t *testing.T) {
+	tests := []struct {
+		name   string
+		policy slowPolicy
+		pushes []push
+		// ok is the result of the last push.
+		ok     bool
+		closed bool
+		want   []string
+	}{
+		{
+			name:   "disconnect under capacity",
+			policy: slowPolicyDisconnect,
+			pushes: []push{{"a", "1"}, {"a", "2"}, {"", "3"}},
+			ok:     true,
+			want:   []string{"1", "2", "3"},
+		},
+		{
+			name:   "disconnect when full",
+			policy: slowPolicyDisconnect,
+			pushes: []push{{"a", "1"}, {"b", "2"}, {"c", "3"}, {"d", "4"}},
+			ok:     false,
+			closed: true,
+			want:   []string{},
+		},
+		{
+			name:   "drop oldest when full",
+			policy: slowPolicyDropOldest,
+			pushes: []push{{"a", "1"}, {"b", "2"}, {"c", "3"}, {"d", "4"}, {"", "5"}},
+			ok:     true,
+			want:   []string{"3", "4", "5"},
+		},
+		{
+			name:   "coalesce keeps repeated keys under capacity",
+			policy: slowPolicyCoalesce,
+			pushes: []push{{"a", "1"}, {"a", "2"}},
+			ok:     true,
+			want:   []string{"1", "2"},
+		},
+		{
+			name:   "coalesce replaces the queued key when full",
+			policy: slowPolicyCoalesce,
+			pushes: []push{{"a", "1"}, {"b", "2"}, {"c", "3"}, {"b", "4"}, {"a", "5"}},
+			ok:     true,
+			want:   []string{"5", "4", "3"},
+		},
+		{
+			name:   "coalesce disconnects on a new key when full",
+			policy: slowPolicyCoalesce,
+			pushes: []push{{"a", "1"}, {"b", "2"}, {"c", "3"}, {"d", "4"}},
+			ok:     false,
+			closed: true,
+			want:   []string{},
+		},
+		{
+			name:   "coalesce disconnects on an empty key when full",
+			policy: slowPolicyCoalesce,
+			pushes: []push{{"", "1"}, {"", "2"}, {"", "3"}, {"", "4"}},
+			ok:     false,
+			closed: true,
+			want:   []string{},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			o := newOutbox(3, tt.policy)
+			var ok bool
+			for _, p := range tt.pushes {
+				ok = o.push(p.key, []byte(p.msg))
+			}
+			if ok != tt.ok {
+				t.Errorf("last push = %t, want %t", ok, tt.ok)
+			}
+			select {
+			case <-o.done:
+				if !tt.closed {
+					t.Error("outbox closed")
+				}
+			default:
+				if tt.closed {
+					t.Error("outbox not closed")
+				}
+			}
+			got := []string{}
+			for _, msg := range o.drain() {
+				got = append(got, string(msg))
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("drained %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestOutboxReadyAndDrain(t *testing.T) {
+	o := newOutbox(3, slowPolicyDisconnect)
+	o.push("", []byte("1"))
+	o.push("", []byte("2"))
+	select {
+	case <-o.ready:
+	default:
+		t.Fatal("ready not signalled after push")
+	}
+	if got := len(o.drain()); got != 2 {
+		t.Fatalf("drained %d messages, want 2", got)
+	}
+	if got := len(o.drain()); got != 0 {
+		t.Errorf("second drain returned %d messages", got)
+	}
+
+	// Draining frees capacity for new messages.
+	for i := 0; i < 3; i++ {
+		if !o.push("", []byte("x")) {
+			t.Fatalf("push %d after drain failed", i)
+		}
+	}
+}
+
+func TestOutboxClosedIgnoresPushes(t *testing.T) {
+	o := newOutbox(1, slowPolicyDisconnect)
+	o.push("", []byte("1"))
+	if o.push("", []byte("2")) {
+		t.Fatal("push over capacity succeeded")
+	}
+	// Once closed the subscriber is going away; later pushes are dropped
+	// without asking for another disconnect.
+	if !o.push("", []byte("3")) {
+		t.Error("push after close reported slow again")
+	}
+	if got := len(o.drain()); got != 0 {
+		t.Errorf("drained %d messages from a closed outbox", got)
+	}
+}
+
+func TestSlowPolicyFromEnv(t *testing.T) {
+	for value, want := range map[string]slowPolicy{
+		"":            slowPolicyCoalesce,
+		"drop_oldest": slowPolicyDropOldest,
+		"disconnect":  slowPolicyDisconnect,
+		"bogus":       slowPolicyCoalesce,
+	} {
+		t.Setenv("SLOW_POLICY_TEST", value)
+		if got := slowPolicyFromEnv("SLOW_POLICY_TEST", slowPolicyCoalesce); got != want {
+			t.Errorf("slowPolicyFromEnv(%q) = %s, want %s", value, got, want)
+		}
+	}
+}
@@ -0,0 +1,287 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Command kinds with their own rate budgets. Commands that do not query the
+// database are not limited.
+const (
+	commandVault     = "vault"     // /subscribeVault watch
+	commandAccount   = "account"   // /subscribeVault account switch
+	commandHome      = "home"      // /subscribeHome options
+	commandGas       = "gas"       // /subscribeGas block ranges
+	commandSubscribe = "subscribe" // /ws subscribe
+	commandAuth      = "auth"      // sign-in requests, per IP only
+	commandRPC       = "rpc"       // JSON-RPC calls
+	commandREST      = "rest"      // REST API requests, per IP only
+)
+
+// rateBudget allows burst commands at once, refilled at burst per period.
+// A zero budget is unlimited.
+type rateBudget struct {
+	burst  float64
+	period time.Duration
+}
+
+func (b rateBudget) String() string {
+	if b.burst == 0 {
+		return "0"
+	}
+	return fmt.Sprintf("%g/%s", b.burst, b.period)
+}
+
+// parseRateBudget parses "<burst>/<period>", e.g. "20/1m", or "0".
+func parseRateBudget(value string) (rateBudget, error) {
+	if value == "0" {
+		return rateBudget{}, nil
+	}
+	burst, period, ok := strings.Cut(value, "/")
+	if !ok {
+		return rateBudget{}, fmt.Errorf("expected <burst>/<period>")
+	}
+	n, err := strconv.ParseUint(burst, 10, 32)
+	if err != nil || n == 0 {
+		return rateBudget{}, fmt.Errorf("invalid burst %q", burst)
+	}
+	d, err := time.ParseDuration(period)
+	if err != nil || d <= 0 {
+		return rateBudget{}, fmt.Errorf("invalid period %q", period)
+	}
+	return rateBudget{burst: float64(n), period: d}, nil
+}
+
+// rateLimitConfig holds the budgets of each command kind, per connection and
+// per client IP. Strikes is the number of consecutive rejected commands
+// after which a connection is closed.
+type rateLimitConfig struct {
+	perConnection map[string]rateBudget
+	perIP         map[string]rateBudget
+	strikes       int
+}
+
+func rateLimitConfigFromEnv() rateLimitConfig {
+	config := rateLimitConfig{
+		perConnection: map[string]rateBudget{
+			commandVault:     {burst: 20, period: time.Minute},
+			commandAccount:   {burst: 20, period: time.Minute},
+			commandHome:      {burst: 30, period: time.Minute},
+			commandGas:       {burst: 30, period: time.Minute},
+			commandSubscribe: {burst: 60, period: time.Minute},
+			commandRPC:       {burst: 120, period: time.Minute},
+		},
+		perIP: map[string]rateBudget{
+			commandVault:     {burst: 60, period: time.Minute},
+			commandAccount:   {burst: 60, period: time.Minute},
+			commandHome:      {burst: 120, period: time.Minute},
+			commandGas:       {burst: 120, period: time.Minute},
+			commandSubscribe: {burst: 240, period: time.Minute},
+			commandAuth:      {burst: 10, period: time.Minute},
+			commandRPC:       {burst: 480, period: time.Minute},
+			commandREST:      {burst: 300, period: time.Minute},
+		},
+		strikes: 10,
+	}
+	budgetsFromEnv("RATE_LIMIT_", config.perConnection)
+	budgetsFromEnv("RATE_LIMIT_IP_", config.perIP)
+	intFromEnv("RATE_LIMIT_STRIKES", &config.strikes)
+	return config
+}
+
+func budgetsFromEnv(prefix string, budgets map[string]rateBudget) {
+	for kind, budget := range budgets {
+		name := prefix + strings.ToUpper(kind)
+		value := os.Getenv(name)
+		if value == "" {
+			continue
+		}
+		parsed, err := parseRateBudget(value)
+		if err != nil {
+			log.Printf("Invalid %s %q, using %s", name, value, budget)
+			continue
+		}
+		budgets[kind] = parsed
+	}
+}
+
+// tokenBucket holds the unspent commands of a budget.
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// take spends a token, refilling the bucket for the time since the last
+// call first. Without a token left it returns how long until one is.
+func (b *tokenBucket) take(budget rateBudget, now time.Time) (time.Duration, bool) {
+	rate := budget.burst / budget.period.Seconds()
+	b.tokens = math.Min(budget.burst, b.tokens+now.Sub(b.last).Seconds()*rate)
+	b.last = now
+	if b.tokens >= 1 {
+		b.tokens--
+		return 0, true
+	}
+	return time.Duration((1 - b.tokens) / rate * float64(time.Second)), false
+}
+
+// full reports whether the bucket has refilled completely by now.
+func (b *tokenBucket) full(budget rateBudget, now time.Time) bool {
+	return b.tokens+now.Sub(b.last).Seconds()*budget.burst/budget.period.Seconds() >= budget.burst
+}
+
+func newBucket(budget rateBudget, now time.Time) *tokenBucket {
+	return &tokenBucket{tokens: budget.burst, last: now}
+}
+
+// rateLimitError is returned for a command over budget. Abusive is set once
+// the connection has been rejected too many times in a row.
+type rateLimitError struct {
+	kind       string
+	retryAfter time.Duration
+	abusive    bool
+}
+
+func (e *rateLimitError) Error() string {
+	return fmt.Sprintf("rate limit exceeded for %s commands, retry in %s", e.kind, e.retryAfter.Round(time.Millisecond))
+}
+
+// commandLimiter rate limits the commands of one connection.
+type commandLimiter struct {
+	ip string
+
+	mu      sync.Mutex
+	buckets map[string]*tokenBucket
+	strikes int
+}
+
+func newCommandLimiter(ip string) *commandLimiter {
+	return &commandLimiter{ip: ip, buckets: make(map[string]*tokenBucket)}
+}
+
+// ipLimiter rate limits the commands of every connection from an IP
+// together.
+type ipLimiter struct {
+	mu      sync.Mutex
+	buckets map[string]map[string]*tokenBucket
+}
+
+// take charges a command of kind to ip.
+func (il *ipLimiter) take(ip, kind string, budget rateBudget, now time.Time) (time.Duration, bool) {
+	if budget.burst == 0 {
+		return 0, true
+	}
+	il.mu.Lock()
+	defer il.mu.Unlock()
+	buckets, ok := il.buckets[ip]
+	if !ok {
+		buckets = make(map[string]*tokenBucket)
+		il.buckets[ip] = buckets
+	}
+	b, ok := buckets[kind]
+	if !ok {
+		b = newBucket(budget, now)
+		buckets[kind] = b
+	}
+	return b.take(budget, now)
+}
+
+// expire drops the buckets of IPs that have not sent commands for long
+// enough to be full again, until ctx is done.
+func (il *ipLimiter) expire(ctx context.Context, budgets map[string]rateBudget) {
+	ticker := time.NewTicker(time.Minute)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			il.expireFull(budgets, now)
+		}
+	}
+}
+
+// expireFull drops the buckets that have refilled completely by now.
+func (il *ipLimiter) expireFull(budgets map[string]rateBudget, now time.Time) {
+	il.mu.Lock()
+	defer il.mu.Unlock()
+	for ip, buckets := range il.buckets {
+		for kind, b := range buckets {
+			if b.full(budgets[kind], now) {
+				delete(buckets, kind)
+			}
+		}
+		if len(buckets) == 0 {
+			delete(il.buckets, ip)
+		}
+	}
+}
+
+// charge spends one command of kind from the budgets of the connection and
+// of its IP.
+func (dbs *dbServer) charge(l *commandLimiter, kind string) *rateLimitError {
+	now := dbs.now()
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	retryAfter, ok := time.Duration(0), true
+	if budget := dbs.rateLimits.perConnection[kind]; budget.burst > 0 {
+		b, found := l.buckets[kind]
+		if !found {
+			b = newBucket(budget, now)
+			l.buckets[kind] = b
+		}
+		retryAfter, ok = b.take(budget, now)
+	}
+	if ok {
+		retryAfter, ok = dbs.ipLimits.take(l.ip, kind, dbs.rateLimits.perIP[kind], now)
+	}
+	if ok {
+		l.strikes = 0
+		return nil
+	}
+	l.strikes++
+	return &rateLimitError{kind: kind, retryAfter: retryAfter, abusive: l.strikes >= dbs.rateLimits.strikes}
+}
+
+// chargeIP spends one command of kind from the budget of ip alone, for
+// requests made outside of a websocket connection.
+func (dbs *dbServer) chargeIP(ip, kind string) *rateLimitError {
+	retryAfter, ok := dbs.ipLimits.take(ip, kind, dbs.rateLimits.perIP[kind], dbs.now())
+	if ok {
+		return nil
+	}
+	return &rateLimitError{kind: kind, retryAfter: retryAfter}
+}
+
+// allowIP charges an HTTP request of kind to the client IP, answering with
+// 429 when it is over budget.
+func (dbs *dbServer) allowIP(w http.ResponseWriter, r *http.Request, kind string) bool {
+	err := dbs.chargeIP(dbs.clientIP(r), kind)
+	if err == nil {
+		return true
+	}
+	w.Header().Set("Retry-After", strconv.FormatInt(int64(math.Ceil(err.retryAfter.Seconds())), 10))
+	writeError(w, err)
+	return false
+}
+
+// vaultRequestKind returns the command kind of a /subscribeVault request,
+// or "" for requests that are not limited.
+func vaultRequestKind(request subscriberVaultRequest) string {
+	switch {
+	case request.Action == "watch":
+		return commandVault
+	case request.Action == "unwatch":
+		return ""
+	case request.UpdatedField == "address":
+		return commandAccount
+	}
+	return ""
+}
@@ -0,0 +1,207 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestParseRateBudget(t *testing.T) {
+	tests := []struct {
+		value string
+		want  rateBudget
+		ok    bool
+	}{
+		{"20/1m", rateBudget{burst: 20, period: time.Minute}, true},
+		{"1/500ms", rateBudget{burst: 1, period: 500 * time.Millisecond}, true},
+		{"0", rateBudget{}, true},
+		{"20", rateBudget{}, false},
+		{"0/1m", rateBudget{}, false},
+		{"-1/1m", rateBudget{}, false},
+		{"1.5/1m", rateBudget{}, false},
+		{"20/0s", rateBudget{}, false},
+		{"20/-1m", rateBudget{}, false},
+		{"20/minute", rateBudget{}, false},
+	}
+	for _, tt := range tests {
+		got, err := parseRateBudget(tt.value)
+		if (err == nil) != tt.ok || got != tt.want {
+			t.Errorf("parseRateBudget(%q) = %v, %v, want %v, ok %t", tt.value, got, err, tt.want, tt.ok)
+		}
+	}
+}
+
+// bucketStep takes a token after advancing the clock by after.
+type bucketStep struct {
+	after      time.Duration
+	ok         bool
+	retryAfter time.Duration
+}
+
+func TestTokenBucket(t *testing.T) {
+	perSecond := rateBudget{burst: 3, period: 3 * time.Second}
+	tests := []struct {
+		name   string
+		budget rateBudget
+		steps  []bucketStep
+	}{
+		{
+			name:   "burst then refill",
+			budget: perSecond,
+			steps: []bucketStep{
+				{0, true, 0},
+				{0, true, 0},
+				{0, true, 0},
+				{0, false, time.Second},
+				{500 * time.Millisecond, false, 500 * time.Millisecond},
+				{500 * time.Millisecond, true, 0},
+				{0, false, time.Second},
+			},
+		},
+		{
+			name:   "refill is capped at the burst",
+			budget: perSecond,
+			steps: []bucketStep{
+				{0, true, 0},
+				{time.Hour, true, 0},
+				{0, true, 0},
+				{0, true, 0},
+				{0, false, time.Second},
+			},
+		},
+		{
+			name:   "rejected takes keep refilling",
+			budget: rateBudget{burst: 2, period: time.Minute},
+			steps: []bucketStep{
+				{0, true, 0},
+				{0, true, 0},
+				{0, false, 30 * time.Second},
+				{15 * time.Second, false, 15 * time.Second},
+				{15 * time.Second, true, 0},
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			now := time.Unix(1700000000, 0)
+			b := newBucket(tt.budget, now)
+			for i, step := range tt.steps {
+				now = now.Add(step.after)
+				retryAfter, ok := b.take(tt.budget, now)
+				if ok != step.ok || retryAfter != step.retryAfter {
+					t.Errorf("take %d = %s, %t, want %s, %t", i, retryAfter, ok, step.retryAfter, step.ok)
+				}
+			}
+		})
+	}
+}
+
+func TestTokenBucketFull(t *testing.T) {
+	budget := rateBudget{burst: 2, period: time.Minute}
+	now := time.Unix(1700000000, 0)
+	b := newBucket(budget, now)
+	if !b.full(budget, now) {
+		t.Error("new bucket is not full")
+	}
+	b.take(budget, now)
+	b.take(budget, now)
+	if b.full(budget, now.Add(59*time.Second)) {
+		t.Error("bucket full before a period passed")
+	}
+	if !b.full(budget, now.Add(time.Minute)) {
+		t.Error("bucket not full after a period")
+	}
+}
+
+// withLimits limits kind to 2 commands a minute per connection and 3 per
+// IP, closing connections after 2 strikes. Other kinds are unlimited.
+func withLimits(kind string) testServerOption {
+	return func(dbs *dbServer) {
+		dbs.rateLimits = rateLimitConfig{
+			perConnection: map[string]rateBudget{kind: {burst: 2, period: time.Minute}},
+			perIP:         map[string]rateBudget{kind: {burst: 3, period: time.Minute}},
+			strikes:       2,
+		}
+	}
+}
+
+func TestCharge(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	dbs := newTestServer(t, withLimits(commandVault), withClock(&now))
+	a := newCommandLimiter("10.0.0.1")
+	b := newCommandLimiter("10.0.0.1")
+
+	steps := []struct {
+		name       string
+		l          *commandLimiter
+		after      time.Duration
+		limited    bool
+		retryAfter time.Duration
+		abusive    bool
+	}{
+		{"first", a, 0, false, 0, false},
+		{"second", a, 0, false, 0, false},
+		{"over the connection budget", a, 0, true, 30 * time.Second, false},
+		{"other connection", b, 0, false, 0, false},
+		{"over the IP budget", b, 0, true, 20 * time.Second, false},
+		{"second strike", a, 0, true, 30 * time.Second, true},
+		{"refilled", a, 30 * time.Second, false, 0, false},
+		{"strikes reset", a, 0, true, 30 * time.Second, false},
+	}
+	for _, step := range steps {
+		now = now.Add(step.after)
+		err := dbs.charge(step.l, commandVault)
+		if (err != nil) != step.limited {
+			t.Fatalf("%s: charge = %v, want limited %t", step.name, err, step.limited)
+		}
+		if err == nil {
+			continue
+		}
+		if err.retryAfter != step.retryAfter || err.abusive != step.abusive {
+			t.Errorf("%s: retry after %s, abusive %t, want %s, %t", step.name, err.retryAfter, err.abusive, step.retryAfter, step.abusive)
+		}
+	}
+
+	// Kinds without a budget are not limited.
+	for i := 0; i < 10; i++ {
+		if err := dbs.charge(a, commandHome); err != nil {
+			t.Fatalf("unlimited command %d rejected: %v", i, err)
+		}
+	}
+}
+
+func TestIPLimiterExpireFull(t *testing.T) {
+	budgets := map[string]rateBudget{commandVault: {burst: 2, period: time.Minute}}
+	now := time.Unix(1700000000, 0)
+	il := &ipLimiter{buckets: make(map[string]map[string]*tokenBucket)}
+	il.take("10.0.0.1", commandVault, budgets[commandVault], now)
+	il.take("10.0.0.2", commandVault, budgets[commandVault], now.Add(time.Minute))
+	il.take("10.0.0.2", commandVault, budgets[commandVault], now.Add(time.Minute))
+
+	il.expireFull(budgets, now.Add(90*time.Second))
+	if _, ok := il.buckets["10.0.0.1"]; ok {
+		t.Error("refilled bucket was kept")
+	}
+	if _, ok := il.buckets["10.0.0.2"]; !ok {
+		t.Error("bucket still refilling was expired")
+	}
+}
+
+func TestAllowIPRetryAfter(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	dbs := newTestServer(t, withClock(&now), func(dbs *dbServer) {
+		dbs.rateLimits.perIP[commandREST] = rateBudget{burst: 1, period: 1500 * time.Millisecond}
+	})
+	r := httptest.NewRequest(http.MethodGet, "/v1/vaults", nil)
+	if !dbs.allowIP(httptest.NewRecorder(), r, commandREST) {
+		t.Fatal("first request rejected")
+	}
+	rec := httptest.NewRecorder()
+	if dbs.allowIP(rec, r, commandREST) {
+		t.Fatal("request over budget allowed")
+	}
+	if rec.Code != http.StatusTooManyRequests || rec.Header().Get("Retry-After") != "2" {
+		t.Errorf("status %d, Retry-After %q, want 429 and 2", rec.Code, rec.Header().Get("Retry-After"))
+	}
+}
@@ -0,0 +1,191 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"pitchlake-backend/models"
+	"strconv"
+)
+
+// notificationReference is sent by triggers in reference mode, for rows too
+// large for the 8000 byte NOTIFY limit. It only names the row; the listener
+// fetches the row itself before broadcasting.
+//
+//	{"operation": "UPDATE", "table": "Option_Buyers", "key": {"address": "0x1", "round_address": "0x2"}}
+type notificationReference struct {
+	Operation string         `json:"operation"`
+	Table     string         `json:"table"`
+	Key       map[string]any `json:"key"`
+}
+
+// parseReference reports whether payload is a reference notification.
+// Inline payloads never carry a table name, so they fall through untouched.
+func parseReference(payload string) (*notificationReference, bool) {
+	var ref notificationReference
+	dec := json.NewDecoder(bytes.NewReader([]byte(payload)))
+	dec.UseNumber()
+	if err := dec.Decode(&ref); err != nil || ref.Table == "" || ref.Key == nil {
+		return nil, false
+	}
+	return &ref, true
+}
+
+// key returns a primary key column of the referenced row as a string.
+func (ref *notificationReference) key(column string) (string, error) {
+	value, ok := ref.Key[column]
+	if !ok {
+		return "", fmt.Errorf("reference to %s is missing key %s", ref.Table, column)
+	}
+	return fmt.Sprint(value), nil
+}
+
+// fetchReference loads the row named by ref through the db package.
+func (dbs *dbServer) fetchReference(ref *notificationReference) (models.AllowedPayload, error) {
+	switch ref.Table {
+	case "VaultStates":
+		address, err := ref.key("address")
+		if err != nil {
+			return nil, err
+		}
+		return dbs.db.GetVaultStateByID(address)
+	case "Option_Rounds":
+		address, err := ref.key("address")
+		if err != nil {
+			return nil, err
+		}
+		return dbs.db.GetOptionRoundByAddress(address)
+	case "Liquidity_Providers":
+		address, err := ref.key("address")
+		if err != nil {
+			return nil, err
+		}
+		vaultAddress, err := ref.key("vault_address")
+		if err != nil {
+			return nil, err
+		}
+		return dbs.db.GetLiquidityProviderStateByAddress(address, vaultAddress)
+	case "Option_Buyers":
+		address, err := ref.key("address")
+		if err != nil {
+			return nil, err
+		}
+		roundAddress, err := ref.key("round_address")
+		if err != nil {
+			return nil, err
+		}
+		return dbs.db.GetOptionBuyer(address, roundAddress)
+	case "Queued_Liquidity":
+		address, err := ref.key("address")
+		if err != nil {
+			return nil, err
+		}
+		roundAddress, err := ref.key("round_address")
+		if err != nil {
+			return nil, err
+		}
+		return dbs.db.GetQueuedLiquidity(address, roundAddress)
+	case "Bids":
+		roundAddress, err := ref.key("round_address")
+		if err != nil {
+			return nil, err
+		}
+		bidID, err := ref.key("bid_id")
+		if err != nil {
+			return nil, err
+		}
+		return dbs.db.GetBid(roundAddress, bidID)
+	case "twap_state":
+		windowType, err := ref.key("window_type")
+		if err != nil {
+			return nil, err
+		}
+		isConfirmed, err := ref.key("is_confirmed")
+		if err != nil {
+			return nil, err
+		}
+		confirmed, err := strconv.ParseBool(isConfirmed)
+		if err != nil {
+			return nil, fmt.Errorf("invalid is_confirmed %q: %w", isConfirmed, err)
+		}
+		return dbs.db.GetTwapState(models.TwapWindowType(windowType), confirmed)
+	case "blocks":
+		value, err := ref.key("block_number")
+		if err != nil {
+			return nil, err
+		}
+		blockNumber, err := strconv.ParseUint(value, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid block_number %q: %w", value, err)
+		}
+		return dbs.db.GetBlockByNumber(blockNumber)
+	default:
+		return nil, fmt.Errorf("unknown reference table %q", ref.Table)
+	}
+}
+
+// resolveReference fetches the row named by ref and checks that it has the
+// type expected on the channel.
+func resolveReference[T models.AllowedPayload](dbs *dbServer, ref *notificationReference) (T, error) {
+	var row T
+	fetched, err := dbs.fetchReference(ref)
+	if err != nil {
+		return row, fmt.Errorf("error fetching %s row: %w", ref.Table, err)
+	}
+	typed, ok := any(fetched).(*T)
+	if !ok {
+		return row, fmt.Errorf("reference to %s does not match payload type %T", ref.Table, row)
+	}
+	return *typed, nil
+}
+
+// referenceKeyRow decodes the key of a reference as a partial row of the
+// channel's payload type.
+func referenceKeyRow[T AllowedPayload](ref *notificationReference) (T, error) {
+	var row T
+	encoded, err := json.Marshal(ref.Key)
+	if err != nil {
+		return row, err
+	}
+	if err := json.Unmarshal(encoded, &row); err != nil {
+		return row, fmt.Errorf("error decoding %s key: %w", ref.Table, err)
+	}
+	return row, nil
+}
+
+// decodeVaultNotification decodes an inline or reference notification for
+// the vault channels.
+func decodeVaultNotification[T AllowedPayload](dbs *dbServer, payload string) (NotificationPayloadVault[T], error) {
+	var updatedData NotificationPayloadVault[T]
+	if ref, ok := parseReference(payload); ok {
+		if ref.Operation == "DELETE" {
+			// The row is gone, so the key columns are all there is to send.
+			row, err := referenceKeyRow[T](ref)
+			if err != nil {
+				return updatedData, err
+			}
+			updatedData.Operation = ref.Operation
+			updatedData.Payload = row
+			return updatedData, nil
+		}
+		row, err := resolveReference[T](dbs, ref)
+		if err != nil {
+			return updatedData, err
+		}
+		updatedData.Operation = ref.Operation
+		updatedData.Payload = row
+		return updatedData, nil
+	}
+	err := json.Unmarshal([]byte(payload), &updatedData)
+	return updatedData, err
+}
+
+// decodeBlock decodes an inline or reference block notification.
+func decodeBlock(dbs *dbServer, payload string) (models.Block, error) {
+	if ref, ok := parseReference(payload); ok {
+		return resolveReference[models.Block](dbs, ref)
+	}
+	var block models.Block
+	err := json.Unmarshal([]byte(payload), &block)
+	return block, err
+}
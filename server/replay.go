@@ -0,0 +1,129 @@
+package server
+
+import (
+	"log"
+	"os"
+	"strconv"
+	"time"
+)
+
+// replayBuffer keeps the latest updates published on a topic so that a
+// reconnecting /ws client can resume from the last seq it received.
+type replayBuffer struct {
+	capacity int
+	// entries are ordered by seq, which is consecutive.
+	entries  []replayEntry
+	lastUsed time.Time
+}
+
+type replayEntry struct {
+	seq uint64
+	key string
+	msg []byte
+}
+
+// replayConfig bounds the replay buffers: size updates per topic, dropped
+// once a topic has been idle for ttl.
+type replayConfig struct {
+	size int
+	ttl  time.Duration
+}
+
+func replayConfigFromEnv() replayConfig {
+	config := replayConfig{size: 256, ttl: 10 * time.Minute}
+	if value := os.Getenv("REPLAY_BUFFER_SIZE"); value != "" {
+		n, err := strconv.Atoi(value)
+		if err != nil || n < 0 {
+			log.Printf("Invalid REPLAY_BUFFER_SIZE %q, using %d", value, config.size)
+		} else {
+			config.size = n
+		}
+	}
+	if value := os.Getenv("REPLAY_BUFFER_TTL"); value != "" {
+		d, err := time.ParseDuration(value)
+		if err != nil || d <= 0 {
+			log.Printf("Invalid REPLAY_BUFFER_TTL %q, using %s", value, config.ttl)
+		} else {
+			config.ttl = d
+		}
+	}
+	return config
+}
+
+func (b *replayBuffer) add(seq uint64, key string, msg []byte, now time.Time) {
+	if len(b.entries) == b.capacity {
+		b.entries = append(b.entries[:0], b.entries[1:]...)
+	}
+	b.entries = append(b.entries, replayEntry{seq: seq, key: key, msg: msg})
+	b.lastUsed = now
+}
+
+// since returns the updates after seq, up to current, and whether the
+// buffer still holds all of them.
+func (b *replayBuffer) since(seq, current uint64) ([]replayEntry, bool) {
+	if seq == current {
+		return nil, true
+	}
+	if len(b.entries) == 0 || seq > current || b.entries[0].seq > seq+1 {
+		return nil, false
+	}
+	for i, entry := range b.entries {
+		if entry.seq > seq {
+			return append([]replayEntry(nil), b.entries[i:]...), true
+		}
+	}
+	return nil, false
+}
+
+// record adds an update to the replay buffer of topic. dbs.topicsMu must be
+// held.
+func (dbs *dbServer) record(topic string, seq uint64, key string, msg []byte) {
+	if dbs.replayConfig.size == 0 {
+		return
+	}
+	b, ok := dbs.replay[topic]
+	if !ok {
+		b = &replayBuffer{capacity: dbs.replayConfig.size}
+		dbs.replay[topic] = b
+	}
+	b.add(seq, key, msg, dbs.now())
+}
+
+// replaySince returns the updates of topic after seq, up to the current seq,
+// and whether they could all be replayed. dbs.topicsMu must be held.
+func (dbs *dbServer) replaySince(topic string, seq uint64) ([]replayEntry, bool) {
+	current := dbs.topicSeq[topic]
+	b, ok := dbs.replay[topic]
+	if !ok {
+		return nil, seq == current
+	}
+	b.lastUsed = dbs.now()
+	return b.since(seq, current)
+}
+
+// expireReplayBuffers drops the buffers of topics that have been idle for
+// the configured ttl and have no subscribers, until ctx is done.
+func (dbs *dbServer) expireReplayBuffers() {
+	ticker := time.NewTicker(time.Minute)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-dbs.ctx.Done():
+			return
+		case now := <-ticker.C:
+			dbs.expireReplay(now)
+		}
+	}
+}
+
+// expireReplay drops the buffers of topics without subscribers that have
+// been idle for longer than the ttl at now.
+func (dbs *dbServer) expireReplay(now time.Time) {
+	dbs.topicsMu.Lock()
+	defer dbs.topicsMu.Unlock()
+	for topic, b := range dbs.replay {
+		if len(dbs.topicSubscribers[topic]) == 0 && now.Sub(b.lastUsed) > dbs.replayConfig.ttl {
+			delete(dbs.replay, topic)
+		}
+	}
+}
@@ -0,0 +1,171 @@
+package server
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+// withReplay sets the size and ttl of the replay buffers.
+func withReplay(size int, ttl time.Duration) testServerOption {
+	return func(dbs *dbServer) {
+		dbs.replayConfig = replayConfig{size: size, ttl: ttl}
+	}
+}
+
+func seqs(entries []replayEntry) []uint64 {
+	var seqs []uint64
+	for _, entry := range entries {
+		seqs = append(seqs, entry.seq)
+	}
+	return seqs
+}
+
+func TestReplayBufferSince(t *testing.T) {
+	// A buffer of 4 that has seen updates 1 to 6 holds 3 to 6.
+	b := &replayBuffer{capacity: 4}
+	for seq := uint64(1); seq <= 6; seq++ {
+		b.add(seq, "", nil, time.Time{})
+	}
+	tests := []struct {
+		name    string
+		seq     uint64
+		current uint64
+		want    []uint64
+		ok      bool
+	}{
+		{"up to date", 6, 6, nil, true},
+		{"missed the last two", 4, 6, []uint64{5, 6}, true},
+		{"missed every buffered update", 2, 6, []uint64{3, 4, 5, 6}, true},
+		{"gap before the buffer", 1, 6, nil, false},
+		{"from the start of the epoch", 0, 6, nil, false},
+		{"ahead of the topic", 7, 6, nil, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			entries, ok := b.since(tt.seq, tt.current)
+			if ok != tt.ok || !reflect.DeepEqual(seqs(entries), tt.want) {
+				t.Errorf("since(%d, %d) = %v, %t, want %v, %t", tt.seq, tt.current, seqs(entries), ok, tt.want, tt.ok)
+			}
+		})
+	}
+
+	if entries, ok := (&replayBuffer{capacity: 4}).since(0, 2); ok || entries != nil {
+		t.Errorf("empty buffer since(0, 2) = %v, %t, want nothing", seqs(entries), ok)
+	}
+}
+
+func TestReplayBufferSinceCopies(t *testing.T) {
+	b := &replayBuffer{capacity: 2}
+	b.add(1, "", nil, time.Time{})
+	b.add(2, "", nil, time.Time{})
+	entries, _ := b.since(0, 2)
+	// Evicting shifts the buffer in place; replayed entries must not move
+	// with it.
+	b.add(3, "", nil, time.Time{})
+	if got := seqs(entries); !reflect.DeepEqual(got, []uint64{1, 2}) {
+		t.Errorf("replayed %v after eviction, want [1 2]", got)
+	}
+}
+
+func TestReplaySince(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	dbs := newTestServer(t, withReplay(4, time.Minute), withClock(&now))
+	if _, ok := dbs.replaySince("vault:0x1", 0); !ok {
+		t.Error("replaySince on a quiet topic failed")
+	}
+
+	for seq := uint64(1); seq <= 3; seq++ {
+		dbs.topicSeq["vault:0x1"] = seq
+		dbs.record("vault:0x1", seq, "", nil)
+	}
+	if entries, ok := dbs.replaySince("vault:0x1", 1); !ok || !reflect.DeepEqual(seqs(entries), []uint64{2, 3}) {
+		t.Errorf("replaySince(1) = %v, %t, want [2 3]", seqs(entries), ok)
+	}
+
+	// Without a buffer only a client that is up to date can resume.
+	dbs.topicSeq["gas:960"] = 5
+	if _, ok := dbs.replaySince("gas:960", 4); ok {
+		t.Error("replaySince without a buffer resumed a client that missed updates")
+	}
+	if _, ok := dbs.replaySince("gas:960", 5); !ok {
+		t.Error("replaySince without a buffer refused an up to date client")
+	}
+}
+
+func TestReplayDisabled(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	dbs := newTestServer(t, withReplay(0, time.Minute), withClock(&now))
+	dbs.topicSeq["home"] = 1
+	dbs.record("home", 1, "", nil)
+	if len(dbs.replay) != 0 {
+		t.Fatal("record buffered an update with REPLAY_BUFFER_SIZE=0")
+	}
+	if _, ok := dbs.replaySince("home", 0); ok {
+		t.Error("resumed with replay disabled")
+	}
+}
+
+func TestSubscribeTopicResume(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	dbs := newTestServer(t, withReplay(4, time.Minute), withClock(&now))
+	for seq := uint64(1); seq <= 3; seq++ {
+		dbs.topicSeq["vault:0x1"] = seq
+		dbs.record("vault:0x1", seq, "", nil)
+	}
+	tests := []struct {
+		name    string
+		resume  *wsResume
+		resumed bool
+		replay  []uint64
+	}{
+		{"without resume", nil, false, nil},
+		{"same epoch", &wsResume{Epoch: dbs.epoch, Seq: 1}, true, []uint64{2, 3}},
+		{"previous epoch", &wsResume{Epoch: "old", Seq: 1}, false, nil},
+		{"same epoch past the buffer", &wsResume{Epoch: dbs.epoch, Seq: 5}, false, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := &wsClient{topics: make(map[string]struct{}), pending: make(map[string][]outboxMessage)}
+			sub, ok := dbs.subscribeTopic(c, "vault:0x1", tt.resume)
+			if !ok {
+				t.Fatal("subscribeTopic failed")
+			}
+			defer dbs.unsubscribeTopic(c, "vault:0x1")
+			if sub.seq != 3 {
+				t.Errorf("seq = %d, want 3", sub.seq)
+			}
+			if sub.resumed != tt.resumed || !reflect.DeepEqual(seqs(sub.replay), tt.replay) {
+				t.Errorf("resumed %t with %v, want %t with %v", sub.resumed, seqs(sub.replay), tt.resumed, tt.replay)
+			}
+		})
+	}
+}
+
+func TestExpireReplay(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	dbs := newTestServer(t, withReplay(4, 10*time.Minute), withClock(&now))
+	dbs.record("vault:0x1", 1, "", nil)
+	dbs.record("vault:0x2", 1, "", nil)
+	dbs.record("vault:0x3", 1, "", nil)
+	dbs.topicSubscribers["vault:0x3"] = map[*wsClient]struct{}{{}: {}}
+
+	// Resuming counts as use.
+	now = now.Add(5 * time.Minute)
+	dbs.replaySince("vault:0x2", 0)
+
+	dbs.expireReplay(now.Add(5 * time.Minute))
+	if len(dbs.replay) != 3 {
+		t.Fatalf("expired %d buffers at the ttl, want none", 3-len(dbs.replay))
+	}
+	dbs.expireReplay(now.Add(5*time.Minute + time.Second))
+	if _, ok := dbs.replay["vault:0x1"]; ok {
+		t.Error("idle buffer was kept past the ttl")
+	}
+	if _, ok := dbs.replay["vault:0x2"]; !ok {
+		t.Error("buffer used by a resume was expired")
+	}
+	if _, ok := dbs.replay["vault:0x3"]; !ok {
+		t.Error("buffer of a followed topic was expired")
+	}
+}
@@ -0,0 +1,330 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"time"
+
+	"github.com/jackc/pglogrepl"
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/jackc/pgx/v5/pgproto3"
+	"github.com/jackc/pgx/v5/pgtype"
+)
+
+// Change sources selectable with CDC_SOURCE.
+const (
+	cdcSourceListen      = "listen"
+	cdcSourceReplication = "replication"
+)
+
+const standbyStatusInterval = 10 * time.Second
+
+// replicationTables maps the replicated tables to the channel whose handler
+// processes their rows. blocks are routed by replicatedBlock instead.
+var replicationTables = map[string]string{
+	"VaultStates":         "vault_update",
+	"Option_Rounds":       "or_update",
+	"Liquidity_Providers": "lp_update",
+	"Option_Buyers":       "ob_update",
+	"Bids":                "bids_update",
+	"Queued_Liquidity":    "ql_update",
+	"twap_state":          "twap_update",
+}
+
+// replicationRenames maps column names to the JSON keys used by the trigger
+// payloads where the two differ.
+var replicationRenames = map[string]map[string]string{
+	"Bids": {"buyer_address": "address"},
+}
+
+// replicationConfig names the slot and publication consumed by replicate.
+// Both are created on first use, and tables missing from the publication
+// are added to it.
+type replicationConfig struct {
+	slot        string
+	publication string
+}
+
+func replicationConfigFromEnv() replicationConfig {
+	config := replicationConfig{
+		slot:        os.Getenv("REPLICATION_SLOT"),
+		publication: os.Getenv("REPLICATION_PUBLICATION"),
+	}
+	if config.slot == "" {
+		config.slot = "pitchlake_db_server"
+	}
+	if config.publication == "" {
+		config.publication = "pitchlake_db_server"
+	}
+	return config
+}
+
+// replicatedChange is a row change decoded from the WAL, ready to be handed
+// to the channel handlers.
+type replicatedChange struct {
+	channel string
+	payload string
+}
+
+// replicationTx accumulates the changes of the transaction being decoded.
+// Changes are only dispatched once the transaction commits.
+type replicationTx struct {
+	changes []replicatedChange
+	// confirmedFrom and confirmedTo span the timestamps of blocks confirmed
+	// in the transaction.
+	confirmedFrom, confirmedTo uint64
+}
+
+// replicate consumes the logical replication slot with the pgoutput plugin
+// and feeds every committed change to the same dispatch used by listen.
+// Progress is acknowledged to the server only after a transaction has been
+// dispatched, so a reconnect resumes from the first undelivered change.
+func (dbs *dbServer) replicate(ctx context.Context) (connected bool, err error) {
+	tables := []string{"blocks"}
+	for table := range replicationTables {
+		tables = append(tables, table)
+	}
+	sort.Strings(tables)
+	if err := dbs.db.EnsurePublication(ctx, dbs.replication.publication, tables); err != nil {
+		return false, err
+	}
+	conn, err := dbs.db.ConnectReplication(ctx)
+	if err != nil {
+		return false, err
+	}
+	defer conn.Close(context.Background())
+
+	_, err = pglogrepl.CreateReplicationSlot(ctx, conn, dbs.replication.slot, "pgoutput", pglogrepl.CreateReplicationSlotOptions{})
+	var pgErr *pgconn.PgError
+	if err != nil && !(errors.As(err, &pgErr) && pgErr.Code == "42710") {
+		return false, fmt.Errorf("creating replication slot %s: %w", dbs.replication.slot, err)
+	}
+	err = pglogrepl.StartReplication(ctx, conn, dbs.replication.slot, 0, pglogrepl.StartReplicationOptions{
+		PluginArgs: []string{
+			"proto_version '1'",
+			fmt.Sprintf("publication_names '%s'", dbs.replication.publication),
+		},
+	})
+	if err != nil {
+		return false, fmt.Errorf("starting replication: %w", err)
+	}
+	dbs.setListenerState(listenerConnected, nil)
+	log.Printf("Streaming changes from slot %s", dbs.replication.slot)
+
+	var (
+		processed  pglogrepl.LSN
+		inTx       bool
+		tx         replicationTx
+		relations  = make(map[uint32]*pglogrepl.RelationMessage)
+		nextStatus = time.Now().Add(standbyStatusInterval)
+	)
+	for {
+		if time.Now().After(nextStatus) {
+			err := pglogrepl.SendStandbyStatusUpdate(ctx, conn, pglogrepl.StandbyStatusUpdate{WALWritePosition: processed})
+			if err != nil {
+				return true, fmt.Errorf("sending standby status: %w", err)
+			}
+			nextStatus = time.Now().Add(standbyStatusInterval)
+		}
+
+		receiveCtx, cancel := context.WithDeadline(ctx, nextStatus)
+		rawMsg, err := conn.ReceiveMessage(receiveCtx)
+		cancel()
+		if err != nil {
+			if pgconn.Timeout(err) && ctx.Err() == nil {
+				continue
+			}
+			return true, err
+		}
+		if errMsg, ok := rawMsg.(*pgproto3.ErrorResponse); ok {
+			return true, fmt.Errorf("replication error: %s", errMsg.Message)
+		}
+		msg, ok := rawMsg.(*pgproto3.CopyData)
+		if !ok || len(msg.Data) == 0 {
+			continue
+		}
+
+		switch msg.Data[0] {
+		case pglogrepl.PrimaryKeepaliveMessageByteID:
+			pkm, err := pglogrepl.ParsePrimaryKeepaliveMessage(msg.Data[1:])
+			if err != nil {
+				return true, err
+			}
+			// Nothing is pending outside a transaction, so the whole WAL up
+			// to the server's position can be released.
+			if !inTx && pkm.ServerWALEnd > processed {
+				processed = pkm.ServerWALEnd
+			}
+			if pkm.ReplyRequested {
+				nextStatus = time.Time{}
+			}
+		case pglogrepl.XLogDataByteID:
+			xld, err := pglogrepl.ParseXLogData(msg.Data[1:])
+			if err != nil {
+				return true, err
+			}
+			logical, err := pglogrepl.Parse(xld.WALData)
+			if err != nil {
+				return true, fmt.Errorf("parsing WAL message: %w", err)
+			}
+			switch m := logical.(type) {
+			case *pglogrepl.RelationMessage:
+				relations[m.RelationID] = m
+			case *pglogrepl.BeginMessage:
+				inTx = true
+				tx = replicationTx{}
+			case *pglogrepl.InsertMessage:
+				tx.add(relations[m.RelationID], "INSERT", m.Tuple)
+			case *pglogrepl.UpdateMessage:
+				tx.add(relations[m.RelationID], "UPDATE", m.NewTuple)
+			case *pglogrepl.DeleteMessage:
+				tx.add(relations[m.RelationID], "DELETE", m.OldTuple)
+			case *pglogrepl.CommitMessage:
+				dbs.markNotification()
+				for _, change := range tx.commit() {
+					if err := dbs.dispatch(change.channel, change.payload); err != nil {
+						dbs.quarantine(change.channel, change.payload, err)
+					}
+				}
+				processed = m.TransactionEndLSN
+				inTx = false
+			}
+		}
+	}
+}
+
+// add records a row change on a replicated table. Changes on tables that
+// are not replicated are ignored.
+func (tx *replicationTx) add(rel *pglogrepl.RelationMessage, operation string, tuple *pglogrepl.TupleData) {
+	if rel == nil || tuple == nil {
+		return
+	}
+	row := tupleRow(rel, tuple)
+
+	if rel.RelationName == "blocks" {
+		tx.addBlock(operation, row)
+		return
+	}
+	channel, ok := replicationTables[rel.RelationName]
+	if !ok {
+		return
+	}
+
+	var payload any
+	if rel.RelationName == "Option_Buyers" {
+		// Option buyers are broadcast with their bids, which are not part
+		// of the row, so let the handler fetch them.
+		payload = notificationReference{
+			Operation: operation,
+			Table:     rel.RelationName,
+			Key: map[string]any{
+				"address":       row["address"],
+				"round_address": row["round_address"],
+			},
+		}
+	} else {
+		payload = struct {
+			Operation string                     `json:"operation"`
+			Payload   map[string]json.RawMessage `json:"payload"`
+		}{operation, row}
+	}
+	encoded, err := json.Marshal(payload)
+	if err != nil {
+		log.Printf("Error encoding %s change: %v", rel.RelationName, err)
+		return
+	}
+	tx.changes = append(tx.changes, replicatedChange{channel: channel, payload: string(encoded)})
+}
+
+// addBlock turns block changes into the gas channel payloads. Unconfirmed
+// blocks are sent one by one, confirmed blocks are collapsed into a single
+// timestamp range per transaction.
+func (tx *replicationTx) addBlock(operation string, row map[string]json.RawMessage) {
+	if operation == "DELETE" {
+		return
+	}
+	var block struct {
+		Timestamp   uint64 `json:"timestamp"`
+		IsConfirmed bool   `json:"is_confirmed"`
+	}
+	encoded, err := json.Marshal(row)
+	if err == nil {
+		err = json.Unmarshal(encoded, &block)
+	}
+	if err != nil {
+		log.Printf("Error decoding block change: %v", err)
+		return
+	}
+	if !block.IsConfirmed {
+		tx.changes = append(tx.changes, replicatedChange{channel: "unconfirmed_insert", payload: string(encoded)})
+		return
+	}
+	if tx.confirmedFrom == 0 || block.Timestamp < tx.confirmedFrom {
+		tx.confirmedFrom = block.Timestamp
+	}
+	if block.Timestamp > tx.confirmedTo {
+		tx.confirmedTo = block.Timestamp
+	}
+}
+
+// commit returns the changes of the transaction in dispatch order.
+func (tx *replicationTx) commit() []replicatedChange {
+	changes := tx.changes
+	if tx.confirmedTo != 0 {
+		encoded, err := json.Marshal(confirmedUpdate{
+			StartTimestamp: tx.confirmedFrom,
+			EndTimestamp:   tx.confirmedTo,
+		})
+		if err == nil {
+			changes = append(changes, replicatedChange{channel: "confirmed_insert", payload: string(encoded)})
+		}
+	}
+	return changes
+}
+
+// tupleRow converts a pgoutput tuple into the JSON object a trigger would
+// have produced with row_to_json. Unchanged TOASTed columns are omitted.
+func tupleRow(rel *pglogrepl.RelationMessage, tuple *pglogrepl.TupleData) map[string]json.RawMessage {
+	row := make(map[string]json.RawMessage, len(tuple.Columns))
+	for i, col := range tuple.Columns {
+		if i >= len(rel.Columns) {
+			break
+		}
+		name := rel.Columns[i].Name
+		if renamed, ok := replicationRenames[rel.RelationName][name]; ok {
+			name = renamed
+		}
+		switch col.DataType {
+		case pglogrepl.TupleDataTypeNull:
+			row[name] = json.RawMessage("null")
+		case pglogrepl.TupleDataTypeText:
+			row[name] = textToJSON(rel.Columns[i].DataType, string(col.Data))
+		}
+	}
+	return row
+}
+
+// textToJSON encodes a column in pgoutput text format as JSON, keeping
+// numbers and booleans unquoted as row_to_json does.
+func textToJSON(oid uint32, text string) json.RawMessage {
+	switch oid {
+	case pgtype.BoolOID:
+		if text == "t" {
+			return json.RawMessage("true")
+		}
+		return json.RawMessage("false")
+	case pgtype.Int2OID, pgtype.Int4OID, pgtype.Int8OID, pgtype.NumericOID, pgtype.Float4OID, pgtype.Float8OID:
+		if json.Valid([]byte(text)) {
+			return json.RawMessage(text)
+		}
+	case pgtype.JSONOID, pgtype.JSONBOID:
+		return json.RawMessage(text)
+	}
+	encoded, _ := json.Marshal(text)
+	return encoded
+}
@@ -0,0 +1,151 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"pitchlake-backend/models"
+	"strconv"
+	"strings"
+)
+
+// The REST API serves the same records as the websockets, in the same
+// models shapes, for clients that only need to read them once. Account
+// scoped endpoints take the session token as "Authorization: Bearer".
+
+// restHandler serves a REST endpoint, returning the value to encode.
+type restHandler func(r *http.Request) (any, error)
+
+// rest wraps h with the per IP rate limit and the JSON encoding of its
+// result or error.
+func (dbs *dbServer) rest(h restHandler) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !dbs.allowIP(w, r, commandREST) {
+			return
+		}
+		result, err := h(r)
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(result)
+	}
+}
+
+// bearerToken returns the session token of r, if any.
+func bearerToken(r *http.Request) string {
+	token, _ := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	return token
+}
+
+// queryUint parses the required query parameter called name.
+func queryUint(r *http.Request, name string) (uint64, error) {
+	value := r.URL.Query().Get(name)
+	if value == "" {
+		return 0, invalidRequest("missing %s", name)
+	}
+	n, err := strconv.ParseUint(value, 10, 64)
+	if err != nil {
+		return 0, invalidRequest("invalid %s %q", name, value)
+	}
+	return n, nil
+}
+
+func (dbs *dbServer) restVaults(r *http.Request) (any, error) {
+	vaults, err := dbs.db.GetVaultSummaries()
+	if err != nil {
+		return nil, err
+	}
+	if vaults == nil {
+		vaults = []*models.VaultSummary{}
+	}
+	return vaults, nil
+}
+
+func (dbs *dbServer) restVault(r *http.Request) (any, error) {
+	address := r.PathValue("addr")
+	if err := requireAddress("vault address", address); err != nil {
+		return nil, err
+	}
+	vaultState, err := dbs.db.GetVaultStateByID(address)
+	if err != nil {
+		return nil, vaultNotFound(address, err)
+	}
+	return vaultState, nil
+}
+
+func (dbs *dbServer) restVaultRounds(r *http.Request) (any, error) {
+	address := r.PathValue("addr")
+	if err := requireAddress("vault address", address); err != nil {
+		return nil, err
+	}
+	// Tell an unknown vault from one without rounds.
+	if _, err := dbs.db.GetVaultStateByID(address); err != nil {
+		return nil, vaultNotFound(address, err)
+	}
+	optionRounds, err := dbs.db.GetOptionRoundsByVaultAddress(address)
+	if err != nil {
+		return nil, err
+	}
+	if optionRounds == nil {
+		optionRounds = []*models.OptionRound{}
+	}
+	return optionRounds, nil
+}
+
+func (dbs *dbServer) restRound(r *http.Request) (any, error) {
+	address := r.PathValue("addr")
+	if err := requireAddress("round address", address); err != nil {
+		return nil, err
+	}
+	return dbs.db.GetOptionRoundByAddress(address)
+}
+
+func (dbs *dbServer) restLiquidityProvider(r *http.Request) (any, error) {
+	address := r.PathValue("addr")
+	vaultAddress := r.URL.Query().Get("vault")
+	if err := requireAddress("address", address); err != nil {
+		return nil, err
+	}
+	if err := requireAddress("vault", vaultAddress); err != nil {
+		return nil, err
+	}
+	if err := dbs.authorizeAccount(bearerToken(r), address); err != nil {
+		return nil, err
+	}
+	return dbs.db.GetLiquidityProviderStateByAddress(address, vaultAddress)
+}
+
+func (dbs *dbServer) restOptionBuyer(r *http.Request) (any, error) {
+	address := r.PathValue("addr")
+	if err := requireAddress("address", address); err != nil {
+		return nil, err
+	}
+	if err := dbs.authorizeAccount(bearerToken(r), address); err != nil {
+		return nil, err
+	}
+	return dbs.db.GetOptionBuyerByAddress(address)
+}
+
+func (dbs *dbServer) restBlocks(r *http.Request) (any, error) {
+	from, err := queryUint(r, "from")
+	if err != nil {
+		return nil, err
+	}
+	to, err := queryUint(r, "to")
+	if err != nil {
+		return nil, err
+	}
+	roundDuration, err := queryUint(r, "roundDuration")
+	if err != nil {
+		return nil, err
+	}
+	if err := requireBlockRange(from, to, roundDuration); err != nil {
+		return nil, err
+	}
+	blocks, err := dbs.db.GetBlocks(from, to, roundDuration)
+	if err != nil {
+		return nil, err
+	}
+	return blockResponses(blocks, roundDuration), nil
+}
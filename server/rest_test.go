@@ -0,0 +1,32 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestRESTBlocksRejectsInvalidRanges(t *testing.T) {
+	dbs := newTestServer(t)
+	handler := dbs.rest(dbs.restBlocks)
+	for _, query := range []string{
+		"from=0&to=1921&roundDuration=960",
+		"from=0&to=18446744073709551615&roundDuration=2631600",
+		"from=10&to=0&roundDuration=960",
+		"from=0&to=10&roundDuration=5",
+		"from=0&to=10",
+		"from=x&to=10&roundDuration=960",
+	} {
+		rec := httptest.NewRecorder()
+		handler(rec, httptest.NewRequest(http.MethodGet, "/v1/blocks?"+query, nil))
+		if rec.Code != http.StatusBadRequest {
+			t.Errorf("%s: status = %d, want %d", query, rec.Code, http.StatusBadRequest)
+			continue
+		}
+		var frame ErrorFrame
+		if err := json.Unmarshal(rec.Body.Bytes(), &frame); err != nil || frame.Code != codeInvalidRequest {
+			t.Errorf("%s: body = %s, want an invalid_request frame", query, rec.Body)
+		}
+	}
+}
@@ -0,0 +1,223 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"log"
+	"pitchlake-backend/models"
+	"strings"
+)
+
+// vaultSnapshot holds the last vault and round states pushed to the
+// subscribers of a vault, marshalled so they can be compared cheaply.
+type vaultSnapshot struct {
+	vaultState   []byte
+	optionRounds map[string][]byte
+}
+
+// recordVaultState remembers the vault state last pushed to subscribers.
+// It reports whether the state differs from the previously recorded one.
+func (dbs *dbServer) recordVaultState(vaultState *models.VaultState) bool {
+	encoded, err := json.Marshal(vaultState)
+	if err != nil {
+		return true
+	}
+	dbs.snapshotsMu.Lock()
+	defer dbs.snapshotsMu.Unlock()
+	snapshot := dbs.snapshot(vaultState.Address)
+	changed := !bytes.Equal(snapshot.vaultState, encoded)
+	snapshot.vaultState = encoded
+	return changed
+}
+
+// recordOptionRound remembers the option round state last pushed to
+// subscribers. It reports whether the state differs from the previously
+// recorded one.
+func (dbs *dbServer) recordOptionRound(optionRound *models.OptionRound) bool {
+	encoded, err := json.Marshal(optionRound)
+	if err != nil {
+		return true
+	}
+	dbs.snapshotsMu.Lock()
+	defer dbs.snapshotsMu.Unlock()
+	snapshot := dbs.snapshot(optionRound.VaultAddress)
+	changed := !bytes.Equal(snapshot.optionRounds[optionRound.Address], encoded)
+	snapshot.optionRounds[optionRound.Address] = encoded
+	return changed
+}
+
+// forgetVault drops the snapshot of a deleted vault.
+func (dbs *dbServer) forgetVault(vaultAddress string) {
+	dbs.snapshotsMu.Lock()
+	defer dbs.snapshotsMu.Unlock()
+	delete(dbs.snapshots, vaultAddress)
+}
+
+// forgetOptionRound drops a deleted option round from its vault's snapshot.
+func (dbs *dbServer) forgetOptionRound(vaultAddress, roundAddress string) {
+	dbs.snapshotsMu.Lock()
+	defer dbs.snapshotsMu.Unlock()
+	if snapshot, ok := dbs.snapshots[vaultAddress]; ok {
+		delete(snapshot.optionRounds, roundAddress)
+	}
+}
+
+// staleOptionRounds returns the recorded rounds of a vault missing from
+// current and forgets them.
+func (dbs *dbServer) staleOptionRounds(vaultAddress string, current []*models.OptionRound) []*models.OptionRound {
+	present := make(map[string]bool, len(current))
+	for _, optionRound := range current {
+		present[optionRound.Address] = true
+	}
+	dbs.snapshotsMu.Lock()
+	defer dbs.snapshotsMu.Unlock()
+	snapshot, ok := dbs.snapshots[vaultAddress]
+	if !ok {
+		return nil
+	}
+	var stale []*models.OptionRound
+	for roundAddress := range snapshot.optionRounds {
+		if present[roundAddress] {
+			continue
+		}
+		stale = append(stale, &models.OptionRound{VaultAddress: vaultAddress, Address: roundAddress})
+		delete(snapshot.optionRounds, roundAddress)
+	}
+	return stale
+}
+
+// snapshot returns the snapshot for a vault, creating it if needed.
+// snapshotsMu must be held.
+func (dbs *dbServer) snapshot(vaultAddress string) *vaultSnapshot {
+	snapshot, ok := dbs.snapshots[vaultAddress]
+	if !ok {
+		snapshot = &vaultSnapshot{optionRounds: make(map[string][]byte)}
+		dbs.snapshots[vaultAddress] = snapshot
+	}
+	return snapshot
+}
+
+// resyncVaults is run after the listener reconnects. Notifications emitted
+// while it was disconnected are lost, so the current state of every
+// subscribed vault is re-queried and any difference from what was last
+// pushed is sent to the vault's subscribers as a regular update. Account
+// state is refreshed for every subscriber with an account_update payload,
+// and /ws clients are asked to resubscribe to every other topic.
+func (dbs *dbServer) resyncVaults() {
+	dbs.subscribersVaultMu.Lock()
+	vaults := make(map[string][]*subscriberVault, len(dbs.subscribersVault))
+	for vaultAddress, subscribers := range dbs.subscribersVault {
+		vaults[vaultAddress] = append([]*subscriberVault(nil), subscribers...)
+	}
+	dbs.subscribersVaultMu.Unlock()
+	for _, topic := range dbs.resyncTopics() {
+		if vaultAddress, ok := strings.CutPrefix(topic, topicVault+":"); ok {
+			if _, exists := vaults[vaultAddress]; !exists {
+				vaults[vaultAddress] = nil
+			}
+		}
+	}
+
+	log.Printf("Resynchronizing %d vaults after listener reconnect", len(vaults))
+	for vaultAddress, subscribers := range vaults {
+		var updates []outboundMessage
+
+		vaultState, err := dbs.db.GetVaultStateByID(vaultAddress)
+		if err != nil {
+			log.Printf("Error resyncing vault %s: %v", vaultAddress, err)
+			continue
+		}
+		if dbs.recordVaultState(vaultState) {
+			response, err := json.Marshal(NotificationPayloadVault[models.VaultState]{
+				Operation: "UPDATE",
+				Type:      "vaultState",
+				Payload:   *vaultState,
+			})
+			if err == nil {
+				updates = append(updates, outboundMessage{msgType: "vaultState", key: entityKey("vaultState", vaultAddress), msg: response})
+			}
+		}
+
+		optionRounds, err := dbs.db.GetOptionRoundsByVaultAddress(vaultAddress)
+		if err != nil {
+			log.Printf("Error resyncing rounds for vault %s: %v", vaultAddress, err)
+			continue
+		}
+		for _, optionRound := range optionRounds {
+			if !dbs.recordOptionRound(optionRound) {
+				continue
+			}
+			response, err := json.Marshal(NotificationPayloadVault[models.OptionRound]{
+				Operation: "UPDATE",
+				Type:      "optionRoundState",
+				Payload:   *optionRound,
+			})
+			if err == nil {
+				updates = append(updates, outboundMessage{msgType: "optionRoundState", roundAddress: optionRound.Address, key: entityKey("optionRound", vaultAddress, optionRound.Address), msg: response})
+			}
+		}
+		for _, optionRound := range dbs.staleOptionRounds(vaultAddress, optionRounds) {
+			key := entityKey("optionRound", vaultAddress, optionRound.Address)
+			response, err := marshalNotification(NotificationPayloadVault[models.OptionRound]{
+				Operation: "DELETE",
+				Type:      "optionRoundState",
+				Payload:   *optionRound,
+			}, key)
+			if err == nil {
+				updates = append(updates, outboundMessage{msgType: "removed", roundAddress: optionRound.Address, key: key, msg: response})
+			}
+		}
+
+		for _, update := range updates {
+			update.stream = streamVault
+			update.vaultAddress = vaultAddress
+			dbs.publish(update)
+		}
+		for _, s := range subscribers {
+			for _, update := range updates {
+				s.send(update.msgType, update.key, update.msg)
+			}
+			for _, w := range dbs.vaultWatches(s, vaultAddress) {
+				if w.address == "" {
+					continue
+				}
+				payload, err := dbs.accountPayload(w.address, w.vaultAddress)
+				if err != nil {
+					log.Printf("Error resyncing account %s: %v", w.address, err)
+					continue
+				}
+				s.send(wsTypeSnapshot, "account:"+w.vaultAddress+":"+w.address, payload)
+			}
+		}
+	}
+}
+
+// resyncTopics returns the topics followed by /ws clients and sends a
+// resync message on each one that is not a vault topic. The state of those
+// topics cannot be diffed, so clients resubscribe to get a fresh snapshot.
+// Replay buffers of topics that are not resynced no longer reflect every
+// change and are dropped.
+func (dbs *dbServer) resyncTopics() []string {
+	dbs.topicsMu.Lock()
+	defer dbs.topicsMu.Unlock()
+	for topic := range dbs.replay {
+		if !strings.HasPrefix(topic, topicVault+":") || len(dbs.topicSubscribers[topic]) == 0 {
+			delete(dbs.replay, topic)
+		}
+	}
+	topics := make([]string, 0, len(dbs.topicSubscribers))
+	for topic, clients := range dbs.topicSubscribers {
+		topics = append(topics, topic)
+		if strings.HasPrefix(topic, topicVault+":") {
+			continue
+		}
+		msg, err := newEnvelope(wsTypeResync, topic, 0, nil)
+		if err != nil {
+			continue
+		}
+		for c := range clients {
+			c.deliver(topic, "", msg)
+		}
+	}
+	return topics
+}
@@ -0,0 +1,477 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	"github.com/coder/websocket"
+)
+
+// JSON-RPC 2.0 error codes. Codes above -32099 are the server's own and
+// carry the matching ErrorFrame as data.
+const (
+	rpcParseError     = -32700
+	rpcInvalidRequest = -32600
+	rpcMethodNotFound = -32601
+	rpcInvalidParams  = -32602
+	rpcInternalError  = -32603
+	rpcNotFound       = -32001
+	rpcUnauthorized   = -32002
+	rpcRateLimited    = -32003
+)
+
+// maxRPCBatch bounds the calls of a batch, and rpcQueueSize the calls a
+// connection may have waiting.
+const (
+	maxRPCBatch  = 20
+	rpcQueueSize = 16
+)
+
+type rpcRequest struct {
+	JSONRPC string          `json:"jsonrpc"`
+	ID      json.RawMessage `json:"id,omitempty"`
+	Method  string          `json:"method"`
+	Params  json.RawMessage `json:"params,omitempty"`
+	// invalid is the validation error the request is answered with.
+	invalid *rpcError
+}
+
+// isNotification reports whether the request expects no response.
+func (r rpcRequest) isNotification() bool {
+	return len(r.ID) == 0
+}
+
+// rejected answers an invalid request. Its id is kept unless the id itself
+// is invalid.
+func (r rpcRequest) rejected() rpcResponse {
+	id := r.ID
+	if len(id) == 0 || id[0] == '{' || id[0] == '[' {
+		id = json.RawMessage("null")
+	}
+	return rpcResponse{JSONRPC: "2.0", Error: r.invalid, ID: id}
+}
+
+type rpcResponse struct {
+	JSONRPC string          `json:"jsonrpc"`
+	Result  json.RawMessage `json:"result,omitempty"`
+	Error   *rpcError       `json:"error,omitempty"`
+	ID      json.RawMessage `json:"id"`
+}
+
+type rpcError struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+	Data    any    `json:"data,omitempty"`
+}
+
+func (e *rpcError) Error() string {
+	return e.Message
+}
+
+// toRPCError maps err to a JSON-RPC error object.
+func toRPCError(err error) *rpcError {
+	var re *rpcError
+	if errors.As(err, &re) {
+		return re
+	}
+	frame := errorFrame(err)
+	code := rpcInternalError
+	switch frame.Code {
+	case codeInvalidRequest:
+		code = rpcInvalidParams
+	case codeVaultNotFound, codeNotFound:
+		code = rpcNotFound
+	case codeUnauthorized:
+		code = rpcUnauthorized
+	case codeRateLimited:
+		code = rpcRateLimited
+	}
+	return &rpcError{Code: code, Message: frame.Message, Data: frame}
+}
+
+// isRPC reports whether msg is a JSON-RPC request or batch rather than a
+// stream command.
+func isRPC(msg []byte) bool {
+	msg = bytes.TrimSpace(msg)
+	if len(msg) > 0 && msg[0] == '[' {
+		return true
+	}
+	var probe struct {
+		JSONRPC *string `json:"jsonrpc"`
+	}
+	return json.Unmarshal(msg, &probe) == nil && probe.JSONRPC != nil
+}
+
+// rpcCall is a request or batch waiting to be served with the session token
+// of its connection at the time it was received. Invalid requests stay in
+// place so that a batch is answered with a single array.
+type rpcCall struct {
+	requests []rpcRequest
+	batch    bool
+	token    string
+}
+
+// rpcConn serves the JSON-RPC requests of a connection. Requests are
+// answered in order by a single worker so that the read loop, and with it
+// pongs and stream commands, never waits on a query. Responses share the
+// connection's outbox with pushed updates.
+type rpcConn struct {
+	dbs     *dbServer
+	limiter *commandLimiter
+	send    func(msg []byte)
+	// abort closes the connection of a client that keeps exceeding its
+	// rate limit.
+	abort func()
+	calls chan rpcCall
+	// stop ends the worker once the connection is done.
+	stop context.CancelFunc
+}
+
+func (dbs *dbServer) newRPCConn(ctx context.Context, c *websocket.Conn, limiter *commandLimiter, send func(msg []byte)) *rpcConn {
+	ctx, stop := context.WithCancel(ctx)
+	rc := &rpcConn{
+		dbs:     dbs,
+		limiter: limiter,
+		send:    send,
+		abort: func() {
+			reject(c, websocket.StatusPolicyViolation, "rate limit exceeded")
+		},
+		calls: make(chan rpcCall, rpcQueueSize),
+		stop:  stop,
+	}
+	go rc.serve(ctx)
+	return rc
+}
+
+func (rc *rpcConn) serve(ctx context.Context) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case call := <-rc.calls:
+			rc.respond(rc.answer(call), call.batch)
+		}
+	}
+}
+
+// answer runs the valid requests of call and returns the responses owed,
+// in request order.
+func (rc *rpcConn) answer(call rpcCall) []rpcResponse {
+	var responses []rpcResponse
+	for _, request := range call.requests {
+		switch {
+		case request.invalid != nil:
+			responses = append(responses, request.rejected())
+		case request.isNotification():
+			rc.call(request, call.token)
+		default:
+			responses = append(responses, rc.call(request, call.token))
+		}
+	}
+	return responses
+}
+
+// handle parses msg and queues its requests. Malformed messages and calls
+// over the queue size are answered right away.
+func (rc *rpcConn) handle(msg []byte, token string) {
+	requests, batch, err := parseRPC(msg)
+	if err != nil {
+		rc.respond([]rpcResponse{{JSONRPC: "2.0", Error: err, ID: json.RawMessage("null")}}, false)
+		return
+	}
+	for i := range requests {
+		requests[i].invalid = requests[i].validate()
+	}
+	select {
+	case rc.calls <- rpcCall{requests: requests, batch: batch, token: token}:
+	default:
+		rc.respond(busyResponses(requests), batch)
+	}
+}
+
+// busyResponses answers requests that could not be queued.
+func busyResponses(requests []rpcRequest) []rpcResponse {
+	var responses []rpcResponse
+	for _, request := range requests {
+		switch {
+		case request.invalid != nil:
+			responses = append(responses, request.rejected())
+		case !request.isNotification():
+			responses = append(responses, rpcResponse{JSONRPC: "2.0", ID: request.ID, Error: &rpcError{
+				Code:    rpcRateLimited,
+				Message: "too many pending requests",
+				Data:    ErrorFrame{Code: codeRateLimited, Message: "too many pending requests"},
+			}})
+		}
+	}
+	return responses
+}
+
+func (rc *rpcConn) respond(responses []rpcResponse, batch bool) {
+	if len(responses) == 0 {
+		return
+	}
+	var msg []byte
+	var err error
+	if batch {
+		msg, err = json.Marshal(responses)
+	} else {
+		msg, err = json.Marshal(responses[0])
+	}
+	if err != nil {
+		rc.dbs.logf("Error marshalling rpc response: %v", err)
+		return
+	}
+	rc.send(msg)
+}
+
+// call runs one request against its method.
+func (rc *rpcConn) call(request rpcRequest, token string) rpcResponse {
+	response := rpcResponse{JSONRPC: "2.0", ID: request.ID}
+	if err := rc.dbs.charge(rc.limiter, commandRPC); err != nil {
+		if err.abusive {
+			rc.abort()
+		}
+		response.Error = toRPCError(err)
+		return response
+	}
+	method, ok := rpcMethods[request.Method]
+	if !ok {
+		response.Error = &rpcError{Code: rpcMethodNotFound, Message: fmt.Sprintf("method %q not found", request.Method)}
+		return response
+	}
+	result, err := method(rc.dbs, request.Params, token)
+	if err == nil {
+		response.Result, err = json.Marshal(result)
+	}
+	if err != nil {
+		response.Error = toRPCError(err)
+		response.Result = nil
+	}
+	return response
+}
+
+// parseRPC decodes a single request or a batch of them.
+func parseRPC(msg []byte) ([]rpcRequest, bool, *rpcError) {
+	msg = bytes.TrimSpace(msg)
+	if len(msg) > 0 && msg[0] == '[' {
+		var elements []json.RawMessage
+		if err := json.Unmarshal(msg, &elements); err != nil {
+			return nil, true, &rpcError{Code: rpcParseError, Message: "parse error"}
+		}
+		if len(elements) == 0 {
+			return nil, false, &rpcError{Code: rpcInvalidRequest, Message: "empty batch"}
+		}
+		if len(elements) > maxRPCBatch {
+			return nil, false, &rpcError{Code: rpcInvalidRequest, Message: fmt.Sprintf("batch of more than %d requests", maxRPCBatch)}
+		}
+		requests := make([]rpcRequest, len(elements))
+		for i, element := range elements {
+			// Elements that are not objects fail validation.
+			if json.Unmarshal(element, &requests[i]) != nil {
+				requests[i] = rpcRequest{}
+			}
+		}
+		return requests, true, nil
+	}
+	var request rpcRequest
+	if err := json.Unmarshal(msg, &request); err != nil {
+		return nil, false, &rpcError{Code: rpcParseError, Message: "parse error"}
+	}
+	return []rpcRequest{request}, false, nil
+}
+
+func (r rpcRequest) validate() *rpcError {
+	if r.JSONRPC != "2.0" || r.Method == "" {
+		return &rpcError{Code: rpcInvalidRequest, Message: "invalid request"}
+	}
+	if len(r.ID) > 0 && (r.ID[0] == '{' || r.ID[0] == '[') {
+		return &rpcError{Code: rpcInvalidRequest, Message: "invalid id"}
+	}
+	return nil
+}
+
+// rpcHandler runs a method with the raw params of its request and the
+// session token of the connection.
+type rpcHandler func(dbs *dbServer, params json.RawMessage, token string) (any, error)
+
+// rpcMethod decodes the params of a request into P before calling call.
+// Params may be given by name or by position, in the order of names.
+func rpcMethod[P any](names []string, call func(dbs *dbServer, p P, token string) (any, error)) rpcHandler {
+	return func(dbs *dbServer, params json.RawMessage, token string) (any, error) {
+		var p P
+		if err := decodeRPCParams(params, names, &p); err != nil {
+			return nil, err
+		}
+		return call(dbs, p, token)
+	}
+}
+
+func decodeRPCParams(params json.RawMessage, names []string, v any) error {
+	params = bytes.TrimSpace(params)
+	if len(params) == 0 || bytes.Equal(params, []byte("null")) {
+		params = []byte("{}")
+	}
+	if params[0] == '[' {
+		var positional []json.RawMessage
+		if err := json.Unmarshal(params, &positional); err != nil {
+			return &rpcError{Code: rpcInvalidParams, Message: fmt.Sprintf("invalid params: %v", err)}
+		}
+		if len(positional) > len(names) {
+			return &rpcError{Code: rpcInvalidParams, Message: fmt.Sprintf("expected at most %d params", len(names))}
+		}
+		named := make(map[string]json.RawMessage, len(positional))
+		for i, param := range positional {
+			named[names[i]] = param
+		}
+		params, _ = json.Marshal(named)
+	}
+	decoder := json.NewDecoder(bytes.NewReader(params))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(v); err != nil {
+		return &rpcError{Code: rpcInvalidParams, Message: fmt.Sprintf("invalid params: %v", err)}
+	}
+	return nil
+}
+
+type rpcAddressParams struct {
+	Address string `json:"address"`
+}
+
+type rpcVaultParams struct {
+	VaultAddress string `json:"vaultAddress"`
+}
+
+type rpcBlocksParams struct {
+	From          uint64 `json:"from"`
+	To            uint64 `json:"to"`
+	RoundDuration uint64 `json:"roundDuration"`
+}
+
+type rpcLiquidityProviderParams struct {
+	Address      string `json:"address"`
+	VaultAddress string `json:"vaultAddress"`
+}
+
+type rpcOptionBuyerParams struct {
+	Address      string `json:"address"`
+	RoundAddress string `json:"roundAddress"`
+}
+
+// requireAddress validates the address param called name.
+func requireAddress(name, address string) error {
+	if !validAddress(address, false) {
+		return invalidRequest("invalid %s %q", name, address)
+	}
+	return nil
+}
+
+// authorizeAccount checks that token grants access to the data of address.
+func (dbs *dbServer) authorizeAccount(token, address string) error {
+	if !dbs.auth.authorize(token, address) {
+		return unauthorized("no session token for %s", address)
+	}
+	return nil
+}
+
+// maxBlockRangeRounds bounds the span of a blocks query in rounds of its
+// roundDuration. GetBlocks samples blocks by round duration, so this keeps
+// the rows a query reads roughly constant whatever the duration.
+const maxBlockRangeRounds = 2
+
+// requireBlockRange validates the range and sampling of a blocks query.
+func requireBlockRange(from, to, roundDuration uint64) error {
+	if from > to {
+		return invalidRequest("from is after to")
+	}
+	if twapWindow(roundDuration) == "" {
+		return invalidRequest("unsupported roundDuration %d", roundDuration)
+	}
+	if to-from > maxBlockRangeRounds*roundDuration {
+		return invalidRequest("range of %ds is longer than %d rounds of %ds", to-from, maxBlockRangeRounds, roundDuration)
+	}
+	return nil
+}
+
+// rpcMethods are the queries served over JSON-RPC. Results have the same
+// shapes as the matching stream payloads. Account scoped methods require
+// the connection to be signed in as the account.
+var rpcMethods = map[string]rpcHandler{
+	"getVaults": rpcMethod(nil, func(dbs *dbServer, _ struct{}, _ string) (any, error) {
+		return dbs.db.GetVaultSummaries()
+	}),
+	"getVault": rpcMethod([]string{"address"}, func(dbs *dbServer, p rpcAddressParams, _ string) (any, error) {
+		if err := requireAddress("address", p.Address); err != nil {
+			return nil, err
+		}
+		vaultState, err := dbs.db.GetVaultStateByID(p.Address)
+		if err != nil {
+			return nil, vaultNotFound(p.Address, err)
+		}
+		return vaultState, nil
+	}),
+	"getOptionRounds": rpcMethod([]string{"vaultAddress"}, func(dbs *dbServer, p rpcVaultParams, _ string) (any, error) {
+		if err := requireAddress("vaultAddress", p.VaultAddress); err != nil {
+			return nil, err
+		}
+		return dbs.db.GetOptionRoundsByVaultAddress(p.VaultAddress)
+	}),
+	"getOptionRound": rpcMethod([]string{"address"}, func(dbs *dbServer, p rpcAddressParams, _ string) (any, error) {
+		if err := requireAddress("address", p.Address); err != nil {
+			return nil, err
+		}
+		return dbs.db.GetOptionRoundByAddress(p.Address)
+	}),
+	"getBlocks": rpcMethod([]string{"from", "to", "roundDuration"}, func(dbs *dbServer, p rpcBlocksParams, _ string) (any, error) {
+		if err := requireBlockRange(p.From, p.To, p.RoundDuration); err != nil {
+			return nil, err
+		}
+		blocks, err := dbs.db.GetBlocks(p.From, p.To, p.RoundDuration)
+		if err != nil {
+			return nil, err
+		}
+		return blockResponses(blocks, p.RoundDuration), nil
+	}),
+	"getLiquidityProvider": rpcMethod([]string{"address", "vaultAddress"}, func(dbs *dbServer, p rpcLiquidityProviderParams, token string) (any, error) {
+		if err := requireAddress("address", p.Address); err != nil {
+			return nil, err
+		}
+		if err := requireAddress("vaultAddress", p.VaultAddress); err != nil {
+			return nil, err
+		}
+		if err := dbs.authorizeAccount(token, p.Address); err != nil {
+			return nil, err
+		}
+		return dbs.db.GetLiquidityProviderStateByAddress(p.Address, p.VaultAddress)
+	}),
+	"getOptionBuyer": rpcMethod([]string{"address", "roundAddress"}, func(dbs *dbServer, p rpcOptionBuyerParams, token string) (any, error) {
+		if err := requireAddress("address", p.Address); err != nil {
+			return nil, err
+		}
+		if err := dbs.authorizeAccount(token, p.Address); err != nil {
+			return nil, err
+		}
+		if p.RoundAddress == "" {
+			return dbs.db.GetOptionBuyerByAddress(p.Address)
+		}
+		if err := requireAddress("roundAddress", p.RoundAddress); err != nil {
+			return nil, err
+		}
+		return dbs.db.GetOptionBuyer(p.Address, p.RoundAddress)
+	}),
+	"getBids": rpcMethod([]string{"address", "roundAddress"}, func(dbs *dbServer, p rpcOptionBuyerParams, token string) (any, error) {
+		if err := requireAddress("address", p.Address); err != nil {
+			return nil, err
+		}
+		if err := requireAddress("roundAddress", p.RoundAddress); err != nil {
+			return nil, err
+		}
+		if err := dbs.authorizeAccount(token, p.Address); err != nil {
+			return nil, err
+		}
+		return dbs.db.GetBidsByBuyer(p.Address, p.RoundAddress)
+	}),
+}
@@ -0,0 +1,248 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestGetBlocksRange(t *testing.T) {
+	tests := []struct {
+		params string
+		ok     bool
+	}{
+		{`{"from": 0, "to": 1920, "roundDuration": 960}`, true},
+		{`[0, 1921, 960]`, false},
+		{`{"from": 100, "to": 0, "roundDuration": 960}`, false},
+		{`{"from": 0, "to": 10, "roundDuration": 5}`, false},
+		{`{"from": 0, "to": 18446744073709551615, "roundDuration": 2631600}`, false},
+	}
+	for _, tt := range tests {
+		var p rpcBlocksParams
+		if err := decodeRPCParams(json.RawMessage(tt.params), []string{"from", "to", "roundDuration"}, &p); err != nil {
+			t.Fatalf("decode %s: %v", tt.params, err)
+		}
+		err := requireBlockRange(p.From, p.To, p.RoundDuration)
+		if (err == nil) != tt.ok {
+			t.Errorf("%s: error = %v, want ok %t", tt.params, err, tt.ok)
+		}
+		if err != nil {
+			if rpcErr := toRPCError(err); rpcErr.Code != rpcInvalidParams {
+				t.Errorf("%s: code = %d, want %d", tt.params, rpcErr.Code, rpcInvalidParams)
+			}
+		}
+	}
+}
+
+func TestParseRPC(t *testing.T) {
+	tests := []struct {
+		name    string
+		msg     string
+		methods []string
+		batch   bool
+		code    int
+	}{
+		{"single", `{"jsonrpc": "2.0", "id": 1, "method": "getVaults"}`, []string{"getVaults"}, false, 0},
+		{"leading space", ` [{"method": "a"}, {"method": "b"}]`, []string{"a", "b"}, true, 0},
+		{"batch of one", `[{"method": "a"}]`, []string{"a"}, true, 0},
+		{"element that is not an object", `[{"method": "a"}, 1]`, []string{"a", ""}, true, 0},
+		{"malformed single", `{"method": `, nil, false, rpcParseError},
+		{"malformed batch", `[{"method": "a"},`, nil, true, rpcParseError},
+		{"empty batch", `[]`, nil, false, rpcInvalidRequest},
+		{"batch too large", "[" + strings.Repeat(`{"method": "a"},`, maxRPCBatch) + `{"method": "a"}]`, nil, false, rpcInvalidRequest},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			requests, batch, err := parseRPC([]byte(tt.msg))
+			code := 0
+			if err != nil {
+				code = err.Code
+			}
+			var methods []string
+			for _, request := range requests {
+				methods = append(methods, request.Method)
+			}
+			if code != tt.code || batch != tt.batch || !reflect.DeepEqual(methods, tt.methods) {
+				t.Errorf("parseRPC = %v, batch %t, code %d, want %v, batch %t, code %d", methods, batch, code, tt.methods, tt.batch, tt.code)
+			}
+		})
+	}
+}
+
+func TestValidateRPC(t *testing.T) {
+	tests := []struct {
+		request string
+		valid   bool
+	}{
+		{`{"jsonrpc": "2.0", "id": 1, "method": "a"}`, true},
+		{`{"jsonrpc": "2.0", "id": "x", "method": "a"}`, true},
+		{`{"jsonrpc": "2.0", "id": null, "method": "a"}`, true},
+		{`{"jsonrpc": "2.0", "method": "a"}`, true},
+		{`{"id": 1, "method": "a"}`, false},
+		{`{"jsonrpc": "1.0", "id": 1, "method": "a"}`, false},
+		{`{"jsonrpc": "2.0", "id": 1}`, false},
+		{`{"jsonrpc": "2.0", "id": {}, "method": "a"}`, false},
+		{`{"jsonrpc": "2.0", "id": [1], "method": "a"}`, false},
+	}
+	for _, tt := range tests {
+		var request rpcRequest
+		if err := json.Unmarshal([]byte(tt.request), &request); err != nil {
+			t.Fatal(err)
+		}
+		err := request.validate()
+		if (err == nil) != tt.valid {
+			t.Errorf("validate(%s) = %v, want valid %t", tt.request, err, tt.valid)
+		}
+		if err != nil && err.Code != rpcInvalidRequest {
+			t.Errorf("validate(%s) code = %d, want %d", tt.request, err.Code, rpcInvalidRequest)
+		}
+	}
+}
+
+func TestDecodeRPCParams(t *testing.T) {
+	names := []string{"address", "vaultAddress"}
+	tests := []struct {
+		params string
+		want   rpcLiquidityProviderParams
+		ok     bool
+	}{
+		{`{"address": "0x1", "vaultAddress": "0x2"}`, rpcLiquidityProviderParams{"0x1", "0x2"}, true},
+		{`["0x1", "0x2"]`, rpcLiquidityProviderParams{"0x1", "0x2"}, true},
+		{`["0x1"]`, rpcLiquidityProviderParams{Address: "0x1"}, true},
+		{``, rpcLiquidityProviderParams{}, true},
+		{`null`, rpcLiquidityProviderParams{}, true},
+		{`["0x1", "0x2", "0x3"]`, rpcLiquidityProviderParams{}, false},
+		{`{"address": "0x1", "round": 1}`, rpcLiquidityProviderParams{}, false},
+		{`{"address": 1}`, rpcLiquidityProviderParams{}, false},
+		{`"0x1"`, rpcLiquidityProviderParams{}, false},
+	}
+	for _, tt := range tests {
+		var got rpcLiquidityProviderParams
+		err := decodeRPCParams(json.RawMessage(tt.params), names, &got)
+		if (err == nil) != tt.ok || (tt.ok && got != tt.want) {
+			t.Errorf("decodeRPCParams(%s) = %+v, %v, want %+v, ok %t", tt.params, got, err, tt.want, tt.ok)
+		}
+		if err != nil && toRPCError(err).Code != rpcInvalidParams {
+			t.Errorf("decodeRPCParams(%s) code = %d, want %d", tt.params, toRPCError(err).Code, rpcInvalidParams)
+		}
+	}
+}
+
+// summarize describes each response of msg as "<id>:<result or error code>",
+// in a list for batches.
+func summarize(t *testing.T, msg []byte) any {
+	t.Helper()
+	describe := func(r rpcResponse) string {
+		if r.Error != nil {
+			return fmt.Sprintf("%s:%d", r.ID, r.Error.Code)
+		}
+		return fmt.Sprintf("%s:%s", r.ID, r.Result)
+	}
+	if msg[0] == '[' {
+		var responses []rpcResponse
+		if err := json.Unmarshal(msg, &responses); err != nil {
+			t.Fatalf("decode %s: %v", msg, err)
+		}
+		summary := []string{}
+		for _, r := range responses {
+			summary = append(summary, describe(r))
+		}
+		return summary
+	}
+	var r rpcResponse
+	if err := json.Unmarshal(msg, &r); err != nil {
+		t.Fatalf("decode %s: %v", msg, err)
+	}
+	return describe(r)
+}
+
+func TestRPCResponses(t *testing.T) {
+	rpcMethods["echo"] = rpcMethod([]string{"value"}, func(_ *dbServer, p struct {
+		Value string `json:"value"`
+	}, _ string) (any, error) {
+		return p.Value, nil
+	})
+	t.Cleanup(func() { delete(rpcMethods, "echo") })
+
+	tests := []struct {
+		name string
+		msg  string
+		// full leaves no room in the queue.
+		full bool
+		want []any
+	}{
+		{
+			name: "single call",
+			msg:  `{"jsonrpc": "2.0", "id": 1, "method": "echo", "params": ["a"]}`,
+			want: []any{`1:"a"`},
+		},
+		{
+			name: "notification",
+			msg:  `{"jsonrpc": "2.0", "method": "echo", "params": ["a"]}`,
+		},
+		{
+			name: "batch of notifications",
+			msg:  `[{"jsonrpc": "2.0", "method": "echo"}, {"jsonrpc": "2.0", "method": "echo"}]`,
+		},
+		{
+			name: "invalid request without id",
+			msg:  `{"method": "echo"}`,
+			want: []any{"null:-32600"},
+		},
+		{
+			name: "parse error",
+			msg:  `{"jsonrpc": `,
+			want: []any{"null:-32700"},
+		},
+		{
+			name: "mixed batch is answered once in order",
+			msg: `[
+				{"jsonrpc": "2.0", "id": 1, "method": "echo", "params": {"value": "a"}},
+				{"id": 2, "method": "echo"},
+				{"jsonrpc": "2.0", "method": "echo"},
+				{"jsonrpc": "2.0", "id": {}, "method": "echo"},
+				{"jsonrpc": "2.0", "id": 3, "method": "missing"},
+				{"jsonrpc": "2.0", "id": 4, "method": "echo", "params": {"other": 1}}
+			]`,
+			want: []any{[]string{`1:"a"`, "2:-32600", "null:-32600", "3:-32601", "4:-32602"}},
+		},
+		{
+			name: "busy batch is answered once in order",
+			msg:  `[{"jsonrpc": "2.0", "id": 1, "method": "echo"}, {"id": 2, "method": "echo"}, {"jsonrpc": "2.0", "method": "echo"}]`,
+			full: true,
+			want: []any{[]string{"1:-32003", "2:-32600"}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var sent [][]byte
+			rc := &rpcConn{
+				dbs:     newTestServer(t),
+				limiter: newCommandLimiter("10.0.0.1"),
+				send:    func(msg []byte) { sent = append(sent, msg) },
+				abort:   func() {},
+				calls:   make(chan rpcCall, 1),
+			}
+			if tt.full {
+				rc.calls <- rpcCall{}
+			}
+			rc.handle([]byte(tt.msg), "")
+			if !tt.full {
+				select {
+				case call := <-rc.calls:
+					rc.respond(rc.answer(call), call.batch)
+				default:
+				}
+			}
+			var got []any
+			for _, msg := range sent {
+				got = append(got, summarize(t, msg))
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("sent %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
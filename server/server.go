@@ -2,10 +2,14 @@ package server
 
 import (
 	"context"
+	"fmt"
 	"log"
 	"net/http"
+	"os"
 	"pitchlake-backend/db"
 	"pitchlake-backend/models"
+	"strconv"
+	"time"
 )
 
 // dbServer enables broadcasting to a set of subscribers.
@@ -20,9 +24,22 @@ type NotificationPayloadVault[T AllowedPayload] struct {
 	Type      string `json:"type"`
 	Payload   T      `json:"payload"`
 }
+
+// RemovedPayload is sent in place of NotificationPayloadVault when a row is
+// deleted. Entity is the type of the update messages for the row and Key the
+// key they were sent with, so clients can drop the matching state.
+type RemovedPayload[T AllowedPayload] struct {
+	Operation string `json:"operation"`
+	Type      string `json:"type"`
+	Entity    string `json:"entity"`
+	Key       string `json:"key"`
+	Payload   T      `json:"payload"`
+}
+
 type InitialPayloadVault struct {
 	PayloadType            string                        `json:"payloadType"`
 	LiquidityProviderState models.LiquidityProviderState `json:"liquidityProviderState"`
+	QueuedLiquidity        models.QueuedLiquidity        `json:"queuedLiquidity"`
 	OptionBuyerStates      []*models.OptionBuyer         `json:"optionBuyerStates"`
 	VaultState             models.VaultState             `json:"vaultState"`
 	OptionRoundStates      []*models.OptionRound         `json:"optionRoundStates"`
@@ -35,48 +52,163 @@ type InitialPayloadGas struct {
 
 // newdbServer constructs a dbServer with the defaults.
 // Create a custom context for the server here and pass it to the db package
-func NewDBServer(ctx context.Context) *dbServer {
+func NewDBServer(ctx context.Context) (*dbServer, error) {
 
-	ctx, cancel := context.WithCancel(ctx)
 	db := &db.DB{}
-	db.Init()
+	if err := db.Init(); err != nil {
+		return nil, err
+	}
+	schemaMismatches, err := checkSchema(ctx, db)
+	if err != nil {
+		db.Pool.Close()
+		return nil, err
+	}
+	dbs := newDBServer(ctx, db, schemaMismatches)
+	go dbs.listener()
+	go dbs.expireReplayBuffers()
+	go dbs.auth.expire(dbs.ctx)
+	go dbs.ipLimits.expire(dbs.ctx, dbs.rateLimits.perIP)
+	return dbs, nil
+}
+
+// newDBServer builds a dbServer on database with its routes, configured
+// from the environment. Its background work is left to the caller.
+func newDBServer(ctx context.Context, database *db.DB, schemaMismatches []db.SchemaMismatch) *dbServer {
+	ctx, cancel := context.WithCancel(ctx)
 	dbs := &dbServer{
 		subscriberMessageBuffer: 16,
+		slowPolicyVault:         slowPolicyFromEnv("SLOW_POLICY_VAULT", slowPolicyCoalesce),
+		slowPolicyHome:          slowPolicyFromEnv("SLOW_POLICY_HOME", slowPolicyCoalesce),
+		slowPolicyGas:           slowPolicyFromEnv("SLOW_POLICY_GAS", slowPolicyDisconnect),
+		slowPolicyWS:            slowPolicyFromEnv("SLOW_POLICY_WS", slowPolicyCoalesce),
 		logf:                    log.Printf,
 		subscribersVault:        make(map[string][]*subscriberVault),
 		subscribersHome:         make(map[*subscriberHome]struct{}),
 		subscribersGas:          make(map[*subscriberGas]struct{}),
-		db:                      db,
+		topicSubscribers:        make(map[string]map[*wsClient]struct{}),
+		topicSeq:                make(map[string]uint64),
+		replay:                  make(map[string]*replayBuffer),
+		replayConfig:            replayConfigFromEnv(),
+		keepaliveConfig:         keepaliveConfigFromEnv(),
+		auth:                    authFromEnv(),
+		admission:               admissionConfigFromEnv(),
+		connections:             &connectionCounter{perIP: make(map[string]int)},
+		rateLimits:              rateLimitConfigFromEnv(),
+		ipLimits:                &ipLimiter{buckets: make(map[string]map[string]*tokenBucket)},
+		epoch:                   strconv.FormatInt(time.Now().UnixNano(), 36),
+		now:                     time.Now,
+		snapshots:               make(map[string]*vaultSnapshot),
+		homeVaults:              make(map[string]*homeVault),
+		channels:                defaultChannels(),
+		deadLetters:             deadLettersFromEnv(),
+		adminToken:              os.Getenv("ADMIN_TOKEN"),
+		db:                      database,
 		ctx:                     ctx,
 		cancel:                  cancel,
+		cdcSource:               cdcSourceListen,
+		replication:             replicationConfigFromEnv(),
+		listenerStatus:          listenerStatus{State: listenerConnecting},
+		schemaMismatches:        schemaMismatches,
+	}
+	switch source := os.Getenv("CDC_SOURCE"); source {
+	case "", cdcSourceListen:
+	case cdcSourceReplication:
+		dbs.cdcSource = cdcSourceReplication
+	default:
+		log.Printf("Unknown CDC_SOURCE %q, using %s", source, cdcSourceListen)
 	}
 	dbs.serveMux.Handle("/", http.FileServer(http.Dir(".")))
+	dbs.serveMux.HandleFunc("/ws", dbs.wsHandler)
 	dbs.serveMux.HandleFunc("/subscribeHome", dbs.subscribeHomeHandler)
 	dbs.serveMux.HandleFunc("/subscribeVault", dbs.subscribeVaultHandler)
 	dbs.serveMux.HandleFunc("/health", dbs.healthCheckHandler)
+	dbs.serveMux.HandleFunc("/status", dbs.statusHandler)
+	dbs.serveMux.HandleFunc("GET /admin/deadletters", dbs.requireAdmin(dbs.listDeadLettersHandler))
+	dbs.serveMux.HandleFunc("POST /admin/deadletters/replay", dbs.requireAdmin(dbs.replayDeadLettersHandler))
 	dbs.serveMux.HandleFunc("/subscribeGas", dbs.subscribeGasDataHandler)
-	go dbs.listener()
+	dbs.serveMux.HandleFunc("POST /auth/challenge", dbs.authChallengeHandler)
+	dbs.serveMux.HandleFunc("POST /auth/verify", dbs.authVerifyHandler)
+	dbs.serveMux.HandleFunc("GET /v1/vaults", dbs.rest(dbs.restVaults))
+	dbs.serveMux.HandleFunc("GET /v1/vaults/{addr}", dbs.rest(dbs.restVault))
+	dbs.serveMux.HandleFunc("GET /v1/vaults/{addr}/rounds", dbs.rest(dbs.restVaultRounds))
+	dbs.serveMux.HandleFunc("GET /v1/rounds/{addr}", dbs.rest(dbs.restRound))
+	dbs.serveMux.HandleFunc("GET /v1/lps/{addr}", dbs.rest(dbs.restLiquidityProvider))
+	dbs.serveMux.HandleFunc("GET /v1/buyers/{addr}", dbs.rest(dbs.restOptionBuyer))
+	dbs.serveMux.HandleFunc("GET /v1/blocks", dbs.rest(dbs.restBlocks))
 	return dbs
 }
 
+// checkSchema verifies the database schema according to SCHEMA_CHECK:
+// strict (the default) refuses to start on any mismatch, warn starts in a
+// degraded state reported on /status, and off skips the check.
+func checkSchema(ctx context.Context, database *db.DB) ([]db.SchemaMismatch, error) {
+	mode := os.Getenv("SCHEMA_CHECK")
+	if mode == "off" {
+		return nil, nil
+	}
+	mismatches, err := database.VerifySchema(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if len(mismatches) == 0 {
+		return nil, nil
+	}
+	for _, m := range mismatches {
+		log.Printf("Schema mismatch: %s", m)
+	}
+	if mode == "warn" {
+		log.Printf("Starting degraded with %d schema mismatches", len(mismatches))
+		return mismatches, nil
+	}
+	return nil, fmt.Errorf("database schema has %d mismatches, run `doctor` for details or set SCHEMA_CHECK=warn", len(mismatches))
+}
+
+// Close stops the listener and releases the database pool.
+func (dbs *dbServer) Close() {
+	dbs.cancel()
+	dbs.db.Pool.Close()
+}
+
 func (dbs *dbServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	dbs.serveMux.ServeHTTP(w, r)
 }
 
-// addSubscriber registers a subscriber.
-func (dbs *dbServer) addSubscriberVault(s *subscriberVault) {
+// addVaultWatch adds a watch to a subscriber and indexes the subscriber
+// under the watched vault. It reports false if the subscriber already has
+// the watch.
+func (dbs *dbServer) addVaultWatch(s *subscriberVault, w vaultWatch) bool {
 
 	dbs.subscribersVaultMu.Lock()
 	defer dbs.subscribersVaultMu.Unlock()
 
-	// Initialize the slice if it doesn't exist
-	if _, exists := dbs.subscribersVault[s.vaultAddress]; !exists {
-		dbs.subscribersVault[s.vaultAddress] = make([]*subscriberVault, 0)
+	if _, exists := s.watches[w]; exists {
+		return false
 	}
+	if !s.watchesVault(w.vaultAddress) {
+		dbs.subscribersVault[w.vaultAddress] = append(dbs.subscribersVault[w.vaultAddress], s)
+	}
+	s.watches[w] = struct{}{}
+	return true
+}
 
-	dbs.subscribersVault[s.vaultAddress] = append(dbs.subscribersVault[s.vaultAddress], s)
+// removeVaultWatch removes a watch from a subscriber, and the subscriber from
+// the vault's index once it no longer watches the vault. It reports false if
+// the subscriber did not have the watch.
+func (dbs *dbServer) removeVaultWatch(s *subscriberVault, w vaultWatch) bool {
+
+	dbs.subscribersVaultMu.Lock()
+	defer dbs.subscribersVaultMu.Unlock()
 
+	if _, exists := s.watches[w]; !exists {
+		return false
+	}
+	delete(s.watches, w)
+	if !s.watchesVault(w.vaultAddress) {
+		dbs.unindexSubscriberVault(s, w.vaultAddress)
+	}
+	return true
 }
+
 func (dbs *dbServer) addSubscriberHome(s *subscriberHome) {
 
 	dbs.subscribersHomeMu.Lock()
@@ -103,13 +235,32 @@ func (dbs *dbServer) deleteSubscriberGas(s *subscriberGas) {
 	dbs.subscribersGasMu.Unlock()
 }
 
-// deleteSubscriber deletes the given subscriber.
+// followGas sets the range and round duration s follows. deliver reads the
+// round duration under the same lock.
+func (dbs *dbServer) followGas(s *subscriberGas, request subscriberGasRequest) {
+	dbs.subscribersGasMu.Lock()
+	s.StartTimestamp = request.StartTimestamp
+	s.EndTimestamp = request.EndTimestamp
+	s.RoundDuration = request.RoundDuration
+	dbs.subscribersGasMu.Unlock()
+}
+
+// deleteSubscriber deletes the given subscriber from every vault it watches.
 func (dbs *dbServer) deleteSubscriberVault(s *subscriberVault) {
 
 	dbs.subscribersVaultMu.Lock()
 	defer dbs.subscribersVaultMu.Unlock()
 
-	subscribers, exists := dbs.subscribersVault[s.vaultAddress]
+	for w := range s.watches {
+		dbs.unindexSubscriberVault(s, w.vaultAddress)
+	}
+	s.watches = make(map[vaultWatch]struct{})
+}
+
+// unindexSubscriberVault removes a subscriber from the index of a vault.
+// subscribersVaultMu must be held.
+func (dbs *dbServer) unindexSubscriberVault(s *subscriberVault, vaultAddress string) {
+	subscribers, exists := dbs.subscribersVault[vaultAddress]
 	if !exists {
 		return // Nothing to delete
 	}
@@ -119,13 +270,99 @@ func (dbs *dbServer) deleteSubscriberVault(s *subscriberVault) {
 			// Replace the element to be deleted with the last element
 			subscribers[i] = subscribers[len(subscribers)-1]
 			// Truncate the slice
-			dbs.subscribersVault[s.vaultAddress] = subscribers[:len(subscribers)-1]
+			dbs.subscribersVault[vaultAddress] = subscribers[:len(subscribers)-1]
 			break
 		}
 	}
 
 	// If the slice is empty after deletion, remove the key from the map
-	if len(dbs.subscribersVault[s.vaultAddress]) == 0 {
-		delete(dbs.subscribersVault, s.vaultAddress)
+	if len(dbs.subscribersVault[vaultAddress]) == 0 {
+		delete(dbs.subscribersVault, vaultAddress)
+	}
+}
+
+// setVaultToken sets the session token of a subscriber.
+func (dbs *dbServer) setVaultToken(s *subscriberVault, token string) {
+	dbs.subscribersVaultMu.Lock()
+	defer dbs.subscribersVaultMu.Unlock()
+	s.token = token
+}
+
+// authorizedWatch reports whether the session of a subscriber still grants
+// access to the account of w. subscribersVaultMu must be held.
+func (dbs *dbServer) authorizedWatch(s *subscriberVault, w vaultWatch) bool {
+	return w.address == "" || dbs.auth.authorize(s.token, w.address)
+}
+
+// revokeVaultWatches turns the account watches of a subscriber whose session
+// no longer covers the account into plain vault watches, and returns them.
+func (dbs *dbServer) revokeVaultWatches(s *subscriberVault) []vaultWatch {
+	dbs.subscribersVaultMu.Lock()
+	defer dbs.subscribersVaultMu.Unlock()
+	var revoked []vaultWatch
+	for w := range s.watches {
+		if !dbs.authorizedWatch(s, w) {
+			revoked = append(revoked, w)
+		}
+	}
+	for _, w := range revoked {
+		delete(s.watches, w)
+		s.watches[vaultWatch{vaultAddress: w.vaultAddress}] = struct{}{}
+	}
+	return revoked
+}
+
+// vaultWatches returns the watches a subscriber has on a vault, leaving out
+// account watches its session no longer covers.
+func (dbs *dbServer) vaultWatches(s *subscriberVault, vaultAddress string) []vaultWatch {
+	dbs.subscribersVaultMu.Lock()
+	defer dbs.subscribersVaultMu.Unlock()
+	var watches []vaultWatch
+	for w := range s.watches {
+		if w.vaultAddress == vaultAddress && dbs.authorizedWatch(s, w) {
+			watches = append(watches, w)
+		}
+	}
+	return watches
+}
+
+// watchesVault reports whether the subscriber has a watch on the vault.
+// subscribersVaultMu must be held.
+func (s *subscriberVault) watchesVault(vaultAddress string) bool {
+	for w := range s.watches {
+		if w.vaultAddress == vaultAddress {
+			return true
+		}
+	}
+	return false
+}
+
+// watchesAccount reports whether the subscriber follows account, in the
+// given vault unless vaultAddress is empty. subscribersVaultMu must be held.
+func (s *subscriberVault) watchesAccount(vaultAddress, account string) bool {
+	for w := range s.watches {
+		if w.address == account && (vaultAddress == "" || w.vaultAddress == vaultAddress) {
+			return true
+		}
+	}
+	return false
+}
+
+// send queues msg of type msgType for the subscriber without blocking.
+// Subscribers that cannot keep up are disconnected according to the
+// stream's slowPolicy.
+func (s *streamConn) send(msgType, key string, msg []byte) {
+	if !s.envelope.push(s.msgs, msgType, key, msg) {
+		go s.closeSlow()
 	}
 }
+
+// sendError reports a failed request to the subscriber.
+func (s *streamConn) sendError(err error) {
+	s.send(wsTypeError, "", s.envelope.errorPayload(err))
+}
+
+// heartbeat queues an application heartbeat. Queued heartbeats coalesce.
+func (s *streamConn) heartbeat() {
+	s.send(wsTypeHeartbeat, "heartbeat", s.envelope.heartbeatPayload())
+}
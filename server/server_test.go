@@ -0,0 +1,55 @@
+package server
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+// testServerOption adjusts a server built by newTestServer.
+type testServerOption func(dbs *dbServer)
+
+// newTestServer returns a server configured like NewDBServer, without a
+// database or background work, after applying opts. It is closed when the
+// test ends.
+func newTestServer(t *testing.T, opts ...testServerOption) *dbServer {
+	t.Helper()
+	dbs := newDBServer(context.Background(), nil, nil)
+	t.Cleanup(dbs.cancel)
+	for _, opt := range opts {
+		opt(dbs)
+	}
+	return dbs
+}
+
+// withClock makes the server read the time from *now.
+func withClock(now *time.Time) testServerOption {
+	return func(dbs *dbServer) {
+		dbs.now = func() time.Time { return *now }
+	}
+}
+
+func TestFollowGasWhileDelivering(t *testing.T) {
+	dbs := newTestServer(t)
+	s := &subscriberGas{streamConn: streamConn{msgs: newOutbox(64, slowPolicyCoalesce)}}
+	dbs.addSubscriberGas(s)
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 100; i++ {
+			dbs.deliver(outboundMessage{stream: streamGas, msgType: "gas", key: "gas", msg: []byte(`{}`), roundDuration: 960})
+		}
+	}()
+	for i := 0; i < 100; i++ {
+		dbs.followGas(s, subscriberGasRequest{RoundDuration: gasRoundDurations[i%2]})
+	}
+	<-done
+
+	dbs.followGas(s, subscriberGasRequest{RoundDuration: 13200})
+	s.msgs.drain()
+	dbs.deliver(outboundMessage{stream: streamGas, msgType: "gas", key: "gas", msg: []byte(`{}`), roundDuration: 960})
+	if got := len(s.msgs.drain()); got != 0 {
+		t.Errorf("subscriber following 13200 got %d updates for 960", got)
+	}
+}
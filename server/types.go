@@ -2,14 +2,20 @@ package server
 
 import (
 	"context"
+	"fmt"
 	"net/http"
 	"pitchlake-backend/db"
 	"pitchlake-backend/models"
 	"sync"
+	"time"
 )
 
 type dbServer struct {
 	subscriberMessageBuffer int
+	slowPolicyVault         slowPolicy
+	slowPolicyHome          slowPolicy
+	slowPolicyGas           slowPolicy
+	slowPolicyWS            slowPolicy
 	db                      *db.DB
 	logf                    func(f string, v ...interface{})
 
@@ -21,19 +27,87 @@ type dbServer struct {
 	subscribersHome    map[*subscriberHome]struct{}
 	subscribersGasMu   sync.Mutex
 	subscribersGas     map[*subscriberGas]struct{}
-	ctx                context.Context
-	cancel             context.CancelFunc
+	topicsMu           sync.Mutex
+	topicSubscribers   map[string]map[*wsClient]struct{}
+	topicSeq           map[string]uint64
+	replay             map[string]*replayBuffer
+	replayConfig       replayConfig
+	keepaliveConfig    keepaliveConfig
+	auth               *authenticator
+	admission          admissionConfig
+	connections        *connectionCounter
+	rateLimits         rateLimitConfig
+	ipLimits           *ipLimiter
+	// epoch identifies this server run; topic seqs restart with it.
+	epoch string
+	// now is the clock of the rate limits and replay buffers.
+	now    func() time.Time
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	cdcSource      string
+	replication    replicationConfig
+	listenerMu     sync.RWMutex
+	listenerStatus listenerStatus
+
+	snapshotsMu sync.Mutex
+	snapshots   map[string]*vaultSnapshot
+
+	homeVaultsMu sync.Mutex
+	homeVaults   map[string]*homeVault
+
+	schemaMismatches []db.SchemaMismatch
+
+	channels    *channelRegistry
+	deadLetters *deadLetterStore
+	adminToken  string
+}
+
+type listenerState string
+
+const (
+	listenerConnecting   listenerState = "connecting"
+	listenerConnected    listenerState = "connected"
+	listenerReconnecting listenerState = "reconnecting"
+	listenerStopped      listenerState = "stopped"
+)
+
+// listenerStatus describes the health of the LISTEN connection.
+type listenerStatus struct {
+	State            listenerState `json:"state"`
+	ConnectedSince   time.Time     `json:"connectedSince"`
+	LastNotification time.Time     `json:"lastNotification"`
+	Reconnects       uint64        `json:"reconnects"`
+	LastError        string        `json:"lastError,omitempty"`
+}
+
+// streamConn is the connection of a subscriber to a dedicated endpoint.
+// Messages are queued on the msgs outbox, wrapped in envelope when the
+// client asked for one, and if the client cannot keep up with the
+// messages, closeSlow is called.
+type streamConn struct {
+	msgs      *outbox
+	closeSlow func()
+	envelope  *streamEnvelope
 }
 
 // subscriber represents a subscriber.
-// Messages are sent on the msgs channel and if the client
-// cannot keep up with the messages, closeSlow is called.
 type subscriberVault struct {
-	msgs         chan []byte
-	address      string
-	userType     string
+	streamConn
+	userType string
+
+	// watches and token are guarded by dbServer.subscribersVaultMu. token
+	// is the session token of the connection, checked again before account
+	// data is delivered.
+	watches map[vaultWatch]struct{}
+	token   string
+}
+
+// vaultWatch is a vault followed by a subscriber together with the account
+// whose state it follows in that vault.
+type vaultWatch struct {
 	vaultAddress string
-	closeSlow    func()
+	address      string
 }
 type BlockResponse struct {
 	BlockNumber uint64 `json:"blockNumber"`
@@ -44,15 +118,14 @@ type BlockResponse struct {
 }
 
 type subscriberHome struct {
-	msgs      chan []byte
-	closeSlow func()
+	streamConn
 }
 type subscriberGas struct {
+	streamConn
+	// The requested range, guarded by subscribersGasMu.
 	StartTimestamp uint64
 	EndTimestamp   uint64
 	RoundDuration  uint64
-	msgs           chan []byte
-	closeSlow      func()
 }
 
 type subscriberMessage struct {
@@ -60,11 +133,42 @@ type subscriberMessage struct {
 	VaultAddress string `json:"vaultAddress"`
 	UserType     string `json:"userType"`
 	OptionRound  uint64 `json:"optionRound"`
+	// Token is a session token for Address, required to receive its
+	// account data.
+	Token string `json:"token"`
+}
+
+// String formats the message for logs without its token.
+func (sm subscriberMessage) String() string {
+	return fmt.Sprintf("{address:%s vaultAddress:%s userType:%s optionRound:%d token:%s}",
+		sm.Address, sm.VaultAddress, sm.UserType, sm.OptionRound, redact(sm.Token))
 }
 
+// subscriberVaultRequest either updates the account of the watch the
+// connection was opened with, or adds or removes a watch with Action
+// "watch" or "unwatch".
 type subscriberVaultRequest struct {
 	UpdatedField string `json:"updatedField"`
 	UpdatedValue string `json:"updatedValue"`
+	Action       string `json:"action"`
+	VaultAddress string `json:"vaultAddress"`
+	Address      string `json:"address"`
+	// Token replaces the session token of the connection when set.
+	Token string `json:"token"`
+}
+
+// String formats the request for logs without its token.
+func (r subscriberVaultRequest) String() string {
+	return fmt.Sprintf("{updatedField:%s updatedValue:%s action:%s vaultAddress:%s address:%s token:%s}",
+		r.UpdatedField, r.UpdatedValue, r.Action, r.VaultAddress, r.Address, redact(r.Token))
+}
+
+// redact hides a session token in logs, only telling whether it was set.
+func redact(token string) string {
+	if token == "" {
+		return ""
+	}
+	return "[redacted]"
 }
 
 type BidData struct {
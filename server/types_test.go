@@ -0,0 +1,21 @@
+package server
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func TestTokensAreRedacted(t *testing.T) {
+	const token = "5ec2e7"
+	for _, v := range []any{
+		subscriberMessage{Address: "0x1", VaultAddress: "0x2", Token: token},
+		subscriberVaultRequest{Action: "watch", VaultAddress: "0x2", Token: token},
+	} {
+		for _, format := range []string{"%v", "%+v", "%s"} {
+			if got := fmt.Sprintf(format, v); strings.Contains(got, token) {
+				t.Errorf("%s of %T leaks the token: %s", format, v, got)
+			}
+		}
+	}
+}
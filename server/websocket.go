@@ -3,10 +3,14 @@ package server
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
+	"math/big"
 	"net"
 	"net/http"
+	"pitchlake-backend/db"
+	"pitchlake-backend/models"
 	"sync"
 	"time"
 
@@ -17,16 +21,13 @@ func (dbs *dbServer) subscribeVault(ctx context.Context, w http.ResponseWriter,
 	var mu sync.Mutex
 	var c *websocket.Conn
 	var closed bool
-	//Extract address from the request and add here
-
-	//allowedOrigin := os.Getenv("APP_URL")
-	c2, err := websocket.Accept(w, r, &websocket.AcceptOptions{
-		InsecureSkipVerify: true,
-	})
+	c2, release, err := dbs.accept(w, r)
 	if err != nil {
 		return err
 	}
+	defer release()
 	defer c2.Close(websocket.StatusInternalError, "Internal server error")
+	envelope := newStreamEnvelope(r, streamVault)
 
 	// Read the first message to get the subscription data
 	_, msg, err := c2.Read(ctx)
@@ -34,28 +35,46 @@ func (dbs *dbServer) subscribeVault(ctx context.Context, w http.ResponseWriter,
 		return err
 	}
 
+	// Without a valid subscription there is nothing to serve, so report
+	// the error and close.
 	var sm subscriberMessage
 	err = json.Unmarshal(msg, &sm)
 	if err != nil {
-		return err
+		dbs.writeTimeout(ctx, time.Second*5, c2, envelope.errorMessage(invalidRequest("invalid subscription message: %v", err)))
+		return reject(c2, websocket.StatusPolicyViolation, "invalid subscription message")
+	}
+	if !validAddress(sm.VaultAddress, false) || !validAddress(sm.Address, true) {
+		dbs.writeTimeout(ctx, time.Second*5, c2, envelope.errorMessage(invalidRequest("invalid address")))
+		return reject(c2, websocket.StatusPolicyViolation, "invalid address")
 	}
 	log.Printf("%v", sm)
 
 	s := &subscriberVault{
-		address:      sm.Address,
-		vaultAddress: sm.VaultAddress,
-		userType:     sm.UserType,
-		msgs:         make(chan []byte, dbs.subscriberMessageBuffer),
-		closeSlow: func() {
-			mu.Lock()
-			defer mu.Unlock()
-			closed = true
-			if c != nil {
-				c.Close(websocket.StatusPolicyViolation, "connection too slow to keep up with messages")
-			}
+		userType: sm.UserType,
+		watches:  make(map[vaultWatch]struct{}),
+		streamConn: streamConn{
+			msgs:     newOutbox(dbs.subscriberMessageBuffer, dbs.slowPolicyVault),
+			envelope: envelope,
+			closeSlow: func() {
+				mu.Lock()
+				defer mu.Unlock()
+				closed = true
+				if c != nil {
+					c.Close(websocket.StatusPolicyViolation, "connection too slow to keep up with messages")
+				}
+			},
 		},
 	}
-	dbs.addSubscriberVault(s)
+	// Account data needs a session token for the address; without one the
+	// connection only follows the public vault data.
+	token := sm.Token
+	s.token = token
+	primary := vaultWatch{vaultAddress: sm.VaultAddress, address: sm.Address}
+	anonymous := primary.address != "" && !dbs.auth.authorize(token, primary.address)
+	if anonymous {
+		primary.address = ""
+	}
+	dbs.addVaultWatch(s, primary)
 	defer dbs.deleteSubscriberVault(s)
 
 	mu.Lock()
@@ -67,95 +86,137 @@ func (dbs *dbServer) subscribeVault(ctx context.Context, w http.ResponseWriter,
 	mu.Unlock()
 	defer c.CloseNow()
 
-	//Send initial payload here
-	var payload InitialPayloadVault
-
-	payload.PayloadType = "initial"
-	vaultState, err := dbs.db.GetVaultStateByID(s.vaultAddress)
-	if err != nil {
-		return err
-	}
-	optionRounds, err := dbs.db.GetOptionRoundsByVaultAddress(s.vaultAddress)
+	//Send initial payload here. An unknown vault is reported but the
+	// connection stays open for other watches.
+	jsonPayload, err := dbs.vaultPayload("initial", primary)
 	if err != nil {
-		return err
-	}
-	payload.OptionRoundStates = optionRounds
-	payload.VaultState = *vaultState
-	lpState, err := dbs.db.GetLiquidityProviderStateByAddress(s.address, s.vaultAddress)
-	if err != nil {
-		fmt.Printf("Error fetching lp state %v", err)
+		jsonPayload = envelope.errorMessage(err)
 	} else {
-		payload.LiquidityProviderState = *lpState
-	}
-
-	obStates, err := dbs.db.GetOptionBuyerByAddress(s.address)
-	if err != nil {
-		fmt.Printf("Error fetching ob state %v", err)
-	}
-	payload.OptionBuyerStates = obStates
-
-	// if sm.UserType == "lp" {
-
-	// } else if sm.UserType == "ob" {
-
-	// } else {
-	// 	return errors.New("invalid user type")
-	// }
-
-	// Marshal the VaultState to a JSON byte array
-	jsonPayload, err := json.Marshal(payload)
-	if err != nil {
-		return err
+		jsonPayload = envelope.frame(wsTypeSnapshot, jsonPayload)
 	}
 	dbs.writeTimeout(ctx, time.Second*5, c, jsonPayload)
+	if anonymous {
+		dbs.writeTimeout(ctx, time.Second*5, c, envelope.errorMessage(unauthorized("no session token for %s", sm.Address)))
+	}
+	limiter := newCommandLimiter(dbs.clientIP(r))
+	rpc := dbs.newRPCConn(ctx, c, limiter, func(msg []byte) { s.send("", "", msg) })
+	defer rpc.stop()
+	errChan := make(chan error, 1)
 	go func() {
 		for {
 			var request subscriberVaultRequest
 			_, msg, err := c.Read(ctx)
 			if err != nil {
 				log.Printf("Error reading message: %v", err)
-				break
+				errChan <- err
+				return
+			}
+			// Messages may carry a session token, so only parsed requests
+			// are logged.
+			if isRPC(msg) {
+				rpc.handle(msg, token)
+				continue
 			}
-			log.Printf("Received message from client: %s", msg)
 			err = json.Unmarshal(msg, &request)
 			if err != nil {
 				log.Printf("Incorrect message format: %v", err)
-				break
+				s.sendError(invalidRequest("invalid message: %v", err))
+				continue
 			}
-			var payload InitialPayloadVault
-			if request.UpdatedField == "address" {
-				s.address = request.UpdatedValue
-
-				payload.PayloadType = "account_update"
-				lpState, err := dbs.db.GetLiquidityProviderStateByAddress(s.address, s.vaultAddress)
+			log.Printf("Received message from client: %v", request)
+			if !validVaultRequest(request) {
+				s.sendError(invalidRequest("invalid address"))
+				continue
+			}
+			if kind := vaultRequestKind(request); kind != "" {
+				if err := dbs.charge(limiter, kind); err != nil {
+					if err.abusive {
+						errChan <- reject(c, websocket.StatusPolicyViolation, "rate limit exceeded")
+						return
+					}
+					s.sendError(err)
+					continue
+				}
+			}
+			if request.Token != "" {
+				token = request.Token
+				dbs.setVaultToken(s, token)
+			}
+			switch {
+			case request.Action == "watch":
+				w := vaultWatch{vaultAddress: request.VaultAddress, address: request.Address}
+				if w.address != "" && !dbs.auth.authorize(token, w.address) {
+					s.sendError(unauthorized("no session token for %s", w.address))
+					continue
+				}
+				if !dbs.addVaultWatch(s, w) {
+					continue
+				}
+				jsonPayload, err := dbs.vaultPayload("watch", w)
 				if err != nil {
-					fmt.Printf("Error fetching lp state %v", err)
-				} else {
-					payload.LiquidityProviderState = *lpState
+					dbs.removeVaultWatch(s, w)
+					s.sendError(err)
+					continue
 				}
-
-				obStates, err := dbs.db.GetOptionBuyerByAddress(s.address)
+				s.send(wsTypeSnapshot, "watch:"+w.vaultAddress+":"+w.address, jsonPayload)
+			case request.Action == "unwatch":
+				w := vaultWatch{vaultAddress: request.VaultAddress, address: request.Address}
+				if !dbs.removeVaultWatch(s, w) {
+					continue
+				}
+				jsonPayload, err := json.Marshal(struct {
+					PayloadType  string `json:"payloadType"`
+					VaultAddress string `json:"vaultAddress"`
+					Address      string `json:"address"`
+				}{"unwatch", w.vaultAddress, w.address})
 				if err != nil {
-					fmt.Printf("Error fetching ob state %v", err)
+					continue
 				}
-				payload.OptionBuyerStates = obStates
-			}
-			jsonPayload, err := json.Marshal(payload)
-			if err != nil {
-				log.Printf("Incorrect response generated: %v", err)
+				s.send(wsTypeUnsubscribed, "", jsonPayload)
+			case request.UpdatedField == "address":
+				// Switch the account of the watch the connection was
+				// opened with.
+				if !dbs.auth.authorize(token, request.UpdatedValue) {
+					s.sendError(unauthorized("no session token for %s", request.UpdatedValue))
+					continue
+				}
+				updated := vaultWatch{vaultAddress: primary.vaultAddress, address: request.UpdatedValue}
+				dbs.removeVaultWatch(s, primary)
+				dbs.addVaultWatch(s, updated)
+				primary = updated
+				jsonPayload, err := dbs.accountPayload(primary.address, primary.vaultAddress)
+				if err != nil {
+					s.sendError(err)
+					continue
+				}
+				s.send(wsTypeSnapshot, "account:"+primary.vaultAddress+":"+primary.address, jsonPayload)
 			}
-			s.msgs <- []byte(jsonPayload)
-			log.Printf("Client Info %v", s)
-			// Handle the received message here
 		}
 	}()
+	pingErr := dbs.keepalive(ctx, c, s.heartbeat)
+	sessionCheck := time.NewTicker(sessionCheckInterval)
+	defer sessionCheck.Stop()
 	for {
 		select {
-		case msg := <-s.msgs:
-			//Push messages received on the subscriber channel to the client
-			err := dbs.writeTimeout(ctx, time.Second*5, c, msg)
-			if err != nil {
-				return err
+		case err := <-errChan:
+			return err
+		case err := <-pingErr:
+			return err
+		case <-sessionCheck.C:
+			// Account watches end with their session; the vault data keeps
+			// streaming.
+			for _, w := range dbs.revokeVaultWatches(s) {
+				s.sendError(unauthorized("session expired for %s", w.address))
+			}
+		case <-s.msgs.done:
+			return net.ErrClosed
+		case <-s.msgs.ready:
+			//Push messages queued on the subscriber outbox to the client
+			for _, msg := range s.msgs.drain() {
+				err := dbs.writeTimeout(ctx, time.Second*5, c, msg)
+				if err != nil {
+					return err
+				}
 			}
 		case <-ctx.Done():
 			return ctx.Err()
@@ -168,20 +229,19 @@ func (dbs *dbServer) subscribeHome(ctx context.Context, w http.ResponseWriter, r
 	var c *websocket.Conn
 	var closed bool
 
-	//allowedOrigin := os.Getenv("APP_URL")
 	// Accept the WebSocket connection
-	c2, err := websocket.Accept(w, r, &websocket.AcceptOptions{
-		InsecureSkipVerify: true,
-	})
+	c2, release, err := dbs.accept(w, r)
 	if err != nil {
 		return err
 	}
+	defer release()
 	defer c2.Close(websocket.StatusInternalError, "Internal server error")
 
 	// Read the first message to get the subscription data
 
-	s := &subscriberHome{
-		msgs: make(chan []byte, dbs.subscriberMessageBuffer),
+	s := &subscriberHome{streamConn{
+		msgs:     newOutbox(dbs.subscriberMessageBuffer, dbs.slowPolicyHome),
+		envelope: newStreamEnvelope(r, streamHome),
 		closeSlow: func() {
 			mu.Lock()
 			defer mu.Unlock()
@@ -190,7 +250,7 @@ func (dbs *dbServer) subscribeHome(ctx context.Context, w http.ResponseWriter, r
 				c.Close(websocket.StatusPolicyViolation, "connection too slow to keep up with messages")
 			}
 		},
-	}
+	}}
 
 	// Add the subscriber to the appropriate map based on the address
 	dbs.addSubscriberHome(s)
@@ -207,31 +267,71 @@ func (dbs *dbServer) subscribeHome(ctx context.Context, w http.ResponseWriter, r
 	mu.Unlock()
 	defer c.CloseNow()
 
-	vaultAddresses, err := dbs.db.GetVaultAddresses()
-	if err != nil {
-		return err
-	}
-	log.Printf("vaultAddresses %v", vaultAddresses)
-	// Send initial payload here
-	response := struct {
-		VaultAddresses []string `json:"vaultAddresses"`
-	}{
-		VaultAddresses: vaultAddresses,
-	}
-	jsonPayload, err := json.Marshal(response)
+	// Send initial payload here, sorted by address until the client asks
+	// for something else
+	jsonPayload, err := dbs.homePayload(subscriberHomeMessage{})
 	if err != nil {
 		return err
 	}
 
-	dbs.writeTimeout(ctx, time.Second*5, c, jsonPayload)
+	dbs.writeTimeout(ctx, time.Second*5, c, s.envelope.frame(wsTypeSnapshot, jsonPayload))
+	limiter := newCommandLimiter(dbs.clientIP(r))
+	rpc := dbs.newRPCConn(ctx, c, limiter, func(msg []byte) { s.send("", "", msg) })
+	defer rpc.stop()
+	errChan := make(chan error, 1)
+	go func() {
+		for {
+			var sm subscriberHomeMessage
+			_, msg, err := c.Read(ctx)
+			if err != nil {
+				log.Printf("Error reading message: %v", err)
+				errChan <- err
+				return
+			}
+			if isRPC(msg) {
+				rpc.handle(msg, "")
+				continue
+			}
+			err = json.Unmarshal(msg, &sm)
+			if err != nil {
+				log.Printf("Incorrect message format: %v", err)
+				s.sendError(invalidRequest("invalid message: %v", err))
+				continue
+			}
+			log.Printf("Received message from client: %v", sm)
+			if err := dbs.charge(limiter, commandHome); err != nil {
+				if err.abusive {
+					errChan <- reject(c, websocket.StatusPolicyViolation, "rate limit exceeded")
+					return
+				}
+				s.sendError(err)
+				continue
+			}
+			jsonPayload, err := dbs.homePayload(sm)
+			if err != nil {
+				s.sendError(err)
+				continue
+			}
+			s.send(wsTypeSnapshot, "home", jsonPayload)
+		}
+	}()
 
+	pingErr := dbs.keepalive(ctx, c, s.heartbeat)
 	for {
 		select {
-		case msg := <-s.msgs:
-			//Loop to write update messages to client
-			err := dbs.writeTimeout(ctx, time.Second*5, c, msg)
-			if err != nil {
-				return err
+		case err := <-errChan:
+			return err
+		case err := <-pingErr:
+			return err
+		case <-s.msgs.done:
+			return net.ErrClosed
+		case <-s.msgs.ready:
+			//Push messages queued on the subscriber outbox to the client
+			for _, msg := range s.msgs.drain() {
+				err := dbs.writeTimeout(ctx, time.Second*5, c, msg)
+				if err != nil {
+					return err
+				}
 			}
 		case <-ctx.Done():
 			return ctx.Err()
@@ -246,12 +346,11 @@ func (dbs *dbServer) subscribeGasData(ctx context.Context, w http.ResponseWriter
 
 	log.Printf("Subscribing to gas data")
 
-	c2, err := websocket.Accept(w, r, &websocket.AcceptOptions{
-		InsecureSkipVerify: true,
-	})
+	c2, release, err := dbs.accept(w, r)
 	if err != nil {
 		return err
 	}
+	defer release()
 	defer c2.Close(websocket.StatusInternalError, "Internal server error")
 
 	// Create a context that we can cancel
@@ -259,19 +358,22 @@ func (dbs *dbServer) subscribeGasData(ctx context.Context, w http.ResponseWriter
 	defer cancelReader()
 
 	s := &subscriberGas{
-		msgs:           make(chan []byte, dbs.subscriberMessageBuffer),
+		streamConn: streamConn{
+			msgs:     newOutbox(dbs.subscriberMessageBuffer, dbs.slowPolicyGas),
+			envelope: newStreamEnvelope(r, streamGas),
+			closeSlow: func() {
+				mu.Lock()
+				defer mu.Unlock()
+				closed = true
+				if c != nil {
+					c.Close(websocket.StatusPolicyViolation, "connection too slow to keep up with messages")
+				}
+				cancelReader() // Cancel the reader goroutine
+			},
+		},
 		StartTimestamp: 0,
 		EndTimestamp:   0,
 		RoundDuration:  0,
-		closeSlow: func() {
-			mu.Lock()
-			defer mu.Unlock()
-			closed = true
-			if c != nil {
-				c.Close(websocket.StatusPolicyViolation, "connection too slow to keep up with messages")
-			}
-			cancelReader() // Cancel the reader goroutine
-		},
 	}
 
 	dbs.addSubscriberGas(s)
@@ -288,6 +390,9 @@ func (dbs *dbServer) subscribeGasData(ctx context.Context, w http.ResponseWriter
 	defer c.CloseNow()
 
 	// Create error channel to handle goroutine errors
+	limiter := newCommandLimiter(dbs.clientIP(r))
+	rpc := dbs.newRPCConn(ctx, c, limiter, func(msg []byte) { s.send("", "", msg) })
+	defer rpc.stop()
 	errChan := make(chan error, 1)
 
 	go func() {
@@ -304,81 +409,52 @@ func (dbs *dbServer) subscribeGasData(ctx context.Context, w http.ResponseWriter
 					errChan <- err
 					return
 				}
-				log.Printf("Received message from client: %s", msg)
+				if isRPC(msg) {
+					rpc.handle(msg, "")
+					continue
+				}
 				err = json.Unmarshal(msg, &request)
 				if err != nil {
 					log.Printf("Incorrect message format: %v", err)
-					errChan <- err
-					return
-				}
-				s.StartTimestamp = request.StartTimestamp
-				s.EndTimestamp = request.EndTimestamp
-				s.RoundDuration = request.RoundDuration
-				blocks, err := dbs.db.GetBlocks(request.StartTimestamp, request.EndTimestamp, request.RoundDuration)
-				if err != nil {
-					log.Printf("Error fetching blocks: %v", err)
-					errChan <- err
-					return
+					s.sendError(invalidRequest("invalid message: %v", err))
+					continue
 				}
-				var confirmedBlocks, unconfirmedBlocks []BlockResponse
-				for _, block := range blocks {
-					var twap string
-					switch request.RoundDuration {
-					case 960:
-						twap = block.TwelveMinTwap
-					case 13200:
-						twap = block.ThreeHourTwap
-					case 2631600:
-						twap = block.ThirtyDayTwap
+				log.Printf("Received message from client: %v", request)
+				if err := dbs.charge(limiter, commandGas); err != nil {
+					if err.abusive {
+						errChan <- reject(c, websocket.StatusPolicyViolation, "rate limit exceeded")
+						return
 					}
-					if block.IsConfirmed {
-						confirmedBlocks = append(confirmedBlocks, BlockResponse{
-							BlockNumber: block.BlockNumber,
-							Timestamp:   block.Timestamp,
-							BaseFee:     block.BaseFee,
-							IsConfirmed: block.IsConfirmed,
-							Twap:        twap,
-						})
-					} else {
-						unconfirmedBlocks = append(unconfirmedBlocks, BlockResponse{
-							BlockNumber: block.BlockNumber,
-							Timestamp:   block.Timestamp,
-							BaseFee:     block.BaseFee,
-							IsConfirmed: block.IsConfirmed,
-							Twap:        twap,
-						})
-					}
-				}
-				response := struct {
-					ConfirmedBlocks   []BlockResponse `json:"confirmedBlocks"`
-					UnconfirmedBlocks []BlockResponse `json:"unconfirmedBlocks"`
-				}{
-					ConfirmedBlocks:   confirmedBlocks,
-					UnconfirmedBlocks: unconfirmedBlocks,
+					s.sendError(err)
+					continue
 				}
-				jsonPayload, err := json.Marshal(response)
+				dbs.followGas(s, request)
+				jsonPayload, err := dbs.gasPayload(request.StartTimestamp, request.EndTimestamp, request.RoundDuration)
 				if err != nil {
-					log.Printf("Incorrect response generated: %v", err)
-					errChan <- err
-					return
-				}
-				select {
-				case s.msgs <- []byte(jsonPayload):
-				case <-readerCtx.Done():
-					return
+					s.sendError(err)
+					continue
 				}
+				s.send(wsTypeSnapshot, "", jsonPayload)
 			}
 		}
 	}()
 
+	pingErr := dbs.keepalive(ctx, c, s.heartbeat)
 	for {
 		select {
 		case err := <-errChan:
 			return err
-		case msg := <-s.msgs:
-			err := dbs.writeTimeout(ctx, time.Second*5, c, msg)
-			if err != nil {
-				return err
+		case err := <-pingErr:
+			return err
+		case <-s.msgs.done:
+			return net.ErrClosed
+		case <-s.msgs.ready:
+			//Push messages queued on the subscriber outbox to the client
+			for _, msg := range s.msgs.drain() {
+				err := dbs.writeTimeout(ctx, time.Second*5, c, msg)
+				if err != nil {
+					return err
+				}
 			}
 		case <-ctx.Done():
 			return ctx.Err()
@@ -386,6 +462,125 @@ func (dbs *dbServer) subscribeGasData(ctx context.Context, w http.ResponseWriter
 	}
 }
 
+// vaultPayload builds the full payload of a watch: the vault and its rounds
+// together with the account state of the watched address, if any.
+func (dbs *dbServer) vaultPayload(payloadType string, w vaultWatch) ([]byte, error) {
+	var payload InitialPayloadVault
+
+	payload.PayloadType = payloadType
+	vaultState, err := dbs.db.GetVaultStateByID(w.vaultAddress)
+	if err != nil {
+		return nil, vaultNotFound(w.vaultAddress, err)
+	}
+	optionRounds, err := dbs.db.GetOptionRoundsByVaultAddress(w.vaultAddress)
+	if err != nil {
+		return nil, err
+	}
+	payload.OptionRoundStates = optionRounds
+	payload.VaultState = *vaultState
+	dbs.recordVaultState(vaultState)
+	for _, optionRound := range optionRounds {
+		dbs.recordOptionRound(optionRound)
+	}
+	if w.address == "" {
+		return json.Marshal(payload)
+	}
+	lpState, err := dbs.db.GetLiquidityProviderStateByAddress(w.address, w.vaultAddress)
+	if err != nil {
+		fmt.Printf("Error fetching lp state %v", err)
+	} else {
+		payload.LiquidityProviderState = *lpState
+	}
+	payload.QueuedLiquidity = dbs.queuedLiquidity(w.address, vaultState.CurrentRoundAddress)
+
+	obStates, err := dbs.db.GetOptionBuyerByAddress(w.address)
+	if err != nil {
+		fmt.Printf("Error fetching ob state %v", err)
+	}
+	payload.OptionBuyerStates = obStates
+	return json.Marshal(payload)
+}
+
+// accountPayload builds the account_update payload carrying the LP, queued
+// liquidity and option buyer state of address in the given vault.
+func (dbs *dbServer) accountPayload(address, vaultAddress string) ([]byte, error) {
+	var payload InitialPayloadVault
+
+	payload.PayloadType = "account_update"
+	lpState, err := dbs.db.GetLiquidityProviderStateByAddress(address, vaultAddress)
+	if err != nil {
+		fmt.Printf("Error fetching lp state %v", err)
+	} else {
+		payload.LiquidityProviderState = *lpState
+	}
+	vaultState, err := dbs.db.GetVaultStateByID(vaultAddress)
+	if err != nil {
+		fmt.Printf("Error fetching vault state %v", err)
+	} else {
+		payload.QueuedLiquidity = dbs.queuedLiquidity(address, vaultState.CurrentRoundAddress)
+	}
+
+	obStates, err := dbs.db.GetOptionBuyerByAddress(address)
+	if err != nil {
+		fmt.Printf("Error fetching ob state %v", err)
+	}
+	payload.OptionBuyerStates = obStates
+	return json.Marshal(payload)
+}
+
+// gasPayload builds the blocks between startTimestamp and endTimestamp,
+// sampled for roundDuration, together with the window's TWAP state.
+func (dbs *dbServer) gasPayload(startTimestamp, endTimestamp, roundDuration uint64) ([]byte, error) {
+	blocks, err := dbs.db.GetBlocks(startTimestamp, endTimestamp, roundDuration)
+	if err != nil {
+		return nil, err
+	}
+	var confirmed, unconfirmed []models.Block
+	for _, block := range blocks {
+		if block.IsConfirmed {
+			confirmed = append(confirmed, block)
+		} else {
+			unconfirmed = append(unconfirmed, block)
+		}
+	}
+	twapStates := []models.TwapState{}
+	if window := twapWindow(roundDuration); window != "" {
+		twapStates, err = dbs.db.GetTwapStates(window)
+		if err != nil {
+			return nil, fmt.Errorf("error fetching twap state: %w", err)
+		}
+	}
+	response := struct {
+		ConfirmedBlocks   []BlockResponse    `json:"confirmedBlocks"`
+		UnconfirmedBlocks []BlockResponse    `json:"unconfirmedBlocks"`
+		TwapStates        []models.TwapState `json:"twapStates"`
+	}{
+		ConfirmedBlocks:   blockResponses(confirmed, roundDuration),
+		UnconfirmedBlocks: blockResponses(unconfirmed, roundDuration),
+		TwapStates:        twapStates,
+	}
+	return json.Marshal(response)
+}
+
+// queuedLiquidity returns the liquidity address has queued for withdrawal
+// from roundAddress. LPs without a queued position get zero values.
+func (dbs *dbServer) queuedLiquidity(address, roundAddress string) models.QueuedLiquidity {
+	queued := models.QueuedLiquidity{
+		Address:         address,
+		RoundAddress:    roundAddress,
+		Bps:             models.BigInt{Int: new(big.Int)},
+		QueuedLiquidity: models.BigInt{Int: new(big.Int)},
+	}
+	ql, err := dbs.db.GetQueuedLiquidity(address, roundAddress)
+	if err != nil {
+		if !errors.Is(err, db.ErrNotFound) {
+			fmt.Printf("Error fetching queued liquidity %v", err)
+		}
+		return queued
+	}
+	return *ql
+}
+
 func (dbs *dbServer) writeTimeout(ctx context.Context, timeout time.Duration, c *websocket.Conn, msg []byte) error {
 	ctx, cancel := context.WithTimeout(ctx, timeout)
 	defer cancel()
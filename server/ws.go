@@ -0,0 +1,593 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/coder/websocket"
+)
+
+// Topic kinds served on /ws. Topics are "home" or "<kind>:<argument>".
+const (
+	topicHome    = "home"
+	topicVault   = "vault"
+	topicAccount = "account"
+	topicGas     = "gas"
+	topicRound   = "round"
+)
+
+// Envelope types sent on /ws besides the update types of the streams.
+const (
+	wsTypeSnapshot     = "snapshot"
+	wsTypeSubscribed   = "subscribed"
+	wsTypeUnsubscribed = "unsubscribed"
+	wsTypeResync       = "resync"
+	wsTypeError        = "error"
+	wsTypeHeartbeat    = "heartbeat"
+	wsTypeAuthorized   = "authorized"
+)
+
+// wsCommand is sent by /ws clients to manage their topics. Params are topic
+// specific: home accepts a subscriberHomeMessage, account an optional
+// vaultAddress and gas the startTimestamp and endTimestamp of the snapshot.
+// Resume asks to replay the updates missed since a previous subscription
+// instead of sending a snapshot. The auth action attaches a session token,
+// which account topics require.
+//
+//	{"action": "subscribe", "topic": "vault:0x1", "resume": {"epoch": "lx2k", "seq": 41}}
+//	{"action": "auth", "token": "..."}
+type wsCommand struct {
+	Action string          `json:"action"`
+	Topic  string          `json:"topic"`
+	Params json.RawMessage `json:"params,omitempty"`
+	Resume *wsResume       `json:"resume,omitempty"`
+	Token  string          `json:"token,omitempty"`
+}
+
+// wsResume names the last update a client received on a topic. Seqs are
+// only comparable within one server epoch.
+type wsResume struct {
+	Epoch string `json:"epoch"`
+	Seq   uint64 `json:"seq"`
+}
+
+// wsSubscribed is the payload of subscribed messages. Seq is the seq of the
+// snapshot, or of the last replayed update when Resumed is set.
+type wsSubscribed struct {
+	Epoch   string `json:"epoch"`
+	Seq     uint64 `json:"seq"`
+	Resumed bool   `json:"resumed"`
+}
+
+// wsSubscription is the starting point of a new subscription.
+type wsSubscription struct {
+	seq     uint64
+	replay  []replayEntry
+	resumed bool
+}
+
+// wsClient is a /ws connection. It shares one outbox across all of its
+// topics.
+type wsClient struct {
+	msgs      *outbox
+	closeSlow func()
+	// token is the session token of the connection, checked again before
+	// account updates are delivered.
+	tokenMu sync.Mutex
+	token   string
+
+	topicsMu sync.Mutex
+	topics   map[string]struct{}
+
+	// pending holds the updates of topics whose snapshot has not been
+	// queued yet, so that the snapshot always comes first.
+	pendingMu sync.Mutex
+	pending   map[string][]outboxMessage
+}
+
+// deliver queues an update for topic, holding it back while the topic's
+// snapshot is being read.
+func (c *wsClient) deliver(topic, key string, msg []byte) {
+	c.pendingMu.Lock()
+	defer c.pendingMu.Unlock()
+	if held, ok := c.pending[topic]; ok {
+		c.pending[topic] = append(held, outboxMessage{key: key, msg: msg})
+		return
+	}
+	c.push(topic, key, msg)
+}
+
+// hold starts holding back the updates of topic.
+func (c *wsClient) hold(topic string) {
+	c.pendingMu.Lock()
+	defer c.pendingMu.Unlock()
+	c.pending[topic] = nil
+}
+
+// release queues the snapshot or replayed updates of topic followed by the
+// updates held back since hold. A nil start discards the held updates.
+func (c *wsClient) release(topic string, start []outboxMessage) {
+	c.pendingMu.Lock()
+	defer c.pendingMu.Unlock()
+	if start != nil {
+		for _, m := range append(start, c.pending[topic]...) {
+			c.push(topic, m.key, m.msg)
+		}
+	}
+	delete(c.pending, topic)
+}
+
+// push queues an encoded envelope for topic. Keys are scoped by topic so
+// that coalescing never merges messages of different topics.
+func (c *wsClient) push(topic, key string, msg []byte) {
+	if key != "" {
+		key = topic + "|" + key
+	}
+	if !c.msgs.push(key, msg) {
+		go c.closeSlow()
+	}
+}
+
+// send wraps payload in an envelope for topic and queues it.
+func (c *wsClient) send(msgType, topic string, seq uint64, payload []byte) {
+	msg, err := newEnvelope(msgType, topic, seq, payload)
+	if err != nil {
+		log.Printf("Error marshalling %s message: %v", topic, err)
+		return
+	}
+	c.push(topic, "", msg)
+}
+
+func (c *wsClient) setToken(token string) {
+	c.tokenMu.Lock()
+	defer c.tokenMu.Unlock()
+	c.token = token
+}
+
+func (c *wsClient) sessionToken() string {
+	c.tokenMu.Lock()
+	defer c.tokenMu.Unlock()
+	return c.token
+}
+
+// heartbeat queues a heartbeat envelope. Pending heartbeats coalesce, so a
+// slow client never has more than one queued.
+func (c *wsClient) heartbeat() {
+	msg, err := newEnvelope(wsTypeHeartbeat, "", 0, nil)
+	if err != nil {
+		return
+	}
+	c.push("", wsTypeHeartbeat, msg)
+}
+
+// sendError reports a failed command on topic with an ErrorFrame payload.
+func (c *wsClient) sendError(topic string, err error) {
+	payload, _ := json.Marshal(errorFrame(err))
+	c.send(wsTypeError, topic, 0, payload)
+}
+
+// parseTopic validates topic and splits it into its kind and argument.
+func parseTopic(topic string) (kind, arg string, err error) {
+	if topic == topicHome {
+		return topicHome, "", nil
+	}
+	kind, arg, ok := strings.Cut(topic, ":")
+	if !ok || arg == "" {
+		return "", "", invalidRequest("invalid topic %q", topic)
+	}
+	switch kind {
+	case topicVault, topicAccount, topicRound:
+		if !validAddress(arg, false) {
+			return "", "", invalidRequest("invalid address in topic %q", topic)
+		}
+		return kind, arg, nil
+	case topicGas:
+		roundDuration, err := strconv.ParseUint(arg, 10, 64)
+		if err != nil || twapWindow(roundDuration) == "" {
+			return "", "", invalidRequest("unsupported round duration in topic %q", topic)
+		}
+		return kind, arg, nil
+	}
+	return "", "", invalidRequest("unknown topic %q", topic)
+}
+
+// messageTopics returns the /ws topics an outbound message belongs to.
+// Account scoped messages are only published on the account topic.
+func messageTopics(m outboundMessage) []string {
+	switch m.stream {
+	case streamHome:
+		return []string{topicHome}
+	case streamGas:
+		if m.roundDuration != 0 {
+			return []string{topicGas + ":" + strconv.FormatUint(m.roundDuration, 10)}
+		}
+		var topics []string
+		for _, roundDuration := range gasRoundDurations {
+			topics = append(topics, topicGas+":"+strconv.FormatUint(roundDuration, 10))
+		}
+		return topics
+	case streamVault:
+		if m.account != "" {
+			return []string{topicAccount + ":" + m.account}
+		}
+		var topics []string
+		if m.vaultAddress != "" {
+			topics = append(topics, topicVault+":"+m.vaultAddress)
+		}
+		if m.roundAddress != "" {
+			topics = append(topics, topicRound+":"+m.roundAddress)
+		}
+		return topics
+	}
+	return nil
+}
+
+// publish numbers m on each of its topics and queues it on every /ws
+// client subscribed to them.
+func (dbs *dbServer) publish(m outboundMessage) {
+	dbs.topicsMu.Lock()
+	defer dbs.topicsMu.Unlock()
+	for _, topic := range messageTopics(m) {
+		dbs.topicSeq[topic]++
+		seq := dbs.topicSeq[topic]
+		msg, err := newEnvelope(m.msgType, topic, seq, m.msg)
+		if err != nil {
+			log.Printf("Error marshalling %s message: %v", topic, err)
+			continue
+		}
+		dbs.record(topic, seq, m.key, msg)
+		account, isAccount := strings.CutPrefix(topic, topicAccount+":")
+		for c := range dbs.topicSubscribers[topic] {
+			// Sessions may have expired since the subscription.
+			if isAccount && !dbs.auth.authorize(c.sessionToken(), account) {
+				continue
+			}
+			c.deliver(topic, m.key, msg)
+		}
+	}
+}
+
+// subscribeTopic adds c to topic and holds back its updates until the
+// snapshot or replay is released. The subscription starts at the last update
+// published before c joined; when resume is set and the replay buffer covers
+// the gap, the updates since resume are returned to be replayed. It returns
+// false if c already follows topic.
+func (dbs *dbServer) subscribeTopic(c *wsClient, topic string, resume *wsResume) (wsSubscription, bool) {
+	c.topicsMu.Lock()
+	defer c.topicsMu.Unlock()
+	if _, ok := c.topics[topic]; ok {
+		return wsSubscription{}, false
+	}
+	c.topics[topic] = struct{}{}
+	c.hold(topic)
+
+	dbs.topicsMu.Lock()
+	defer dbs.topicsMu.Unlock()
+	if dbs.topicSubscribers[topic] == nil {
+		dbs.topicSubscribers[topic] = make(map[*wsClient]struct{})
+	}
+	dbs.topicSubscribers[topic][c] = struct{}{}
+	sub := wsSubscription{seq: dbs.topicSeq[topic]}
+	if resume != nil && resume.Epoch == dbs.epoch {
+		sub.replay, sub.resumed = dbs.replaySince(topic, resume.Seq)
+	}
+	return sub, true
+}
+
+// unsubscribeTopic removes c from topic. It reports false if c did not
+// follow it.
+func (dbs *dbServer) unsubscribeTopic(c *wsClient, topic string) bool {
+	c.topicsMu.Lock()
+	defer c.topicsMu.Unlock()
+	if _, ok := c.topics[topic]; !ok {
+		return false
+	}
+	delete(c.topics, topic)
+
+	dbs.topicsMu.Lock()
+	defer dbs.topicsMu.Unlock()
+	delete(dbs.topicSubscribers[topic], c)
+	if len(dbs.topicSubscribers[topic]) == 0 {
+		delete(dbs.topicSubscribers, topic)
+	}
+	return true
+}
+
+// revokeAccountTopics unsubscribes c from the account topics its session no
+// longer covers and returns them.
+func (dbs *dbServer) revokeAccountTopics(c *wsClient) []string {
+	c.topicsMu.Lock()
+	var revoked []string
+	for topic := range c.topics {
+		account, ok := strings.CutPrefix(topic, topicAccount+":")
+		if ok && !dbs.auth.authorize(c.sessionToken(), account) {
+			revoked = append(revoked, topic)
+		}
+	}
+	c.topicsMu.Unlock()
+	for _, topic := range revoked {
+		dbs.unsubscribeTopic(c, topic)
+	}
+	return revoked
+}
+
+// unsubscribeAll removes c from every topic it follows.
+func (dbs *dbServer) unsubscribeAll(c *wsClient) {
+	c.topicsMu.Lock()
+	topics := make([]string, 0, len(c.topics))
+	for topic := range c.topics {
+		topics = append(topics, topic)
+	}
+	c.topicsMu.Unlock()
+	for _, topic := range topics {
+		dbs.unsubscribeTopic(c, topic)
+	}
+}
+
+// topicSnapshot returns the current state of topic, sent to a client right
+// after it subscribes.
+func (dbs *dbServer) topicSnapshot(topic string, params json.RawMessage) ([]byte, error) {
+	kind, arg, err := parseTopic(topic)
+	if err != nil {
+		return nil, err
+	}
+	switch kind {
+	case topicHome:
+		var sm subscriberHomeMessage
+		if err := decodeParams(params, &sm); err != nil {
+			return nil, err
+		}
+		return dbs.homePayload(sm)
+	case topicVault:
+		vaultState, err := dbs.db.GetVaultStateByID(arg)
+		if err != nil {
+			return nil, vaultNotFound(arg, err)
+		}
+		optionRounds, err := dbs.db.GetOptionRoundsByVaultAddress(arg)
+		if err != nil {
+			return nil, err
+		}
+		dbs.recordVaultState(vaultState)
+		for _, optionRound := range optionRounds {
+			dbs.recordOptionRound(optionRound)
+		}
+		return json.Marshal(InitialPayloadVault{
+			PayloadType:       "initial",
+			VaultState:        *vaultState,
+			OptionRoundStates: optionRounds,
+		})
+	case topicAccount:
+		var p struct {
+			VaultAddress string `json:"vaultAddress"`
+		}
+		if err := decodeParams(params, &p); err != nil {
+			return nil, err
+		}
+		if !validAddress(p.VaultAddress, false) {
+			return nil, invalidRequest("invalid vaultAddress %q", p.VaultAddress)
+		}
+		return dbs.accountPayload(arg, p.VaultAddress)
+	case topicGas:
+		roundDuration, _ := strconv.ParseUint(arg, 10, 64)
+		var p subscriberGasRequest
+		if err := decodeParams(params, &p); err != nil {
+			return nil, err
+		}
+		return dbs.gasPayload(p.StartTimestamp, p.EndTimestamp, roundDuration)
+	case topicRound:
+		optionRound, err := dbs.db.GetOptionRoundByAddress(arg)
+		if err != nil {
+			return nil, err
+		}
+		return json.Marshal(optionRound)
+	}
+	return nil, fmt.Errorf("unknown topic %q", topic)
+}
+
+func decodeParams(params json.RawMessage, v any) error {
+	if len(params) == 0 {
+		return nil
+	}
+	if err := json.Unmarshal(params, v); err != nil {
+		return invalidRequest("invalid params: %v", err)
+	}
+	return nil
+}
+
+// handleCommand applies a client command. Failures are reported to the
+// client as error messages on the command's topic.
+func (dbs *dbServer) handleCommand(c *wsClient, cmd wsCommand) {
+	switch cmd.Action {
+	case "auth":
+		session, ok := dbs.auth.session(cmd.Token)
+		if !ok {
+			c.sendError("", unauthorized("invalid or expired token"))
+			return
+		}
+		c.setToken(cmd.Token)
+		authorized, _ := json.Marshal(struct {
+			Address   string `json:"address"`
+			ExpiresAt int64  `json:"expiresAt"`
+		}{"0x" + session.address.Text(16), session.expires.Unix()})
+		c.send(wsTypeAuthorized, "", 0, authorized)
+	case "subscribe":
+		kind, arg, err := parseTopic(cmd.Topic)
+		if err != nil {
+			c.sendError(cmd.Topic, err)
+			return
+		}
+		if kind == topicAccount && !dbs.auth.authorize(c.sessionToken(), arg) {
+			c.sendError(cmd.Topic, unauthorized("authenticate with a token for this address"))
+			return
+		}
+		// Subscribe before reading the snapshot so that no update between
+		// the two is lost. Every update up to sub.seq was dispatched before
+		// the snapshot is read, so the snapshot contains it; later ones are
+		// held back and follow the snapshot.
+		sub, ok := dbs.subscribeTopic(c, cmd.Topic, cmd.Resume)
+		if !ok {
+			c.sendError(cmd.Topic, invalidRequest("already subscribed to %q", cmd.Topic))
+			return
+		}
+		subscribed, _ := json.Marshal(wsSubscribed{Epoch: dbs.epoch, Seq: sub.seq, Resumed: sub.resumed})
+		if sub.resumed {
+			start := []outboxMessage{}
+			for _, entry := range sub.replay {
+				start = append(start, outboxMessage{key: entry.key, msg: entry.msg})
+			}
+			c.send(wsTypeSubscribed, cmd.Topic, 0, subscribed)
+			c.release(cmd.Topic, start)
+			return
+		}
+		snapshot, err := dbs.topicSnapshot(cmd.Topic, cmd.Params)
+		if err == nil {
+			snapshot, err = newEnvelope(wsTypeSnapshot, cmd.Topic, sub.seq, snapshot)
+		}
+		if err != nil {
+			dbs.unsubscribeTopic(c, cmd.Topic)
+			c.release(cmd.Topic, nil)
+			c.sendError(cmd.Topic, err)
+			return
+		}
+		c.send(wsTypeSubscribed, cmd.Topic, 0, subscribed)
+		c.release(cmd.Topic, []outboxMessage{{msg: snapshot}})
+	case "unsubscribe":
+		if !dbs.unsubscribeTopic(c, cmd.Topic) {
+			c.sendError(cmd.Topic, invalidRequest("not subscribed to %q", cmd.Topic))
+			return
+		}
+		c.send(wsTypeUnsubscribed, cmd.Topic, 0, nil)
+	default:
+		c.sendError(cmd.Topic, invalidRequest("unknown action %q", cmd.Action))
+	}
+}
+
+func (dbs *dbServer) wsHandler(w http.ResponseWriter, r *http.Request) {
+	err := dbs.serveWS(r.Context(), w, r)
+	if errors.Is(err, context.Canceled) {
+		return
+	}
+	if websocket.CloseStatus(err) == websocket.StatusNormalClosure ||
+		websocket.CloseStatus(err) == websocket.StatusGoingAway {
+		return
+	}
+	if err != nil {
+		dbs.logf("%v", err)
+		return
+	}
+}
+
+// serveWS runs a multiplexed /ws connection. The client manages its topics
+// with wsCommands and every message it receives names its topic.
+func (dbs *dbServer) serveWS(ctx context.Context, w http.ResponseWriter, r *http.Request) error {
+	var mu sync.Mutex
+	var conn *websocket.Conn
+	var closed bool
+
+	c2, release, err := dbs.accept(w, r)
+	if err != nil {
+		return err
+	}
+	defer release()
+	defer c2.Close(websocket.StatusInternalError, "Internal server error")
+
+	readerCtx, cancelReader := context.WithCancel(ctx)
+	defer cancelReader()
+
+	c := &wsClient{
+		msgs:    newOutbox(dbs.subscriberMessageBuffer, dbs.slowPolicyWS),
+		topics:  make(map[string]struct{}),
+		pending: make(map[string][]outboxMessage),
+		closeSlow: func() {
+			mu.Lock()
+			defer mu.Unlock()
+			closed = true
+			if conn != nil {
+				conn.Close(websocket.StatusPolicyViolation, "connection too slow to keep up with messages")
+			}
+			cancelReader()
+		},
+	}
+	defer dbs.unsubscribeAll(c)
+
+	mu.Lock()
+	if closed {
+		mu.Unlock()
+		return net.ErrClosed
+	}
+	conn = c2
+	mu.Unlock()
+	defer conn.CloseNow()
+
+	limiter := newCommandLimiter(dbs.clientIP(r))
+	rpc := dbs.newRPCConn(ctx, conn, limiter, func(msg []byte) { c.push("", "", msg) })
+	defer rpc.stop()
+	errChan := make(chan error, 1)
+	go func() {
+		defer close(errChan)
+		for {
+			_, msg, err := conn.Read(readerCtx)
+			if err != nil {
+				errChan <- err
+				return
+			}
+			if isRPC(msg) {
+				rpc.handle(msg, c.sessionToken())
+				continue
+			}
+			var cmd wsCommand
+			if err := json.Unmarshal(msg, &cmd); err != nil {
+				c.sendError("", invalidRequest("invalid command: %v", err))
+				continue
+			}
+			if cmd.Action == "subscribe" {
+				if err := dbs.charge(limiter, commandSubscribe); err != nil {
+					if err.abusive {
+						errChan <- reject(conn, websocket.StatusPolicyViolation, "rate limit exceeded")
+						return
+					}
+					c.sendError(cmd.Topic, err)
+					continue
+				}
+			}
+			dbs.handleCommand(c, cmd)
+		}
+	}()
+
+	pingErr := dbs.keepalive(ctx, conn, c.heartbeat)
+	sessionCheck := time.NewTicker(sessionCheckInterval)
+	defer sessionCheck.Stop()
+	for {
+		select {
+		case err := <-errChan:
+			return err
+		case err := <-pingErr:
+			return err
+		case <-sessionCheck.C:
+			for _, topic := range dbs.revokeAccountTopics(c) {
+				c.sendError(topic, unauthorized("session expired"))
+			}
+		case <-c.msgs.done:
+			return net.ErrClosed
+		case <-c.msgs.ready:
+			//Push messages queued on the client outbox to the client
+			for _, msg := range c.msgs.drain() {
+				err := dbs.writeTimeout(ctx, time.Second*5, conn, msg)
+				if err != nil {
+					return err
+				}
+			}
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
@@ -0,0 +1,32 @@
+package starknet
+
+import (
+	"errors"
+	"fmt"
+	"math/big"
+)
+
+// ErrInvalidAddress is returned for strings that are not contract
+// addresses.
+var ErrInvalidAddress = errors.New("invalid Starknet address")
+
+// addressBound is the exclusive upper bound of contract addresses, 2^251.
+var addressBound = new(big.Int).Lsh(big.NewInt(1), 251)
+
+// ParseAddress parses a 0x prefixed hexadecimal contract address of at most
+// 64 digits.
+func ParseAddress(s string) (*big.Int, error) {
+	if len(s) < 3 || len(s) > 66 || s[0] != '0' || (s[1] != 'x' && s[1] != 'X') {
+		return nil, fmt.Errorf("%w: %q", ErrInvalidAddress, s)
+	}
+	for _, r := range s[2:] {
+		if !('0' <= r && r <= '9' || 'a' <= r && r <= 'f' || 'A' <= r && r <= 'F') {
+			return nil, fmt.Errorf("%w: %q", ErrInvalidAddress, s)
+		}
+	}
+	n, _ := new(big.Int).SetString(s[2:], 16)
+	if n.Cmp(addressBound) >= 0 {
+		return nil, fmt.Errorf("%w: %q", ErrInvalidAddress, s)
+	}
+	return n, nil
+}
@@ -0,0 +1,33 @@
+package starknet
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestParseAddress(t *testing.T) {
+	tests := []struct {
+		in string
+		ok bool
+	}{
+		{"0x1", true},
+		{"0x049d36570d4e46f48e99674bd3fcc84644ddd6b96f7c741b1562b82f9e004dc7", true},
+		{"0X49D36570D4E46F48E99674BD3FCC84644DDD6B96F7C741B1562B82F9E004DC7", true},
+		{"0x07ffffffffffffffffffffffffffffffffffffffffffffffffffffffffffffff", true},
+		{"0x0800000000000000000000000000000000000000000000000000000000000000", false},
+		{"0x00000000000000000000000000000000000000000000000000000000000000001", false},
+		{"0x", false},
+		{"1", false},
+		{"0xg1", false},
+		{"", false},
+	}
+	for _, tt := range tests {
+		_, err := ParseAddress(tt.in)
+		if (err == nil) != tt.ok {
+			t.Errorf("ParseAddress(%q) error = %v, want ok %t", tt.in, err, tt.ok)
+		}
+		if err != nil && !errors.Is(err, ErrInvalidAddress) {
+			t.Errorf("ParseAddress(%q) error %v is not ErrInvalidAddress", tt.in, err)
+		}
+	}
+}
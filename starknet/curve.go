@@ -0,0 +1,224 @@
+// Package starknet implements the parts of the Starknet cryptography the
+// server needs to authenticate wallets: field elements, the Pedersen hash,
+// SNIP-12 typed data and Stark-curve ECDSA verification.
+package starknet
+
+import (
+	"errors"
+	"fmt"
+	"math/big"
+	"strings"
+
+	"golang.org/x/crypto/sha3"
+)
+
+func mustHex(s string) *big.Int {
+	n, ok := new(big.Int).SetString(s, 16)
+	if !ok {
+		panic("starknet: invalid constant " + s)
+	}
+	return n
+}
+
+var (
+	// fieldPrime is the prime of the Starknet field, 2^251 + 17*2^192 + 1.
+	fieldPrime = mustHex("800000000000011000000000000000000000000000000000000000000000001")
+	// curveOrder is the order of the Stark curve's generator.
+	curveOrder = mustHex("800000000000010ffffffffffffffffb781126dcae7b2321e66a241adc64d2f")
+	// curveBeta is the constant term of y^2 = x^3 + x + beta.
+	curveBeta = mustHex("6f21413efbe40de150e596d72f7a8c5609ad26c15c915c1f4cdfcb99cee9e89")
+
+	generator = point{
+		x: mustHex("1ef15c18599971b7beced415a40f0c7deacfd9b0d1819e03d723d8bc943cfca"),
+		y: mustHex("5668060aa49730b7be4801df46ec62de53ecd11abe43a32873000c36e8dc1f"),
+	}
+
+	// pedersenPoints are the shift point followed by the points the low and
+	// high bits of both inputs are multiplied with.
+	pedersenPoints = [5]point{
+		{x: mustHex("49ee3eba8c1600700ee1b87eb599f16716b0b1022947733551fde4050ca6804"), y: mustHex("3ca0cfe4b3bc6ddf346d49d06ea0ed34e621062c0e056c1d0405d266e10268a")},
+		{x: mustHex("234287dcbaffe7f969c748655fca9e58fa8120b6d56eb0c1080d17957ebe47b"), y: mustHex("3b056f100f96fb21e889527d41f4e39940135dd7a6c94cc6ed0268ee89e5615")},
+		{x: mustHex("4fa56f376c83db33f9dab2656558f3399099ec1de5e3018b7a6932dba8aa378"), y: mustHex("3fa0984c931c9e38113e0c0e47e4401562761f92a7a23b45168f4e80ff5b54d")},
+		{x: mustHex("4ba4cc166be8dec764910f75b45f74b40c690c74709e90f3aa372f0bd2d6997"), y: mustHex("40301cf5c1751f4b971e46c4ede85fcac5c59a5ce5ae7c48151f27b24b219c")},
+		{x: mustHex("54302dcb0e6cc1c6e44cca8f61a63bb2ca65048d53fb325d36ff12c49a58202"), y: mustHex("1b77b3e37d13504b348046268d8ae25ce98ad783c25561a879dcc77e99c2426")},
+	}
+
+	// maxSignatureValue bounds r, s and the message hash of a signature.
+	maxSignatureValue = new(big.Int).Lsh(big.NewInt(1), 251)
+	lowPartMask       = new(big.Int).Sub(new(big.Int).Lsh(big.NewInt(1), 248), big.NewInt(1))
+	keccakMask        = new(big.Int).Sub(new(big.Int).Lsh(big.NewInt(1), 250), big.NewInt(1))
+)
+
+// ErrInvalidFelt is returned for values that are not field elements.
+var ErrInvalidFelt = errors.New("invalid field element")
+
+// ParseFelt parses a 0x prefixed hexadecimal or a decimal field element.
+func ParseFelt(s string) (*big.Int, error) {
+	var n *big.Int
+	var ok bool
+	if hex, found := strings.CutPrefix(strings.ToLower(s), "0x"); found {
+		n, ok = new(big.Int).SetString(hex, 16)
+	} else {
+		n, ok = new(big.Int).SetString(s, 10)
+	}
+	if !ok || n.Sign() < 0 || n.Cmp(fieldPrime) >= 0 {
+		return nil, fmt.Errorf("%w: %q", ErrInvalidFelt, s)
+	}
+	return n, nil
+}
+
+// ShortString encodes s, at most 31 ASCII characters, as a field element.
+func ShortString(s string) (*big.Int, error) {
+	if len(s) > 31 {
+		return nil, fmt.Errorf("short string %q is longer than 31 characters", s)
+	}
+	for i := 0; i < len(s); i++ {
+		if s[i] > 0x7f {
+			return nil, fmt.Errorf("short string %q is not ASCII", s)
+		}
+	}
+	return new(big.Int).SetBytes([]byte(s)), nil
+}
+
+// Keccak is the Starknet Keccak: Keccak-256 truncated to 250 bits. It
+// derives entry point selectors and SNIP-12 type hashes.
+func Keccak(data []byte) *big.Int {
+	h := sha3.NewLegacyKeccak256()
+	h.Write(data)
+	n := new(big.Int).SetBytes(h.Sum(nil))
+	return n.And(n, keccakMask)
+}
+
+// Pedersen returns the Starknet Pedersen hash of two field elements.
+func Pedersen(a, b *big.Int) *big.Int {
+	p := pedersenPoints[0]
+	for i, x := range []*big.Int{a, b} {
+		p = p.add(pedersenPoints[1+2*i].mul(new(big.Int).And(x, lowPartMask)))
+		p = p.add(pedersenPoints[2+2*i].mul(new(big.Int).Rsh(x, 248)))
+	}
+	return p.x
+}
+
+// PedersenArray hashes elements in a chain starting from zero and finally
+// with their count, as Cairo's compute_hash_on_elements does.
+func PedersenArray(elements ...*big.Int) *big.Int {
+	h := new(big.Int)
+	for _, e := range elements {
+		h = Pedersen(h, e)
+	}
+	return Pedersen(h, big.NewInt(int64(len(elements))))
+}
+
+// Verify reports whether (r, s) is a Stark-curve ECDSA signature of
+// msgHash by the key whose x coordinate is publicKey.
+func Verify(msgHash, r, s, publicKey *big.Int) bool {
+	for _, n := range []*big.Int{r, s} {
+		if n.Sign() <= 0 || n.Cmp(maxSignatureValue) >= 0 {
+			return false
+		}
+	}
+	if msgHash.Sign() < 0 || msgHash.Cmp(maxSignatureValue) >= 0 {
+		return false
+	}
+	q, ok := pointFromX(publicKey)
+	if !ok {
+		return false
+	}
+	w := new(big.Int).ModInverse(s, curveOrder)
+	if w == nil {
+		return false
+	}
+	u1 := new(big.Int).Mul(msgHash, w)
+	u1.Mod(u1, curveOrder)
+	u2 := new(big.Int).Mul(r, w)
+	u2.Mod(u2, curveOrder)
+	g := generator.mul(u1)
+	// Only the x coordinate of the key is known, so accept either point.
+	for _, key := range []point{q, q.neg()} {
+		p := g.add(key.mul(u2))
+		if !p.isInfinity() && new(big.Int).Mod(p.x, curveOrder).Cmp(r) == 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// point is an affine point of the Stark curve. The point at infinity has a
+// nil x.
+type point struct {
+	x, y *big.Int
+}
+
+func pointFromX(x *big.Int) (point, bool) {
+	if x.Sign() <= 0 || x.Cmp(fieldPrime) >= 0 {
+		return point{}, false
+	}
+	rhs := new(big.Int).Exp(x, big.NewInt(3), fieldPrime)
+	rhs.Add(rhs, x)
+	rhs.Add(rhs, curveBeta)
+	rhs.Mod(rhs, fieldPrime)
+	y := new(big.Int).ModSqrt(rhs, fieldPrime)
+	if y == nil {
+		return point{}, false
+	}
+	return point{x: new(big.Int).Set(x), y: y}, true
+}
+
+func (p point) isInfinity() bool {
+	return p.x == nil
+}
+
+func (p point) neg() point {
+	if p.isInfinity() {
+		return p
+	}
+	return point{x: p.x, y: new(big.Int).Sub(fieldPrime, p.y)}
+}
+
+func (p point) add(q point) point {
+	if p.isInfinity() {
+		return q
+	}
+	if q.isInfinity() {
+		return p
+	}
+	var slope *big.Int
+	if p.x.Cmp(q.x) == 0 {
+		sum := new(big.Int).Add(p.y, q.y)
+		if sum.Mod(sum, fieldPrime).Sign() == 0 {
+			return point{}
+		}
+		// Doubling: (3x^2 + 1) / 2y
+		num := new(big.Int).Mul(p.x, p.x)
+		num.Mul(num, big.NewInt(3))
+		num.Add(num, big.NewInt(1))
+		den := new(big.Int).Lsh(p.y, 1)
+		slope = num.Mul(num, den.ModInverse(den, fieldPrime))
+	} else {
+		num := new(big.Int).Sub(q.y, p.y)
+		den := new(big.Int).Sub(q.x, p.x)
+		den.Mod(den, fieldPrime)
+		slope = num.Mul(num, den.ModInverse(den, fieldPrime))
+	}
+	slope.Mod(slope, fieldPrime)
+	x := new(big.Int).Mul(slope, slope)
+	x.Sub(x, p.x)
+	x.Sub(x, q.x)
+	x.Mod(x, fieldPrime)
+	y := new(big.Int).Sub(p.x, x)
+	y.Mul(y, slope)
+	y.Sub(y, p.y)
+	y.Mod(y, fieldPrime)
+	return point{x: x, y: y}
+}
+
+func (p point) mul(k *big.Int) point {
+	var r point
+	for i := k.BitLen() - 1; i >= 0; i-- {
+		r = r.add(r)
+		if k.Bit(i) == 1 {
+			r = r.add(p)
+		}
+	}
+	return r
+}
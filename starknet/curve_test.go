@@ -0,0 +1,126 @@
+package starknet
+
+import (
+	"math/big"
+	"testing"
+)
+
+func felt(t *testing.T, s string) *big.Int {
+	t.Helper()
+	n, err := ParseFelt(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return n
+}
+
+// Pedersen vectors from Starkware's crypto test data.
+func TestPedersen(t *testing.T) {
+	tests := []struct {
+		a, b, want string
+	}{
+		{
+			"0x3d937c035c878245caf64531a5756109c53068da139362728feb561405371cb",
+			"0x208a0a10250e382e1e4bbe2880906c2791bf6275695e02fbbc6aeff9cd8b31a",
+			"0x30e480bed5fe53fa909cc0f8c4d99b8f9f2c016be4c41e13a4848797979c662",
+		},
+		{
+			"0x58f580910a6ca59b28927c08fe6c43e2e303ca384badc365795fc645d479d45",
+			"0x78734f65a067be9bdb39de18434d71e79f7b6466a4b66bbd979ab9e7515fe0b",
+			"0x68cc0b76cddd1dd4ed2301ada9b7c872b23875d5ff837b3a87993e0d9996b87",
+		},
+	}
+	for _, tt := range tests {
+		if got := Pedersen(felt(t, tt.a), felt(t, tt.b)); got.Cmp(felt(t, tt.want)) != 0 {
+			t.Errorf("Pedersen(%s, %s) = %#x, want %s", tt.a, tt.b, got, tt.want)
+		}
+	}
+}
+
+func TestKeccak(t *testing.T) {
+	// The selector of "transfer".
+	want := felt(t, "0x83afd3f4caedc6eebf44246fe54e38c95e3179a5ec9ea81740eca5b482d12e")
+	if got := Keccak([]byte("transfer")); got.Cmp(want) != 0 {
+		t.Errorf("Keccak(transfer) = %#x, want %#x", got, want)
+	}
+}
+
+// The signature of party_a_order in Starkware's signature test data, by the
+// key 0x3c1e9550e66958296d11b60f8e8e7a7ad990d07fa65d5f7652c4a6c87d4e3cc.
+const (
+	testPublicKey = "0x77a3b314db07c45076d11f62b6f9e748a39790441823307743cf00d6597ea43"
+	testMsgHash   = "0x397e76d1667c4454bfb83514e120583af836f8e32a516765497823eabe16a3f"
+	testR         = "0x173fd03d8b008ee7432977ac27d1e9d1a1f6c98b1a2f05fa84a21c84c44e882"
+	testS         = "0x4b6d75385aed025aa222f28a0adc6d58db78ff17e51c3f59e259b131cd5a1cc"
+)
+
+func TestPublicKey(t *testing.T) {
+	key := generator.mul(felt(t, "0x3c1e9550e66958296d11b60f8e8e7a7ad990d07fa65d5f7652c4a6c87d4e3cc"))
+	if key.x.Cmp(felt(t, testPublicKey)) != 0 {
+		t.Errorf("public key = %#x, want %s", key.x, testPublicKey)
+	}
+}
+
+func TestVerify(t *testing.T) {
+	one := big.NewInt(1)
+	tests := []struct {
+		name                  string
+		msgHash, r, s, pubKey *big.Int
+		want                  bool
+	}{
+		{"valid", felt(t, testMsgHash), felt(t, testR), felt(t, testS), felt(t, testPublicKey), true},
+		{"tampered hash", new(big.Int).Add(felt(t, testMsgHash), one), felt(t, testR), felt(t, testS), felt(t, testPublicKey), false},
+		{"tampered r", felt(t, testMsgHash), new(big.Int).Add(felt(t, testR), one), felt(t, testS), felt(t, testPublicKey), false},
+		{"tampered s", felt(t, testMsgHash), felt(t, testR), new(big.Int).Add(felt(t, testS), one), felt(t, testPublicKey), false},
+		{"other key", felt(t, testMsgHash), felt(t, testR), felt(t, testS), generator.x, false},
+		{"zero r", felt(t, testMsgHash), new(big.Int), felt(t, testS), felt(t, testPublicKey), false},
+		{"s out of range", felt(t, testMsgHash), felt(t, testR), new(big.Int).Lsh(one, 251), felt(t, testPublicKey), false},
+		{"key off the curve", felt(t, testMsgHash), felt(t, testR), felt(t, testS), big.NewInt(0), false},
+	}
+	for _, tt := range tests {
+		if got := Verify(tt.msgHash, tt.r, tt.s, tt.pubKey); got != tt.want {
+			t.Errorf("%s: Verify = %t, want %t", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestParseFelt(t *testing.T) {
+	tests := []struct {
+		in   string
+		want string
+		ok   bool
+	}{
+		{"0x1f", "31", true},
+		{"0X1F", "31", true},
+		{"31", "31", true},
+		// The field prime and the largest felt below it.
+		{"0x800000000000011000000000000000000000000000000000000000000000001", "", false},
+		{"0x800000000000011000000000000000000000000000000000000000000000000", "3618502788666131213697322783095070105623107215331596699973092056135872020480", true},
+		{"-1", "", false},
+		{"0xzz", "", false},
+		{"", "", false},
+	}
+	for _, tt := range tests {
+		got, err := ParseFelt(tt.in)
+		if (err == nil) != tt.ok {
+			t.Errorf("ParseFelt(%q) error = %v, want ok %t", tt.in, err, tt.ok)
+			continue
+		}
+		if tt.ok && got.String() != tt.want {
+			t.Errorf("ParseFelt(%q) = %s, want %s", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestShortString(t *testing.T) {
+	got, err := ShortString("StarkNet Message")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := felt(t, "0x537461726b4e6574204d657373616765"); got.Cmp(want) != 0 {
+		t.Errorf("ShortString = %#x, want %#x", got, want)
+	}
+	if _, err := ShortString("this string is longer than 31 chars"); err == nil {
+		t.Error("ShortString accepted 35 characters")
+	}
+}
@@ -0,0 +1,87 @@
+package starknet
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"net/http"
+)
+
+// Client calls view functions through a Starknet JSON-RPC node.
+type Client struct {
+	URL        string
+	HTTPClient *http.Client
+}
+
+type rpcError struct {
+	Code    int             `json:"code"`
+	Message string          `json:"message"`
+	Data    json.RawMessage `json:"data,omitempty"`
+}
+
+func (e *rpcError) Error() string {
+	return fmt.Sprintf("rpc error %d: %s", e.Code, e.Message)
+}
+
+// Call invokes entryPoint of contract on the latest block and returns its
+// result.
+func (c *Client) Call(ctx context.Context, contract *big.Int, entryPoint string, calldata ...*big.Int) ([]*big.Int, error) {
+	encoded := make([]string, 0, len(calldata))
+	for _, d := range calldata {
+		encoded = append(encoded, "0x"+d.Text(16))
+	}
+	body, err := json.Marshal(map[string]any{
+		"jsonrpc": "2.0",
+		"id":      1,
+		"method":  "starknet_call",
+		"params": map[string]any{
+			"request": map[string]any{
+				"contract_address":     "0x" + contract.Text(16),
+				"entry_point_selector": "0x" + Keccak([]byte(entryPoint)).Text(16),
+				"calldata":             encoded,
+			},
+			"block_id": "latest",
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, c.URL, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	httpClient := c.HTTPClient
+	if httpClient == nil {
+		httpClient = http.DefaultClient
+	}
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("starknet_call %s: %s", entryPoint, resp.Status)
+	}
+	var response struct {
+		Result []string  `json:"result"`
+		Error  *rpcError `json:"error"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&response); err != nil {
+		return nil, fmt.Errorf("starknet_call %s: %w", entryPoint, err)
+	}
+	if response.Error != nil {
+		return nil, fmt.Errorf("starknet_call %s: %w", entryPoint, response.Error)
+	}
+	result := make([]*big.Int, 0, len(response.Result))
+	for _, r := range response.Result {
+		n, err := ParseFelt(r)
+		if err != nil {
+			return nil, fmt.Errorf("starknet_call %s: %w", entryPoint, err)
+		}
+		result = append(result, n)
+	}
+	return result, nil
+}
@@ -0,0 +1,154 @@
+package starknet
+
+import (
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"sort"
+	"strings"
+)
+
+// TypedData is a SNIP-12 message in revision 0, the Pedersen based
+// revision every wallet supports. Members are felts, felt arrays or other
+// structs declared in Types.
+type TypedData struct {
+	Types       map[string][]TypeMember `json:"types"`
+	PrimaryType string                  `json:"primaryType"`
+	Domain      map[string]any          `json:"domain"`
+	Message     map[string]any          `json:"message"`
+}
+
+type TypeMember struct {
+	Name string `json:"name"`
+	Type string `json:"type"`
+}
+
+const domainType = "StarkNetDomain"
+
+// MessageHash returns the hash account signs for td.
+func (td TypedData) MessageHash(account *big.Int) (*big.Int, error) {
+	prefix, _ := ShortString("StarkNet Message")
+	domain, err := td.structHash(domainType, td.Domain)
+	if err != nil {
+		return nil, fmt.Errorf("domain: %w", err)
+	}
+	message, err := td.structHash(td.PrimaryType, td.Message)
+	if err != nil {
+		return nil, fmt.Errorf("message: %w", err)
+	}
+	return PedersenArray(prefix, domain, account, message), nil
+}
+
+// encodeType returns the type followed by the types it depends on, sorted
+// by name.
+func (td TypedData) encodeType(typeName string) string {
+	deps := map[string]bool{}
+	td.dependencies(typeName, deps)
+	delete(deps, typeName)
+	names := make([]string, 0, len(deps))
+	for name := range deps {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var b strings.Builder
+	for _, name := range append([]string{typeName}, names...) {
+		b.WriteString(name + "(")
+		for i, m := range td.Types[name] {
+			if i > 0 {
+				b.WriteString(",")
+			}
+			b.WriteString(m.Name + ":" + m.Type)
+		}
+		b.WriteString(")")
+	}
+	return b.String()
+}
+
+func (td TypedData) dependencies(typeName string, deps map[string]bool) {
+	if deps[typeName] {
+		return
+	}
+	if _, ok := td.Types[typeName]; !ok {
+		return
+	}
+	deps[typeName] = true
+	for _, m := range td.Types[typeName] {
+		td.dependencies(strings.TrimSuffix(m.Type, "*"), deps)
+	}
+}
+
+func (td TypedData) structHash(typeName string, data map[string]any) (*big.Int, error) {
+	members, ok := td.Types[typeName]
+	if !ok {
+		return nil, fmt.Errorf("unknown type %q", typeName)
+	}
+	elements := []*big.Int{Keccak([]byte(td.encodeType(typeName)))}
+	for _, m := range members {
+		value, ok := data[m.Name]
+		if !ok {
+			return nil, fmt.Errorf("missing %s", m.Name)
+		}
+		encoded, err := td.encodeValue(m.Type, value)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", m.Name, err)
+		}
+		elements = append(elements, encoded)
+	}
+	return PedersenArray(elements...), nil
+}
+
+func (td TypedData) encodeValue(typeName string, value any) (*big.Int, error) {
+	if elemType, ok := strings.CutSuffix(typeName, "*"); ok {
+		values, ok := value.([]any)
+		if !ok {
+			return nil, fmt.Errorf("expected an array, got %T", value)
+		}
+		elements := make([]*big.Int, 0, len(values))
+		for _, v := range values {
+			encoded, err := td.encodeValue(elemType, v)
+			if err != nil {
+				return nil, err
+			}
+			elements = append(elements, encoded)
+		}
+		return PedersenArray(elements...), nil
+	}
+	if _, ok := td.Types[typeName]; ok {
+		data, ok := value.(map[string]any)
+		if !ok {
+			return nil, fmt.Errorf("expected a %s object, got %T", typeName, value)
+		}
+		return td.structHash(typeName, data)
+	}
+	if typeName != "felt" {
+		return nil, fmt.Errorf("unsupported type %q", typeName)
+	}
+	return encodeFelt(value)
+}
+
+// encodeFelt encodes numbers and numeric strings as their value and any
+// other string as a short string, as wallets do.
+func encodeFelt(value any) (*big.Int, error) {
+	switch v := value.(type) {
+	case string:
+		if n, err := ParseFelt(v); err == nil {
+			return n, nil
+		}
+		return ShortString(v)
+	case json.Number:
+		return ParseFelt(v.String())
+	case float64:
+		if v < 0 || v != float64(int64(v)) {
+			return nil, fmt.Errorf("%w: %v", ErrInvalidFelt, v)
+		}
+		return big.NewInt(int64(v)), nil
+	case int:
+		return ParseFelt(fmt.Sprint(v))
+	case int64:
+		return ParseFelt(fmt.Sprint(v))
+	case uint64:
+		return ParseFelt(fmt.Sprint(v))
+	}
+	return nil, fmt.Errorf("unsupported felt value %T", value)
+}
@@ -0,0 +1,94 @@
+package starknet
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+// typedDataExample is the mail example of starknet.js' typed data tests.
+const typedDataExample = `{
+	"types": {
+		"StarkNetDomain": [
+			{"name": "name", "type": "felt"},
+			{"name": "version", "type": "felt"},
+			{"name": "chainId", "type": "felt"}
+		],
+		"Person": [
+			{"name": "name", "type": "felt"},
+			{"name": "wallet", "type": "felt"}
+		],
+		"Mail": [
+			{"name": "from", "type": "Person"},
+			{"name": "to", "type": "Person"},
+			{"name": "contents", "type": "felt"}
+		]
+	},
+	"primaryType": "Mail",
+	"domain": {"name": "StarkNet Mail", "version": "1", "chainId": 1},
+	"message": {
+		"from": {"name": "Cow", "wallet": "0xCD2a3d9F938E13CD947Ec05AbC7FE734Df8DD826"},
+		"to": {"name": "Bob", "wallet": "0xbBbBBBBbbBBBbbbBbbBbbbbBBbBbbbbBbBbbBBbB"},
+		"contents": "Hello, Bob!"
+	}
+}`
+
+func exampleTypedData(t *testing.T) TypedData {
+	t.Helper()
+	var td TypedData
+	if err := json.Unmarshal([]byte(typedDataExample), &td); err != nil {
+		t.Fatal(err)
+	}
+	return td
+}
+
+func TestEncodeType(t *testing.T) {
+	td := exampleTypedData(t)
+	if got, want := td.encodeType("Mail"), "Mail(from:Person,to:Person,contents:felt)Person(name:felt,wallet:felt)"; got != want {
+		t.Errorf("encodeType(Mail) = %q, want %q", got, want)
+	}
+	if got, want := td.encodeType(domainType), "StarkNetDomain(name:felt,version:felt,chainId:felt)"; got != want {
+		t.Errorf("encodeType(StarkNetDomain) = %q, want %q", got, want)
+	}
+}
+
+func TestTypeHash(t *testing.T) {
+	td := exampleTypedData(t)
+	tests := map[string]string{
+		domainType: "0x1bfc207425a47a5dfa1a50a4f5241203f50624ca5fdf5e18755765416b8e288",
+		"Mail":     "0x13d89452df9512bf750f539ba3001b945576243288137ddb6c788457d4b2f79",
+	}
+	for typeName, want := range tests {
+		if got := Keccak([]byte(td.encodeType(typeName))); got.Cmp(felt(t, want)) != 0 {
+			t.Errorf("type hash of %s = %#x, want %s", typeName, got, want)
+		}
+	}
+}
+
+func TestMessageHash(t *testing.T) {
+	td := exampleTypedData(t)
+	got, err := td.MessageHash(felt(t, "0xcd2a3d9f938e13cd947ec05abc7fe734df8dd826"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := felt(t, "0x6fcff244f63e38b9d88b9e3378d44757710d1b244282b435cb472053c8d78d0"); got.Cmp(want) != 0 {
+		t.Errorf("MessageHash = %#x, want %#x", got, want)
+	}
+
+	// Any change to the message changes the hash.
+	td.Message["contents"] = "Hello, Eve!"
+	tampered, err := td.MessageHash(felt(t, "0xcd2a3d9f938e13cd947ec05abc7fe734df8dd826"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tampered.Cmp(got) == 0 {
+		t.Error("MessageHash ignores the message contents")
+	}
+}
+
+func TestMessageHashErrors(t *testing.T) {
+	td := exampleTypedData(t)
+	td.PrimaryType = "Letter"
+	if _, err := td.MessageHash(felt(t, "0x1")); err == nil {
+		t.Error("MessageHash accepted an undeclared primary type")
+	}
+}